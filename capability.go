@@ -0,0 +1,50 @@
+package main
+
+import "Etherfile/p2p"
+
+/**
+能力: 握手时节点声明自己支持的功能
+加密格式必须和对方一致 否则对方存储的密文在本节点无法解密 不一致时握手失败
+*/
+
+const (
+	CapEncryptGCM = "enc:gcm"
+	CapEncryptCTR = "enc:ctr"
+	CapKeyring    = "keyring"
+	CapEnvelope   = "envelope"
+	CapChunked    = "chunked"
+	CapRange      = "range"
+	CapDHT        = "dht"
+	CapGossip     = "gossip"
+	CapRepair     = "repair"
+)
+
+// encryptionCapabilities 加密器对应的密文格式
+func encryptionCapabilities(e Encrypter) []string {
+	switch e := e.(type) {
+	case *KeyringEncrypter:
+		return append([]string{CapKeyring}, encryptionCapabilities(e.Encrypter)...)
+	case *GCMEncrypter:
+		return []string{CapEncryptGCM}
+	case *DefaultEncrypter:
+		return []string{CapEncryptCTR}
+	}
+	return nil
+}
+
+// Capabilities 使用加密器e的节点支持的功能
+func Capabilities(e Encrypter) []string {
+	return append(encryptionCapabilities(e), CapEnvelope, CapChunked, CapRange, CapDHT, CapGossip, CapRepair)
+}
+
+// NewHandshakeOpts 握手时发送本节点的信息 并要求对方使用相同的加密格式
+func NewHandshakeOpts(nodeID p2p.NodeID, listenAddr string, e Encrypter) p2p.HandshakeOpts {
+	return p2p.HandshakeOpts{
+		Local: p2p.PeerInfo{
+			NodeID:       nodeID,
+			ListenAddr:   listenAddr,
+			Capabilities: Capabilities(e),
+		},
+		Required: encryptionCapabilities(e),
+	}
+}
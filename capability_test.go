@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapabilities(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+
+	opts := NewHandshakeOpts([32]byte{1}, ":3000", NewKeyringEncrypter(kr, NewGCMEncrypter()))
+	assert.Equal(t, []string{CapKeyring, CapEncryptGCM}, opts.Required)
+	assert.Subset(t, opts.Local.Capabilities, []string{CapKeyring, CapEncryptGCM, CapChunked, CapRange})
+
+	// 不同的加密格式要求不同的能力
+	assert.Equal(t, []string{CapEncryptCTR}, NewHandshakeOpts([32]byte{1}, ":3000", NewDefaultEncrypter()).Required)
+}
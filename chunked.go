@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+/**
+分块存储: 文件按内容切分为块 每块以其明文的CID为key单独存储(相同的块只存一份)
+清单(Manifest)按顺序列出所有块 并记录由块摘要构成的Merkle树根 清单本身以文件的key存储
+读取时可以只获取需要的块 缺少的块并行地从网络中获取
+*/
+
+const (
+	manifestVersion         = 1
+	DefaultFetchConcurrency = 4
+)
+
+var ErrBadManifest = errors.New("manifest: merkle root does not match chunks")
+
+// ChunkRef 清单中的一个块
+type ChunkRef struct {
+	CID  CID   `json:"cid"`
+	Size int64 `json:"size"`
+}
+
+// Manifest 分块存储文件的清单
+type Manifest struct {
+	Version int        `json:"version"`
+	Size    int64      `json:"size"`
+	Root    string     `json:"root"`
+	Chunks  []ChunkRef `json:"chunks"`
+}
+
+func NewManifest(chunks []ChunkRef) *Manifest {
+	m := &Manifest{
+		Version: manifestVersion,
+		Chunks:  chunks,
+	}
+	for _, c := range chunks {
+		m.Size += c.Size
+	}
+	m.Root = hex.EncodeToString(m.merkleRoot())
+	return m
+}
+
+func (m *Manifest) merkleRoot() []byte {
+	leaves := make([][]byte, len(m.Chunks))
+	for i, c := range m.Chunks {
+		leaves[i] = c.CID.Digest()
+	}
+	return MerkleRoot(leaves)
+}
+
+// Verify 校验清单中的块与Merkle树根是否一致
+func (m *Manifest) Verify() error {
+	if m.Version != manifestVersion {
+		return fmt.Errorf("manifest: unsupported version %d", m.Version)
+	}
+	if m.Root != hex.EncodeToString(m.merkleRoot()) {
+		return ErrBadManifest
+	}
+	return nil
+}
+
+// ChunksInRange 返回覆盖[offset, offset+length)的块的下标范围[first, last) 以及第一个块的起始偏移
+func (m *Manifest) ChunksInRange(offset, length int64) (first, last int, start int64) {
+	end := offset + length
+	pos := int64(0)
+	first, last = len(m.Chunks), len(m.Chunks)
+	for i, c := range m.Chunks {
+		if first == len(m.Chunks) && pos+c.Size > offset {
+			first, start = i, pos
+		}
+		if pos >= end {
+			last = i
+			break
+		}
+		pos += c.Size
+	}
+	if first > last {
+		first = last
+	}
+	return first, last, start
+}
+
+// MerkleRoot 计算叶子的Merkle树根 叶子和内部节点使用不同的前缀防止第二原像攻击
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	}
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		sum := sha256.Sum256(append([]byte{0x00}, leaf...))
+		level[i] = sum[:]
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				// 奇数个节点时最后一个直接提升到上一层
+				next = append(next, level[i])
+				continue
+			}
+			node := append([]byte{0x01}, level[i]...)
+			sum := sha256.Sum256(append(node, level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// StoreChunked 将文件切分为块分别存储 再以key存储文件的清单
+func (fs *FileServer) StoreChunked(key string, r io.Reader) (*Manifest, error) {
+	var (
+		chunker = NewChunker(r, fs.ChunkerOpts)
+		chunks  []ChunkRef
+	)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		cid, err := fs.StoreContent(bytes.NewReader(chunk))
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, ChunkRef{CID: cid, Size: int64(len(chunk))})
+	}
+
+	m := NewManifest(chunks)
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.Store(key, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	log.Printf("[%s] stored %s as %d chunks\n", fs.ListenAddr, key, len(chunks))
+	return m, nil
+}
+
+// GetManifest 获取并校验文件的清单
+func (fs *FileServer) GetManifest(key string) (*Manifest, error) {
+	r, err := fs.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	m := new(Manifest)
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	if err := m.Verify(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetChunked 获取分块存储的文件 所有块就绪后按顺序边读边解密
+func (fs *FileServer) GetChunked(key string) (io.ReadCloser, error) {
+	m, err := fs.GetManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.fetchChunks(m.Chunks); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for _, c := range m.Chunks {
+			r, err := fs.getReplicated(c.CID.String())
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			_, err = io.Copy(pw, r)
+			r.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+// fetchChunks 并行获取本地缺少并且由本节点负责的块 其他块读取时再从网络中获取
+func (fs *FileServer) fetchChunks(chunks []ChunkRef) error {
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, fs.FetchConcurrency)
+		errOnce  sync.Once
+		fetchErr error
+	)
+	for _, c := range chunks {
+		if fs.store.Exists(c.CID.String()) || !fs.ownsKey(c.CID.String()) {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c ChunkRef) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fs.fetch(c.CID.String()); err != nil {
+				errOnce.Do(func() {
+					fetchErr = fmt.Errorf("fetch chunk %s: %w", c.CID, err)
+				})
+			}
+		}(c)
+	}
+	wg.Wait()
+	return fetchErr
+}
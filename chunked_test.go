@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileServer_StoreChunked(t *testing.T) {
+	fs := newTestServer(t)
+	data := make([]byte, 1024*1024)
+	_, _ = io.ReadFull(rand.Reader, data)
+
+	m, err := fs.StoreChunked("big_file", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), m.Size)
+	assert.Nil(t, m.Verify())
+
+	r, err := fs.GetChunked("big_file")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	assert.True(t, bytes.Equal(data, got))
+
+	// 新版本只修改了末尾 之前的块可以复用
+	v2 := append(append([]byte{}, data...), []byte("appended in v2")...)
+	m2, err := fs.StoreChunked("big_file_v2", bytes.NewReader(v2))
+	assert.Nil(t, err)
+	assert.Equal(t, m.Chunks[:len(m.Chunks)-1], m2.Chunks[:len(m.Chunks)-1])
+	assert.NotEqual(t, m.Root, m2.Root)
+
+	m.Chunks[0], m.Chunks[1] = m.Chunks[1], m.Chunks[0]
+	assert.Equal(t, ErrBadManifest, m.Verify())
+}
+
+func TestManifest_ChunksInRange(t *testing.T) {
+	m := NewManifest([]ChunkRef{{Size: 10}, {Size: 10}, {Size: 10}})
+	first, last, start := m.ChunksInRange(15, 10)
+	assert.Equal(t, []any{1, 3, int64(10)}, []any{first, last, start})
+	first, last, start = m.ChunksInRange(0, 10)
+	assert.Equal(t, []any{0, 1, int64(0)}, []any{first, last, start})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+/**
+基于内容的分块(FastCDC): 用gear滚动哈希在内容中寻找切分点
+切分点只取决于附近的内容 文件中间插入或删除数据时 之后的块仍然能和旧版本对齐从而被去重
+*/
+
+const (
+	DefaultMinChunkSize = 16 * 1024
+	DefaultAvgChunkSize = 64 * 1024
+	DefaultMaxChunkSize = 256 * 1024
+)
+
+// gearTable 每个字节对应的随机数 由固定种子生成 保证所有节点切分结果一致
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		sum := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return table
+}()
+
+type ChunkerOpts struct {
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// Chunker 将流切分为大小在[MinSize, MaxSize]之间的块
+type Chunker struct {
+	ChunkerOpts
+	r     *bufio.Reader
+	maskS uint64 // 平均大小之前使用 更难命中切分点
+	maskL uint64 // 平均大小之后使用 更容易命中切分点
+}
+
+func NewChunker(r io.Reader, opts ChunkerOpts) *Chunker {
+	if opts.MinSize <= 0 {
+		opts.MinSize = DefaultMinChunkSize
+	}
+	if opts.AvgSize <= opts.MinSize {
+		opts.AvgSize = max(DefaultAvgChunkSize, 2*opts.MinSize)
+	}
+	if opts.MaxSize <= opts.AvgSize {
+		opts.MaxSize = max(DefaultMaxChunkSize, 2*opts.AvgSize)
+	}
+	bits := 0
+	for 1<<(bits+1) <= opts.AvgSize {
+		bits++
+	}
+	return &Chunker{
+		ChunkerOpts: opts,
+		r:           bufio.NewReaderSize(r, opts.MaxSize),
+		maskS:       highBitsMask(bits + 2),
+		maskL:       highBitsMask(bits - 2),
+	}
+}
+
+// Next 返回下一个块 没有更多数据时返回io.EOF
+func (c *Chunker) Next() ([]byte, error) {
+	data, err := c.r.Peek(c.MaxSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+	n := c.cut(data)
+	chunk := make([]byte, n)
+	copy(chunk, data[:n])
+	if _, err := c.r.Discard(n); err != nil {
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// cut 返回data中第一个切分点的位置
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.MinSize {
+		return n
+	}
+	normal := min(c.AvgSize, n)
+	h := uint64(0)
+	i := c.MinSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// highBitsMask 高位的bits个1 高位受最近64个字节影响
+func highBitsMask(bits int) uint64 {
+	return ^uint64(0) << (64 - bits)
+}
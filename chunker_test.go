@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	var chunks [][]byte
+	c := NewChunker(bytes.NewReader(data), ChunkerOpts{})
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		assert.Nil(t, err)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestChunker_Boundaries(t *testing.T) {
+	data := make([]byte, 2*1024*1024)
+	_, _ = io.ReadFull(rand.Reader, data)
+
+	chunks := chunkAll(t, data)
+	assert.True(t, len(chunks) > 1)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+	for _, chunk := range chunks[:len(chunks)-1] {
+		assert.GreaterOrEqual(t, len(chunk), DefaultMinChunkSize)
+		assert.LessOrEqual(t, len(chunk), DefaultMaxChunkSize)
+	}
+
+	// 在开头插入数据后 大部分块仍然相同
+	shifted := chunkAll(t, append([]byte("inserted at the front"), data...))
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		seen[string(chunk)] = true
+	}
+	same := 0
+	for _, chunk := range shifted {
+		if seen[string(chunk)] {
+			same++
+		}
+	}
+	assert.GreaterOrEqual(t, same, len(chunks)-2)
+}
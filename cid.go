@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+)
+
+/**
+内容标识(CID): 文件明文的SHA-256摘要 格式为 "sha256-<64位十六进制>"
+以CID为key存储的文件 相同内容只会保存一次 读取时会校验内容与CID是否一致
+*/
+
+const cidPrefix = "sha256-"
+
+var (
+	ErrInvalidCID  = errors.New("cid: invalid content id")
+	ErrCIDMismatch = errors.New("cid: content does not match content id")
+)
+
+type CID string
+
+// NewCID 由SHA-256摘要生成CID
+func NewCID(digest []byte) CID {
+	return CID(cidPrefix + hex.EncodeToString(digest))
+}
+
+// ParseCID 解析CID字符串
+func ParseCID(s string) (CID, error) {
+	if !strings.HasPrefix(s, cidPrefix) {
+		return "", ErrInvalidCID
+	}
+	digest, err := hex.DecodeString(s[len(cidPrefix):])
+	if err != nil || len(digest) != sha256.Size {
+		return "", ErrInvalidCID
+	}
+	return CID(s), nil
+}
+
+func (c CID) String() string {
+	return string(c)
+}
+
+// Digest 返回CID中的SHA-256摘要
+func (c CID) Digest() []byte {
+	digest, _ := hex.DecodeString(strings.TrimPrefix(string(c), cidPrefix))
+	return digest
+}
+
+// cidHasher 在流式读写的同时计算CID
+type cidHasher struct {
+	hash.Hash
+}
+
+func newCIDHasher() *cidHasher {
+	return &cidHasher{sha256.New()}
+}
+
+func (h *cidHasher) CID() CID {
+	return NewCID(h.Sum(nil))
+}
+
+// ComputeCID 计算r中内容的CID
+func ComputeCID(r io.Reader) (CID, error) {
+	h := newCIDHasher()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return h.CID(), nil
+}
+
+// cidVerifyReader 读取的同时计算CID 读到结尾时内容与CID不一致则返回ErrCIDMismatch
+type cidVerifyReader struct {
+	io.ReadCloser
+	cid    CID
+	hasher *cidHasher
+}
+
+func newCIDVerifyReader(r io.ReadCloser, cid CID) *cidVerifyReader {
+	return &cidVerifyReader{
+		ReadCloser: r,
+		cid:        cid,
+		hasher:     newCIDHasher(),
+	}
+}
+
+func (r *cidVerifyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hasher.Write(p[:n])
+	if err == io.EOF && r.hasher.CID() != r.cid {
+		return n, ErrCIDMismatch
+	}
+	return n, err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"Etherfile/p2p"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+/**
+连接管理: 记录希望保持连接的节点(引导节点和gossip得知的成员) 没有连接时在后台重新拨号
+连续失败时按指数增长并带随机抖动的间隔重试 避免所有节点同时重连 同一时间拨号的数量有上限
+*/
+
+const (
+	DefaultMaxConcurrentDials  = 4
+	DefaultReconnectMinBackoff = 500 * time.Millisecond
+	DefaultReconnectMaxBackoff = 30 * time.Second
+	// 没有需要重试的节点时检查连接的间隔
+	reconnectCheckInterval = time.Second
+)
+
+// dialTarget 希望保持连接的节点 name是节点的标识 连接成功之前可能未知
+type dialTarget struct {
+	addr     string
+	name     string
+	attempts int
+	next     time.Time
+	dialing  bool
+}
+
+type connManager struct {
+	// dial 建立连接 握手完成后返回
+	dial func(addr string) (p2p.Peer, error)
+	// connected 是否已经与name建立了连接
+	connected  func(name string) bool
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	sem     chan struct{}
+	wakeup  chan struct{}
+	mu      sync.Mutex
+	targets map[string]*dialTarget
+}
+
+func newConnManager(dial func(string) (p2p.Peer, error), connected func(string) bool, maxDials int, minBackoff, maxBackoff time.Duration) *connManager {
+	if maxDials <= 0 {
+		maxDials = DefaultMaxConcurrentDials
+	}
+	if minBackoff <= 0 {
+		minBackoff = DefaultReconnectMinBackoff
+	}
+	if maxBackoff < minBackoff {
+		maxBackoff = max(minBackoff, DefaultReconnectMaxBackoff)
+	}
+	return &connManager{
+		dial:       dial,
+		connected:  connected,
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+		sem:        make(chan struct{}, maxDials),
+		wakeup:     make(chan struct{}, 1),
+		targets:    make(map[string]*dialTarget),
+	}
+}
+
+// Dial 拨号 同一时间最多有maxDials个拨号在进行
+func (m *connManager) Dial(addr string) (p2p.Peer, error) {
+	m.sem <- struct{}{}
+	defer func() {
+		<-m.sem
+	}()
+	return m.dial(addr)
+}
+
+// Add 保持与addr的连接 name不为空时表示addr上节点的标识
+func (m *connManager) Add(addr, name string) {
+	m.mu.Lock()
+	t, ok := m.targets[addr]
+	if !ok {
+		t = &dialTarget{addr: addr}
+		m.targets[addr] = t
+	}
+	if name != "" {
+		t.name = name
+	}
+	m.mu.Unlock()
+	m.Wake()
+}
+
+// Remove 不再重连addr
+func (m *connManager) Remove(addr string) {
+	m.mu.Lock()
+	delete(m.targets, addr)
+	m.mu.Unlock()
+}
+
+// Wake 连接断开或者有新的节点时立即检查
+func (m *connManager) Wake() {
+	select {
+	case m.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// run 在quit关闭之前保持所有节点的连接
+func (m *connManager) run(quit <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-m.wakeup:
+		case <-quit:
+			return
+		}
+		next := m.reconnect(time.Now())
+		timer.Reset(time.Until(next))
+	}
+}
+
+// reconnect 为到了重试时间且没有连接的节点发起拨号 返回下一次需要检查的时间
+func (m *connManager) reconnect(now time.Time) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	next := now.Add(reconnectCheckInterval)
+	for _, t := range m.targets {
+		if t.dialing || (t.name != "" && m.connected(t.name)) {
+			continue
+		}
+		if now.Before(t.next) {
+			next = minTime(next, t.next)
+			continue
+		}
+		t.dialing = true
+		go m.attempt(t)
+	}
+	return next
+}
+
+func (m *connManager) attempt(t *dialTarget) {
+	peer, err := m.Dial(t.addr)
+	m.mu.Lock()
+	t.dialing = false
+	if err != nil {
+		t.attempts++
+		t.next = time.Now().Add(m.backoff(t.attempts))
+		log.Printf("Error connecting to %s (attempt %d, retry in %s): %s\n", t.addr, t.attempts, time.Until(t.next).Round(time.Millisecond), err)
+	} else {
+		t.attempts, t.next = 0, time.Time{}
+		t.name = peerName(peer)
+	}
+	m.mu.Unlock()
+	m.Wake()
+}
+
+// backoff 第attempts次失败后的等待时间 在指数增长的间隔的一半到全部之间随机选取
+func (m *connManager) backoff(attempts int) time.Duration {
+	d := m.minBackoff
+	// 达到上限后不再加倍 避免溢出
+	for i := 1; i < attempts && d < m.maxBackoff; i++ {
+		if d > m.maxBackoff/2 {
+			d = m.maxBackoff
+			break
+		}
+		d *= 2
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"Etherfile/p2p"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnManager_Backoff(t *testing.T) {
+	m := newConnManager(nil, nil, 0, 100*time.Millisecond, time.Second)
+	for attempts, want := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second, 100: time.Second} {
+		for i := 0; i < 20; i++ {
+			d := m.backoff(attempts)
+			assert.GreaterOrEqual(t, d, want/2)
+			assert.LessOrEqual(t, d, want)
+		}
+	}
+
+	// 最短间隔很大时 多次失败后也不会溢出
+	m = newConnManager(nil, nil, 0, 30*time.Second, 5*time.Minute)
+	for _, attempts := range []int{1, 5, 30, 31, 64, 1000} {
+		d := m.backoff(attempts)
+		assert.Greater(t, d, time.Duration(0))
+		assert.LessOrEqual(t, d, 5*time.Minute)
+	}
+	assert.GreaterOrEqual(t, m.backoff(30), 5*time.Minute/2)
+}
+
+func TestConnManager_RetryAndCapDials(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		failures  = map[string]int{}
+		connected = map[string]bool{}
+		active    int
+		maxActive int
+	)
+	dial := func(addr string) (p2p.Peer, error) {
+		mu.Lock()
+		active++
+		maxActive = max(maxActive, active)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		active--
+		// 每个地址前两次拨号失败
+		if failures[addr] < 2 {
+			failures[addr]++
+			return nil, errors.New("connection refused")
+		}
+		connected[addr] = true
+		return identityPeer{id: p2p.NodeID{byte(len(connected))}}, nil
+	}
+	m := newConnManager(dial, func(name string) bool {
+		return false
+	}, 2, 10*time.Millisecond, 50*time.Millisecond)
+	for i := 0; i < 6; i++ {
+		m.Add(fmt.Sprintf("node-%d", i), "")
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	go m.run(quit)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(connected) == 6
+	}, 3*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.LessOrEqual(t, maxActive, 2)
+	for _, n := range failures {
+		assert.Equal(t, 2, n)
+	}
+	mu.Unlock()
+}
+
+func TestFileServer_Reconnect(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	a := newClusterNode(t, kr, FileServerOpts{ListenAddr: "127.0.0.1:4420"})
+	t.Cleanup(a.Stop)
+	time.Sleep(50 * time.Millisecond)
+	b := newClusterNode(t, kr, FileServerOpts{
+		ListenAddr:          "127.0.0.1:4421",
+		ReconnectMinBackoff: 20 * time.Millisecond,
+	}, "127.0.0.1:4420")
+	t.Cleanup(b.Stop)
+
+	var old p2p.Peer
+	assert.Eventually(t, func() bool {
+		var ok bool
+		old, ok = b.getPeer(a.NodeID.String())
+		return ok
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// 连接断开后被删除 之后重新连接并加入新的连接
+	_ = old.Close()
+	assert.Eventually(t, func() bool {
+		p, ok := b.getPeer(a.NodeID.String())
+		return ok && p != old
+	}, 3*time.Second, 10*time.Millisecond)
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"io"
 )
 
@@ -19,6 +20,13 @@ const (
 	BufferSize       = 32 * 1024
 )
 
+// DefaultEncrypter 密文头部的版本号
+// 旧版本的密文以全零计数器开头 所以第一个字节恒为0x00
+const (
+	ctrVersionLegacy = 0x00 // 旧格式: [全零计数器 16B][密文]
+	ctrVersionRandIV = 0x01 // 当前格式: [版本 1B][随机IV 16B][密文]
+)
+
 type Encrypter interface {
 	Key() []byte
 	KeyGeneration() []byte
@@ -26,6 +34,59 @@ type Encrypter interface {
 	Decrypt([]byte, io.Reader, io.Writer) (int64, error)
 }
 
+// RangeDecrypter 可以只解密一段明文的Encrypter 用于范围读取
+type RangeDecrypter interface {
+	// DecryptRange 从完整的密文src中解密明文[offset, offset+length)写入dst
+	DecryptRange(key []byte, src io.ReaderAt, offset, length int64, dst io.Writer) (int64, error)
+}
+
+// DecryptRange 解密一段明文 Encrypter不支持随机访问时解密整个密文并跳过不需要的部分
+func DecryptRange(e Encrypter, key []byte, src io.ReaderAt, offset, length int64, dst io.Writer) (int64, error) {
+	if rd, ok := e.(RangeDecrypter); ok {
+		return rd.DecryptRange(key, src, offset, length, dst)
+	}
+	w := &rangeWriter{w: dst, skip: offset, remain: length}
+	_, err := e.Decrypt(key, io.NewSectionReader(src, 0, maxStreamSize), w)
+	if err != nil && !errors.Is(err, errRangeDone) {
+		return w.written, err
+	}
+	return w.written, nil
+}
+
+const maxStreamSize = 1<<63 - 1
+
+var errRangeDone = errors.New("range done")
+
+// rangeWriter 丢弃前skip个字节 最多写入remain个字节
+type rangeWriter struct {
+	w       io.Writer
+	skip    int64
+	remain  int64
+	written int64
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	if w.skip > 0 {
+		n := min(w.skip, int64(len(p)))
+		w.skip -= n
+		p = p[n:]
+	}
+	if int64(len(p)) > w.remain {
+		p = p[:w.remain]
+	}
+	n, err := w.w.Write(p)
+	w.remain -= int64(n)
+	w.written += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	if w.remain == 0 {
+		return total, errRangeDone
+	}
+	return total, nil
+}
+
 // DefaultEncrypter 默认的加密类：使用AES加密算法
 type DefaultEncrypter struct {
 	key []byte
@@ -64,15 +125,21 @@ func (e *DefaultEncrypter) Encrypt(key []byte, src io.Reader, dst io.Writer) (in
 
 	var (
 		buf       = make([]byte, BufferSize)
-		counter   = make([]byte, block.BlockSize()) // 用于CTR模式的计数器
+		iv        = make([]byte, block.BlockSize()) // 用于CTR模式的计数器初始值 每次加密随机生成
 		totalSize = int64(0)
 	)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return 0, err
+	}
 
 	// 初始化一个CTR加密流
-	stream := cipher.NewCTR(block, counter)
+	stream := cipher.NewCTR(block, iv)
 
-	// 将计数器初始值写入到目标写入器
-	if _, err := dst.Write(counter); err != nil {
+	// 将版本号和IV写入到目标写入器
+	if _, err := dst.Write([]byte{ctrVersionRandIV}); err != nil {
+		return 0, err
+	}
+	if _, err := dst.Write(iv); err != nil {
 		return 0, err
 	}
 
@@ -107,9 +174,9 @@ func (e *DefaultEncrypter) Decrypt(key []byte, src io.Reader, dst io.Writer) (in
 		return 0, err
 	}
 
-	// 从源读取计数器
-	counter := make([]byte, block.BlockSize())
-	if _, err := src.Read(counter); err != nil {
+	// 从源读取头部得到计数器初始值
+	counter, err := readCTRHeader(src, block.BlockSize())
+	if err != nil {
 		return 0, err
 	}
 
@@ -140,3 +207,90 @@ func (e *DefaultEncrypter) Decrypt(key []byte, src io.Reader, dst io.Writer) (in
 	}
 	return totalSize, nil
 }
+
+// DecryptRange CTR模式可以直接定位到offset对应的计数器
+func (e *DefaultEncrypter) DecryptRange(key []byte, src io.ReaderAt, offset, length int64, dst io.Writer) (int64, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	version := make([]byte, 1)
+	if _, err := src.ReadAt(version, 0); err != nil {
+		return 0, err
+	}
+	headerLen := int64(1 + block.BlockSize())
+	if version[0] == ctrVersionLegacy {
+		// 旧格式的头部没有版本字节
+		headerLen--
+	}
+	counter, err := readCTRHeader(io.NewSectionReader(src, 0, headerLen), block.BlockSize())
+	if err != nil {
+		return 0, err
+	}
+
+	// 计数器加上offset所在的块号 再丢弃块内offset之前的密钥流
+	blockSize := int64(block.BlockSize())
+	addCounter(counter, uint64(offset/blockSize))
+	stream := cipher.NewCTR(block, counter)
+	skip := make([]byte, offset%blockSize)
+	stream.XORKeyStream(skip, skip)
+
+	var (
+		r         = io.NewSectionReader(src, headerLen+offset, length)
+		buf       = make([]byte, BufferSize)
+		totalSize = int64(0)
+	)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			stream.XORKeyStream(buf[:n], buf[:n])
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return 0, err
+			}
+			totalSize += int64(n)
+		}
+		if err == io.EOF {
+			return totalSize, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// addCounter 将大端序的计数器加上n
+func addCounter(counter []byte, n uint64) {
+	for i := len(counter) - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(counter[i]) + n&0xff
+		counter[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+}
+
+// readCTRHeader 读取密文头部 兼容旧版本的全零计数器格式
+func readCTRHeader(src io.Reader, blockSize int) ([]byte, error) {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(src, version); err != nil {
+		return nil, err
+	}
+	counter := make([]byte, blockSize)
+	switch version[0] {
+	case ctrVersionRandIV:
+		if _, err := io.ReadFull(src, counter); err != nil {
+			return nil, err
+		}
+	case ctrVersionLegacy:
+		// 旧格式: 版本字节本身就是计数器的第一个字节 剩余部分也必须全为0
+		if _, err := io.ReadFull(src, counter[1:]); err != nil {
+			return nil, err
+		}
+		for _, b := range counter {
+			if b != 0 {
+				return nil, ErrBadHeader
+			}
+		}
+	default:
+		return nil, ErrBadHeader
+	}
+	return counter, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/**
+GCMEncrypter 分块的AES-GCM认证加密流
+格式: [版本 1B][nonce前缀 7B] 之后是若干密文块 每块为 明文(最多GCMChunkSize) + 16B认证标签
+每块的nonce = nonce前缀(7B) || 块序号(4B 大端) || 结束标记(1B)
+最后一块的结束标记为1(可以为空块) 因此篡改、重排、截断都会在解密时报错
+*/
+
+const (
+	GCMChunkSize     = 64 * 1024
+	gcmStreamVersion = 0x01
+	gcmPrefixSize    = 7
+	gcmHeaderSize    = 1 + gcmPrefixSize
+)
+
+var (
+	ErrAuthentication = errors.New("crypto: message authentication failed")
+	ErrTruncated      = errors.New("crypto: encrypted stream truncated")
+	ErrBadHeader      = errors.New("crypto: unsupported encrypted stream header")
+)
+
+// GCMEncrypter 使用分块AES-GCM进行认证加密的加密类
+type GCMEncrypter struct {
+	key []byte
+}
+
+func NewGCMEncrypter(key ...[]byte) *GCMEncrypter {
+	e := &GCMEncrypter{}
+	if len(key) > 0 && len(key[0]) == DefaultKeyLength {
+		e.key = key[0]
+	} else {
+		e.key = e.KeyGeneration()
+	}
+	return e
+}
+
+func (e *GCMEncrypter) Key() []byte {
+	return e.key
+}
+
+// KeyGeneration 随机的密钥生成函数
+func (e *GCMEncrypter) KeyGeneration() []byte {
+	key := make([]byte, DefaultKeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil
+	}
+	return key
+}
+
+// Encrypt 加密src写入dst 返回写入dst的总字节数(包含头部和认证标签)
+func (e *GCMEncrypter) Encrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// 写入头部：版本号 + 随机nonce前缀
+	header := make([]byte, gcmHeaderSize)
+	header[0] = gcmStreamVersion
+	if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
+		return 0, err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return 0, err
+	}
+
+	var (
+		r         = bufio.NewReaderSize(src, GCMChunkSize)
+		buf       = make([]byte, GCMChunkSize, GCMChunkSize+aead.Overhead())
+		nonce     = make([]byte, aead.NonceSize())
+		totalSize = int64(len(header))
+	)
+	copy(nonce, header[1:])
+
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		last := false
+		switch {
+		case err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF):
+			last = true
+		case err != nil:
+			return 0, err
+		default:
+			// 满块时预读一个字节判断是否已经到达结尾
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		gcmNonce(nonce, counter, last)
+		sealed := aead.Seal(buf[:0], nonce, buf[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return 0, err
+		}
+		totalSize += int64(len(sealed))
+
+		if last {
+			return totalSize, nil
+		}
+		if counter == ^uint32(0) {
+			return 0, errors.New("crypto: encrypted stream too large")
+		}
+	}
+}
+
+// Decrypt 逐块校验并解密src写入dst 任意块被篡改或流被截断都会返回错误
+func (e *GCMEncrypter) Decrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, gcmHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, ErrTruncated
+		}
+		return 0, err
+	}
+	if header[0] != gcmStreamVersion {
+		return 0, ErrBadHeader
+	}
+
+	var (
+		r         = bufio.NewReaderSize(src, GCMChunkSize+aead.Overhead())
+		buf       = make([]byte, GCMChunkSize+aead.Overhead())
+		plainBuf  = make([]byte, 0, GCMChunkSize)
+		nonce     = make([]byte, aead.NonceSize())
+		totalSize = int64(0)
+	)
+	copy(nonce, header[1:])
+
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		last := false
+		switch {
+		case err == io.EOF:
+			// 没有读到结束块
+			return 0, ErrTruncated
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			last = true
+		case err != nil:
+			return 0, err
+		default:
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		gcmNonce(nonce, counter, last)
+		// 解密失败时Open会清空输出 所以不能原地解密
+		plain, err := aead.Open(plainBuf[:0], nonce, buf[:n], header)
+		if err != nil {
+			// 一个完整的非结束块恰好落在流末尾 说明后续块被截掉了
+			if last && n == len(buf) {
+				gcmNonce(nonce, counter, false)
+				if _, err := aead.Open(plainBuf[:0], nonce, buf[:n], header); err == nil {
+					return 0, ErrTruncated
+				}
+			}
+			return 0, ErrAuthentication
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return 0, err
+		}
+		totalSize += int64(len(plain))
+
+		if last {
+			return totalSize, nil
+		}
+		if counter == ^uint32(0) {
+			return 0, ErrAuthentication
+		}
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmNonce 在nonce前缀之后写入块序号和结束标记
+func gcmNonce(nonce []byte, counter uint32, last bool) {
+	binary.BigEndian.PutUint32(nonce[gcmPrefixSize:], counter)
+	nonce[len(nonce)-1] = 0
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+}
+
+// DecryptRange 只读取并校验覆盖明文[offset, offset+length)的密文块
+func (e *GCMEncrypter) DecryptRange(key []byte, src io.ReaderAt, offset, length int64, dst io.Writer) (int64, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, gcmHeaderSize)
+	if _, err := src.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return 0, ErrTruncated
+		}
+		return 0, err
+	}
+	if header[0] != gcmStreamVersion {
+		return 0, ErrBadHeader
+	}
+	if length <= 0 {
+		return 0, nil
+	}
+
+	// 每次读取并校验一个密文块 多读一个字节用于判断这一块是不是结束块
+	var (
+		sealedSize = int64(GCMChunkSize + aead.Overhead())
+		first      = offset / GCMChunkSize
+		buf        = make([]byte, sealedSize+1)
+		plainBuf   = make([]byte, 0, GCMChunkSize)
+		nonce      = make([]byte, aead.NonceSize())
+		skip       = offset - first*GCMChunkSize
+		remain     = length
+		totalSize  = int64(0)
+	)
+	copy(nonce, header[1:])
+	for i := first; remain > 0; i++ {
+		if i > int64(^uint32(0)) {
+			return 0, ErrAuthentication
+		}
+		n, err := src.ReadAt(buf, gcmHeaderSize+i*sealedSize)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		chunk := buf[:min(int64(n), sealedSize)]
+		final := int64(n) <= sealedSize
+
+		gcmNonce(nonce, uint32(i), final)
+		plain, err := aead.Open(plainBuf[:0], nonce, chunk, header)
+		if err != nil {
+			if final && int64(len(chunk)) == sealedSize {
+				gcmNonce(nonce, uint32(i), false)
+				if _, err := aead.Open(plainBuf[:0], nonce, chunk, header); err == nil {
+					return 0, ErrTruncated
+				}
+			}
+			return 0, ErrAuthentication
+		}
+		if skip >= int64(len(plain)) {
+			break
+		}
+		plain = plain[skip:]
+		skip = 0
+		plain = plain[:min(int64(len(plain)), remain)]
+		if _, err := dst.Write(plain); err != nil {
+			return 0, err
+		}
+		remain -= int64(len(plain))
+		totalSize += int64(len(plain))
+		if final {
+			break
+		}
+	}
+	return totalSize, nil
+}
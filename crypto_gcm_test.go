@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCMEncrypter_RoundTrip(t *testing.T) {
+	e := NewGCMEncrypter()
+	for _, size := range []int{0, 1, GCMChunkSize - 1, GCMChunkSize, 3*GCMChunkSize + 17} {
+		data := make([]byte, size)
+		_, _ = io.ReadFull(rand.Reader, data)
+
+		ciphertext := new(bytes.Buffer)
+		_, err := e.Encrypt(e.Key(), bytes.NewReader(data), ciphertext)
+		assert.Nil(t, err)
+
+		plaintext := new(bytes.Buffer)
+		n, err := e.Decrypt(e.Key(), ciphertext, plaintext)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(size), n)
+		assert.True(t, bytes.Equal(data, plaintext.Bytes()))
+	}
+}
+
+func TestGCMEncrypter_Tampered(t *testing.T) {
+	e := NewGCMEncrypter()
+	ciphertext := new(bytes.Buffer)
+	_, err := e.Encrypt(e.Key(), bytes.NewReader(bytes.Repeat([]byte("etherfile"), 20000)), ciphertext)
+	assert.Nil(t, err)
+
+	data := ciphertext.Bytes()
+	data[gcmHeaderSize+GCMChunkSize+100] ^= 0x01
+	_, err = e.Decrypt(e.Key(), bytes.NewReader(data), io.Discard)
+	assert.True(t, errors.Is(err, ErrAuthentication))
+}
+
+func TestGCMEncrypter_Truncated(t *testing.T) {
+	e := NewGCMEncrypter()
+	ciphertext := new(bytes.Buffer)
+	_, err := e.Encrypt(e.Key(), bytes.NewReader(make([]byte, 2*GCMChunkSize+10)), ciphertext)
+	assert.Nil(t, err)
+
+	// 截掉最后一块 剩下的都是合法的非结束块
+	chunk := GCMChunkSize + 16
+	data := ciphertext.Bytes()[:gcmHeaderSize+2*chunk]
+	_, err = e.Decrypt(e.Key(), bytes.NewReader(data), io.Discard)
+	assert.True(t, errors.Is(err, ErrTruncated))
+
+	// 在块中间截断
+	data = ciphertext.Bytes()[:gcmHeaderSize+chunk+10]
+	_, err = e.Decrypt(e.Key(), bytes.NewReader(data), io.Discard)
+	assert.True(t, errors.Is(err, ErrAuthentication))
+}
+
+func TestStore_ReadDecryptTampered(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+	e := NewGCMEncrypter()
+	key := "tampered_file"
+	assert.Nil(t, s.WriteEncrypt(key, e, bytes.NewReader([]byte("some secret bytes"))))
+
+	path := s.Root + "/" + s.PathTransformFunc(key).FullPath()
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0666))
+
+	err = s.ReadDecrypt(key, e, io.Discard)
+	assert.True(t, errors.Is(err, ErrAuthentication))
+}
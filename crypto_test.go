@@ -2,8 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"fmt"
+	"io"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDefaultEncrypter_Encrypt_(t *testing.T) {
@@ -26,3 +31,42 @@ func TestDefaultEncrypter_Encrypt_(t *testing.T) {
 	}
 	t.Logf("the plaintext data :%s size : %d \n", res.String(), totalSize)
 }
+
+func TestDefaultEncrypter_RandomIV(t *testing.T) {
+	e := NewDefaultEncrypter()
+	data := []byte("same plaintext, same key")
+	c1, c2 := new(bytes.Buffer), new(bytes.Buffer)
+	_, err := e.Encrypt(e.Key(), bytes.NewReader(data), c1)
+	assert.Nil(t, err)
+	_, err = e.Encrypt(e.Key(), bytes.NewReader(data), c2)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(ctrVersionRandIV), c1.Bytes()[0])
+	assert.NotEqual(t, c1.Bytes(), c2.Bytes())
+
+	res := new(bytes.Buffer)
+	_, err = e.Decrypt(e.Key(), c1, res)
+	assert.Nil(t, err)
+	assert.Equal(t, data, res.Bytes())
+}
+
+func TestDefaultEncrypter_DecryptLegacy(t *testing.T) {
+	e := NewDefaultEncrypter()
+	data := []byte("written before random IVs")
+
+	// 按旧格式构造密文: 全零计数器 + CTR密文
+	block, err := aes.NewCipher(e.Key())
+	assert.Nil(t, err)
+	counter := make([]byte, block.BlockSize())
+	legacy := make([]byte, len(data))
+	cipher.NewCTR(block, counter).XORKeyStream(legacy, data)
+	legacy = append(counter, legacy...)
+
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+	assert.Nil(t, s.Write("legacy_file", bytes.NewReader(legacy)))
+	res := new(bytes.Buffer)
+	assert.Nil(t, s.ReadDecrypt("legacy_file", e, res))
+	assert.Equal(t, data, res.Bytes())
+
+	_, err = e.Decrypt(e.Key(), bytes.NewReader([]byte{0x7f, 1, 2, 3}), io.Discard)
+	assert.Equal(t, ErrBadHeader, err)
+}
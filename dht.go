@@ -0,0 +1,211 @@
+package main
+
+import (
+	"Etherfile/dht"
+	"Etherfile/p2p"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+/**
+通过DHT定位文件: 存储文件的节点把自己登记为文件的提供者 获取文件时只向提供者请求
+DHT的请求和回复都是普通的Message 回复通过请求ID对应到请求
+节点只能登记自己为提供者 登记的地址是连接上观察到的地址 而不是请求中声明的地址
+路由表为空时与新连接的节点进行一次引导查找 让附近的节点记录本节点
+对方节点不支持DHT时(握手时没有声明CapDHT) 仍然向它广播请求
+*/
+
+type MessageFindNode struct {
+	Target p2p.NodeID
+}
+
+type MessageFindValue struct {
+	Key p2p.NodeID
+}
+
+type MessageAddProvider struct {
+	Key      p2p.NodeID
+	Provider dht.Contact
+}
+
+// MessageDHTReply DHT请求的回复
+type MessageDHTReply struct {
+	Providers []dht.Contact
+	Closest   []dht.Contact
+}
+
+// dhtNetwork 通过FileServer的连接发送DHT请求
+type dhtNetwork struct {
+	fs *FileServer
+}
+
+func (n dhtNetwork) FindNode(to dht.Contact, target p2p.NodeID) ([]dht.Contact, error) {
+	reply, err := n.fs.callContact(to, MessageFindNode{Target: target})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Closest, nil
+}
+
+func (n dhtNetwork) FindValue(to dht.Contact, key p2p.NodeID) ([]dht.Contact, []dht.Contact, error) {
+	reply, err := n.fs.callContact(to, MessageFindValue{Key: key})
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply.Providers, reply.Closest, nil
+}
+
+func (n dhtNetwork) Store(to dht.Contact, key p2p.NodeID, provider dht.Contact) error {
+	_, err := n.fs.callContact(to, MessageAddProvider{Key: key, Provider: provider})
+	return err
+}
+
+// callContact 向DHT中的节点发送请求 没有连接时先建立连接
+func (fs *FileServer) callContact(to dht.Contact, payload any) (*MessageDHTReply, error) {
+	peer, err := fs.connect(to)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fs.call(peer, payload)
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := resp.(MessageDHTReply)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T from %s", resp, to.ID)
+	}
+	return &reply, nil
+}
+
+// connect 返回到节点的连接 没有连接时拨号
+func (fs *FileServer) connect(to dht.Contact) (p2p.Peer, error) {
+	if to.ID == fs.NodeID {
+		return nil, errors.New("cannot connect to self")
+	}
+	if peer, ok := fs.getPeer(to.ID.String()); ok {
+		return peer, nil
+	}
+	peer, err := fs.conns.Dial(to.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if name := peerName(peer); name != to.ID.String() {
+		return nil, fmt.Errorf("expected node %s at %s, got %s", to.ID, to.Addr, name)
+	}
+	return peer, nil
+}
+
+// contactOf 对方节点在DHT中的地址 监听地址没有主机部分时使用连接的IP
+func contactOf(peer p2p.Peer) dht.Contact {
+	info := peer.Info()
+	addr := info.ListenAddr
+	if host, port, err := net.SplitHostPort(addr); err == nil && (host == "" || net.ParseIP(host).IsUnspecified()) {
+		if remote, ok := peer.RemoteAddr().(*net.TCPAddr); ok {
+			addr = net.JoinHostPort(remote.IP.String(), port)
+		}
+	}
+	return dht.Contact{ID: info.NodeID, Addr: addr}
+}
+
+// supportsDHT 握手时交换了节点标识并且声明支持DHT
+func supportsDHT(peer p2p.Peer) bool {
+	info := peer.Info()
+	return !info.NodeID.IsZero() && info.HasCapability(CapDHT)
+}
+
+// sourcesFor 获取key时请求的节点: 哈希环上负责key的节点 DHT中key的提供者 加上不支持DHT的节点
+func (fs *FileServer) sourcesFor(key string) []p2p.Peer {
+	sources := fs.replicaPeers(key)
+	seen := make(map[string]bool, len(sources))
+	add := func(peer p2p.Peer) {
+		if name := peerName(peer); !seen[name] {
+			seen[name] = true
+			sources = append(sources, peer)
+		}
+	}
+	for _, peer := range sources {
+		seen[peerName(peer)] = true
+	}
+	providers, err := fs.dht.FindProviders(dht.KeyID(key))
+	if err != nil && !errors.Is(err, dht.ErrNoContacts) {
+		log.Printf("[%s] Error finding providers of %s: %s\n", fs.ListenAddr, key, err)
+	}
+	for _, c := range providers {
+		if c.ID == fs.NodeID || seen[c.ID.String()] {
+			continue
+		}
+		peer, err := fs.connect(c)
+		if err != nil {
+			log.Printf("[%s] Error connecting to provider %s: %s\n", fs.ListenAddr, c.ID, err)
+			continue
+		}
+		add(peer)
+	}
+	for _, peer := range fs.peerList() {
+		if !supportsDHT(peer) {
+			add(peer)
+		}
+	}
+	return sources
+}
+
+// bootstrapDHT 在后台查找本节点自己的标识 填充路由表
+func (fs *FileServer) bootstrapDHT() {
+	go func() {
+		if err := fs.dht.Bootstrap(); err != nil && !errors.Is(err, dht.ErrNoContacts) {
+			log.Printf("[%s] Error bootstrapping dht: %s\n", fs.ListenAddr, err)
+		}
+	}()
+}
+
+// provide 在后台将本节点登记为key的提供者
+func (fs *FileServer) provide(key string) {
+	go func() {
+		if err := fs.dht.Provide(dht.KeyID(key)); err != nil {
+			log.Printf("[%s] Error providing %s: %s\n", fs.ListenAddr, key, err)
+		}
+	}()
+}
+
+func (fs *FileServer) handleMsgFindNode(from string, id uint64, msg MessageFindNode) error {
+	sender, err := fs.dhtSender(from)
+	if err != nil {
+		return err
+	}
+	return fs.reply(from, id, MessageDHTReply{Closest: fs.dht.HandleFindNode(sender, msg.Target)})
+}
+
+func (fs *FileServer) handleMsgFindValue(from string, id uint64, msg MessageFindValue) error {
+	sender, err := fs.dhtSender(from)
+	if err != nil {
+		return err
+	}
+	providers, closest := fs.dht.HandleFindValue(sender, msg.Key)
+	return fs.reply(from, id, MessageDHTReply{Providers: providers, Closest: closest})
+}
+
+func (fs *FileServer) handleMsgAddProvider(from string, id uint64, msg MessageAddProvider) error {
+	sender, err := fs.dhtSender(from)
+	if err != nil {
+		return err
+	}
+	// 只接受节点登记自己 否则任何节点都可以把流量引到别的地址
+	if msg.Provider.ID != sender.ID {
+		return fmt.Errorf("peer %s tried to add %s as provider", from, msg.Provider.ID)
+	}
+	fs.dht.HandleStore(sender, msg.Key, sender)
+	return fs.reply(from, id, MessageDHTReply{})
+}
+
+func (fs *FileServer) dhtSender(from string) (dht.Contact, error) {
+	peer, ok := fs.getPeer(from)
+	if !ok {
+		return dht.Contact{}, fmt.Errorf("peer %s not found", from)
+	}
+	if !supportsDHT(peer) {
+		return dht.Contact{}, fmt.Errorf("peer %s does not support dht", from)
+	}
+	return contactOf(peer), nil
+}
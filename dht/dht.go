@@ -0,0 +1,275 @@
+package dht
+
+import (
+	"Etherfile/p2p"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+/**
+Kademlia DHT: 节点和key在同一个256位的标识空间中 两者之间的距离是XOR
+每个key的提供者记录保存在离key最近的K个节点上 查找时每一轮并行询问Alpha个已知的最近节点
+直到没有更近的节点为止 查找只需要联系离key最近的节点 而不是网络中的所有节点
+DHT不关心节点之间如何通信 由上层通过Network发送请求 收到请求时调用Handle*方法
+*/
+
+const (
+	DefaultK           = 20
+	DefaultAlpha       = 3
+	DefaultProviderTTL = 24 * time.Hour
+)
+
+var ErrNoContacts = errors.New("dht: routing table is empty")
+
+// Network 向其他节点发送DHT请求
+type Network interface {
+	// FindNode 返回to已知的离target最近的节点
+	FindNode(to Contact, target p2p.NodeID) ([]Contact, error)
+	// FindValue 返回to保存的key的提供者 以及to已知的离key最近的节点
+	FindValue(to Contact, key p2p.NodeID) (providers, closest []Contact, err error)
+	// Store 让to保存provider是key的提供者
+	Store(to Contact, key p2p.NodeID, provider Contact) error
+}
+
+type Opts struct {
+	Self        Contact
+	Network     Network
+	K           int
+	Alpha       int
+	ProviderTTL time.Duration
+}
+
+type DHT struct {
+	Opts
+	table     *RoutingTable
+	providers *providerStore
+}
+
+func New(opts Opts) *DHT {
+	if opts.K <= 0 {
+		opts.K = DefaultK
+	}
+	if opts.Alpha <= 0 {
+		opts.Alpha = DefaultAlpha
+	}
+	if opts.ProviderTTL <= 0 {
+		opts.ProviderTTL = DefaultProviderTTL
+	}
+	return &DHT{
+		Opts:      opts,
+		table:     NewRoutingTable(opts.Self.ID, opts.K),
+		providers: newProviderStore(opts.ProviderTTL),
+	}
+}
+
+// KeyID 文件的key在标识空间中的位置
+func KeyID(key string) p2p.NodeID {
+	return sha256.Sum256([]byte(key))
+}
+
+func (d *DHT) Table() *RoutingTable {
+	return d.table
+}
+
+// AddContact 记录一个已知的节点 连接建立或收到请求时调用
+func (d *DHT) AddContact(c Contact) {
+	d.table.Update(c)
+}
+
+// RemoveContact 删除不再可用的节点
+func (d *DHT) RemoveContact(id p2p.NodeID) {
+	d.table.Remove(id)
+}
+
+// HandleFindNode 处理FIND_NODE请求
+func (d *DHT) HandleFindNode(from Contact, target p2p.NodeID) []Contact {
+	d.AddContact(from)
+	return d.closestExcept(target, from.ID)
+}
+
+// HandleFindValue 处理FIND_VALUE请求
+func (d *DHT) HandleFindValue(from Contact, key p2p.NodeID) (providers, closest []Contact) {
+	d.AddContact(from)
+	return d.providers.get(key), d.closestExcept(key, from.ID)
+}
+
+// HandleStore 处理STORE请求
+func (d *DHT) HandleStore(from Contact, key p2p.NodeID, provider Contact) {
+	d.AddContact(from)
+	d.providers.add(key, provider)
+}
+
+func (d *DHT) closestExcept(target, except p2p.NodeID) []Contact {
+	contacts := d.table.Closest(target, d.K+1)
+	out := contacts[:0]
+	for _, c := range contacts {
+		if c.ID != except {
+			out = append(out, c)
+		}
+	}
+	if len(out) > d.K {
+		out = out[:d.K]
+	}
+	return out
+}
+
+// Bootstrap 查找本节点自己的标识 让附近的节点记录本节点 并填充路由表
+func (d *DHT) Bootstrap() error {
+	_, err := d.Lookup(d.Self.ID)
+	return err
+}
+
+// Lookup 在网络中查找离target最近的K个节点(不包括本节点)
+func (d *DHT) Lookup(target p2p.NodeID) ([]Contact, error) {
+	closest, _, err := d.iterate(target, false)
+	return closest, err
+}
+
+// Provide 将本节点作为key的提供者 记录保存在离key最近的K个节点上
+// 本节点也在最近的K个节点中时同时保存在本地
+func (d *DHT) Provide(key p2p.NodeID) error {
+	closest, err := d.Lookup(key)
+	if err != nil && !errors.Is(err, ErrNoContacts) {
+		return err
+	}
+	if len(closest) < d.K || closer(d.Self.ID, closest[len(closest)-1].ID, key) {
+		d.providers.add(key, d.Self)
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		stored int
+	)
+	for _, c := range closest {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			if err := d.Network.Store(c, key, d.Self); err != nil {
+				d.table.Remove(c.ID)
+				return
+			}
+			mu.Lock()
+			stored++
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	if stored == 0 && len(closest) > 0 {
+		return errors.New("dht: no node accepted the provider record")
+	}
+	return nil
+}
+
+// FindProviders 查找key的提供者 先查本地记录 再在网络中查找
+func (d *DHT) FindProviders(key p2p.NodeID) ([]Contact, error) {
+	if providers := d.providers.get(key); len(providers) > 0 {
+		return providers, nil
+	}
+	_, providers, err := d.iterate(key, true)
+	return providers, err
+}
+
+// iterate 迭代查找离target最近的节点 findValue为true时找到提供者就停止
+func (d *DHT) iterate(target p2p.NodeID, findValue bool) ([]Contact, []Contact, error) {
+	shortlist := d.table.Closest(target, d.K)
+	if len(shortlist) == 0 {
+		return nil, nil, ErrNoContacts
+	}
+	var (
+		seen      = map[p2p.NodeID]bool{d.Self.ID: true}
+		queried   = map[p2p.NodeID]bool{}
+		failed    = map[p2p.NodeID]bool{}
+		providers []Contact
+	)
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+
+	type result struct {
+		from      Contact
+		closest   []Contact
+		providers []Contact
+		err       error
+	}
+	for {
+		// 从最近的K个节点中选出还没有询问过的Alpha个
+		var batch []Contact
+		for _, c := range shortlist {
+			if len(batch) == d.Alpha {
+				break
+			}
+			if !queried[c.ID] {
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan result, len(batch))
+		for _, c := range batch {
+			queried[c.ID] = true
+			go func(c Contact) {
+				r := result{from: c}
+				if findValue {
+					r.providers, r.closest, r.err = d.Network.FindValue(c, target)
+				} else {
+					r.closest, r.err = d.Network.FindNode(c, target)
+				}
+				results <- r
+			}(c)
+		}
+		for range batch {
+			r := <-results
+			if r.err != nil {
+				failed[r.from.ID] = true
+				d.table.Remove(r.from.ID)
+				continue
+			}
+			d.table.Update(r.from)
+			providers = append(providers, r.providers...)
+			for _, c := range r.closest {
+				if !seen[c.ID] {
+					seen[c.ID] = true
+					shortlist = append(shortlist, c)
+				}
+			}
+		}
+		if findValue && len(providers) > 0 {
+			break
+		}
+
+		// 只保留最近的K个没有失败的节点
+		shortlist = withoutFailed(shortlist, failed)
+		sortByDistance(shortlist, target)
+		if len(shortlist) > d.K {
+			shortlist = shortlist[:d.K]
+		}
+	}
+	shortlist = withoutFailed(shortlist, failed)
+	return shortlist, dedup(providers), nil
+}
+
+func withoutFailed(contacts []Contact, failed map[p2p.NodeID]bool) []Contact {
+	out := contacts[:0]
+	for _, c := range contacts {
+		if !failed[c.ID] {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func dedup(contacts []Contact) []Contact {
+	seen := make(map[p2p.NodeID]bool, len(contacts))
+	out := contacts[:0]
+	for _, c := range contacts {
+		if !seen[c.ID] {
+			seen[c.ID] = true
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package dht
+
+import (
+	"Etherfile/p2p"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memNetwork 直接调用其他节点的Handle方法 down中的节点不响应
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[p2p.NodeID]*DHT
+	down  map[p2p.NodeID]bool
+	calls int
+}
+
+type memClient struct {
+	net  *memNetwork
+	self Contact
+}
+
+var errDown = errors.New("node down")
+
+func (n *memNetwork) node(id p2p.NodeID) (*DHT, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.calls++
+	if n.down[id] {
+		return nil, errDown
+	}
+	return n.nodes[id], nil
+}
+
+func (c memClient) FindNode(to Contact, target p2p.NodeID) ([]Contact, error) {
+	d, err := c.net.node(to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return d.HandleFindNode(c.self, target), nil
+}
+
+func (c memClient) FindValue(to Contact, key p2p.NodeID) ([]Contact, []Contact, error) {
+	d, err := c.net.node(to.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	providers, closest := d.HandleFindValue(c.self, key)
+	return providers, closest, nil
+}
+
+func (c memClient) Store(to Contact, key p2p.NodeID, provider Contact) error {
+	d, err := c.net.node(to.ID)
+	if err != nil {
+		return err
+	}
+	d.HandleStore(c.self, key, provider)
+	return nil
+}
+
+// newMemCluster 创建n个节点 每个节点只知道第一个节点 然后各自Bootstrap
+func newMemCluster(t *testing.T, n int) (*memNetwork, []*DHT) {
+	network := &memNetwork{nodes: map[p2p.NodeID]*DHT{}, down: map[p2p.NodeID]bool{}}
+	nodes := make([]*DHT, n)
+	for i := range nodes {
+		self := Contact{ID: p2p.NewNodeID()}
+		nodes[i] = New(Opts{Self: self, Network: memClient{net: network, self: self}, K: 8})
+		network.nodes[self.ID] = nodes[i]
+	}
+	for _, d := range nodes[1:] {
+		d.AddContact(nodes[0].Self)
+		assert.Nil(t, d.Bootstrap())
+	}
+	return network, nodes
+}
+
+func TestRoutingTable(t *testing.T) {
+	self := p2p.NodeID{}
+	table := NewRoutingTable(self, 2)
+	assert.False(t, table.Update(Contact{ID: self}))
+
+	// 最高位为1的节点都在第0个桶 桶满后不再加入新节点
+	a, b, c := p2p.NodeID{0x80}, p2p.NodeID{0x81}, p2p.NodeID{0x82}
+	assert.True(t, table.Update(Contact{ID: a}))
+	assert.True(t, table.Update(Contact{ID: b}))
+	assert.False(t, table.Update(Contact{ID: c}))
+	assert.True(t, table.Update(Contact{ID: a}))
+	table.Remove(b)
+	assert.True(t, table.Update(Contact{ID: c}))
+
+	near := p2p.NodeID{0x01}
+	assert.True(t, table.Update(Contact{ID: near}))
+	assert.Equal(t, 3, table.Size())
+	assert.Equal(t, []Contact{{ID: near}, {ID: a}}, table.Closest(p2p.NodeID{}, 2))
+	assert.Equal(t, 0, bucketIndex(self, a))
+	assert.Equal(t, 7, bucketIndex(self, near))
+}
+
+func TestDHT_Lookup(t *testing.T) {
+	_, nodes := newMemCluster(t, 60)
+	target := KeyID("some file")
+
+	got, err := nodes[42].Lookup(target)
+	assert.Nil(t, err)
+
+	// 和遍历所有节点得到的最近节点一致
+	var all []Contact
+	for _, d := range nodes {
+		if d != nodes[42] {
+			all = append(all, d.Self)
+		}
+	}
+	sortByDistance(all, target)
+	assert.Equal(t, all[:nodes[42].K], got)
+}
+
+func TestDHT_Providers(t *testing.T) {
+	network, nodes := newMemCluster(t, 60)
+	key := KeyID("some file")
+	assert.Nil(t, nodes[5].Provide(key))
+
+	// 提供者记录离key最近的节点关闭一部分后仍然可以找到
+	closest, err := nodes[10].Lookup(key)
+	assert.Nil(t, err)
+	for _, c := range closest[:3] {
+		network.down[c.ID] = true
+	}
+
+	network.calls = 0
+	providers, err := nodes[50].FindProviders(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []Contact{nodes[5].Self}, providers)
+	// 只联系了少量节点
+	assert.Less(t, network.calls, len(nodes)/2)
+
+	providers, err = nodes[50].FindProviders(KeyID("missing"))
+	assert.Nil(t, err)
+	assert.Empty(t, providers)
+}
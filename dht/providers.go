@@ -0,0 +1,58 @@
+package dht
+
+import (
+	"Etherfile/p2p"
+	"sync"
+	"time"
+)
+
+// providerStore 本节点保存的提供者记录 记录过期后不再返回
+type providerStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	records map[p2p.NodeID]map[p2p.NodeID]providerRecord
+}
+
+type providerRecord struct {
+	Contact
+	expires time.Time
+}
+
+func newProviderStore(ttl time.Duration) *providerStore {
+	return &providerStore{
+		ttl:     ttl,
+		records: make(map[p2p.NodeID]map[p2p.NodeID]providerRecord),
+	}
+}
+
+// add 添加或刷新key的提供者
+func (s *providerStore) add(key p2p.NodeID, provider Contact) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, ok := s.records[key]
+	if !ok {
+		records = make(map[p2p.NodeID]providerRecord)
+		s.records[key] = records
+	}
+	records[provider.ID] = providerRecord{Contact: provider, expires: time.Now().Add(s.ttl)}
+}
+
+// get 返回key没有过期的提供者 同时清理过期的记录
+func (s *providerStore) get(key p2p.NodeID) []Contact {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var providers []Contact
+	for id, r := range s.records[key] {
+		if now.After(r.expires) {
+			delete(s.records[key], id)
+			continue
+		}
+		providers = append(providers, r.Contact)
+	}
+	if len(s.records[key]) == 0 {
+		delete(s.records, key)
+	}
+	return providers
+}
@@ -0,0 +1,117 @@
+package dht
+
+import (
+	"Etherfile/p2p"
+	"bytes"
+	"math/bits"
+	"slices"
+	"sync"
+)
+
+// Contact 路由表中的一个节点
+type Contact struct {
+	ID   p2p.NodeID
+	Addr string
+}
+
+// Distance 两个标识之间的XOR距离
+func Distance(a, b p2p.NodeID) p2p.NodeID {
+	var d p2p.NodeID
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closer a是否比b更接近target
+func closer(a, b, target p2p.NodeID) bool {
+	da, db := Distance(a, target), Distance(b, target)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// bucketIndex 与self的公共前缀长度 也就是id所在的k桶 id等于self时返回-1
+func bucketIndex(self, id p2p.NodeID) int {
+	d := Distance(self, id)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return -1
+}
+
+// sortByDistance 按与target的距离从近到远排序
+func sortByDistance(contacts []Contact, target p2p.NodeID) {
+	slices.SortFunc(contacts, func(a, b Contact) int {
+		da, db := Distance(a.ID, target), Distance(b.ID, target)
+		return bytes.Compare(da[:], db[:])
+	})
+}
+
+// RoutingTable 按与本节点公共前缀长度分组的k桶 每个桶中最近活跃的节点在最后
+type RoutingTable struct {
+	self p2p.NodeID
+	k    int
+
+	mu      sync.Mutex
+	buckets [len(p2p.NodeID{}) * 8][]Contact
+}
+
+func NewRoutingTable(self p2p.NodeID, k int) *RoutingTable {
+	return &RoutingTable{self: self, k: k}
+}
+
+// Update 记录一个活跃的节点 桶已满时保留原有的节点(在线时间越长的节点越可能继续在线)
+// 返回节点是否在路由表中
+func (t *RoutingTable) Update(c Contact) bool {
+	i := bucketIndex(t.self, c.ID)
+	if i < 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bucket := t.buckets[i]
+	if j := slices.IndexFunc(bucket, func(e Contact) bool { return e.ID == c.ID }); j >= 0 {
+		bucket = slices.Delete(bucket, j, j+1)
+	} else if len(bucket) >= t.k {
+		return false
+	}
+	t.buckets[i] = append(bucket, c)
+	return true
+}
+
+// Remove 删除没有响应的节点
+func (t *RoutingTable) Remove(id p2p.NodeID) {
+	i := bucketIndex(t.self, id)
+	if i < 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buckets[i] = slices.DeleteFunc(t.buckets[i], func(e Contact) bool { return e.ID == id })
+}
+
+// Closest 路由表中离target最近的n个节点
+func (t *RoutingTable) Closest(target p2p.NodeID, n int) []Contact {
+	t.mu.Lock()
+	var all []Contact
+	for _, bucket := range t.buckets {
+		all = append(all, bucket...)
+	}
+	t.mu.Unlock()
+	sortByDistance(all, target)
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (t *RoutingTable) Size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"Etherfile/dht"
+	"Etherfile/p2p"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// infoPeer 只提供握手信息和远端地址
+type infoPeer struct {
+	p2p.Peer
+	info   p2p.PeerInfo
+	remote net.Addr
+}
+
+func (p infoPeer) Info() p2p.PeerInfo   { return p.info }
+func (p infoPeer) RemoteAddr() net.Addr { return p.remote }
+
+func TestContactOf(t *testing.T) {
+	id := p2p.NewNodeID()
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 51234}
+
+	// 监听地址没有主机部分时使用连接的IP和监听端口
+	c := contactOf(infoPeer{info: p2p.PeerInfo{NodeID: id, ListenAddr: ":3000"}, remote: remote})
+	assert.Equal(t, id, c.ID)
+	assert.Equal(t, "10.0.0.5:3000", c.Addr)
+	c = contactOf(infoPeer{info: p2p.PeerInfo{NodeID: id, ListenAddr: "0.0.0.0:3000"}, remote: remote})
+	assert.Equal(t, "10.0.0.5:3000", c.Addr)
+	c = contactOf(infoPeer{info: p2p.PeerInfo{NodeID: id, ListenAddr: "192.168.1.2:3000"}, remote: remote})
+	assert.Equal(t, "192.168.1.2:3000", c.Addr)
+
+	assert.False(t, supportsDHT(infoPeer{info: p2p.PeerInfo{NodeID: id}}))
+	assert.True(t, supportsDHT(infoPeer{info: p2p.PeerInfo{NodeID: id, Capabilities: []string{CapDHT}}}))
+	assert.False(t, supportsDHT(infoPeer{info: p2p.PeerInfo{Capabilities: []string{CapDHT}}}))
+}
+
+func TestFileServer_AddProviderOnlySelf(t *testing.T) {
+	fs := newTestServer(t)
+	sender := p2p.PeerInfo{NodeID: p2p.NewNodeID(), ListenAddr: "127.0.0.1:3000", Capabilities: []string{CapDHT}}
+	peer := infoPeer{info: sender, remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 51234}}
+	fs.peers[sender.NodeID.String()] = peer
+
+	// 不能把其他节点登记为提供者
+	key := dht.KeyID("forged")
+	other := dht.Contact{ID: p2p.NewNodeID(), Addr: "10.0.0.9:3000"}
+	assert.NotNil(t, fs.handleMsgAddProvider(sender.NodeID.String(), 1, MessageAddProvider{Key: key, Provider: other}))
+	providers, _ := fs.dht.HandleFindValue(dht.Contact{ID: p2p.NewNodeID()}, key)
+	assert.Empty(t, providers)
+}
+
+func TestFileServer_GetAsksProvidersOnly(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	addrs := []string{"127.0.0.1:4460", "127.0.0.1:4461", "127.0.0.1:4462", "127.0.0.1:4463", "127.0.0.1:4464"}
+	nodes := make([]*FileServer, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = newClusterNode(t, kr, FileServerOpts{ListenAddr: addr, ReplicationFactor: 2}, addrs[:i]...)
+		t.Cleanup(nodes[i].Stop)
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return len(n.peerList()) == len(nodes)-1 }, 3*time.Second, 20*time.Millisecond)
+	}
+
+	// 找一个写入节点不负责的key 读取节点和其余节点也都不负责
+	writer := nodes[0]
+	var (
+		key    string
+		owners []string
+	)
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("dht_file_%d", i)
+		owners = writer.replicaOwners(key)
+		if !slices.Contains(owners, writer.NodeID.String()) {
+			break
+		}
+	}
+	var reader *FileServer
+	var bystanders []string
+	for _, n := range nodes[1:] {
+		if slices.Contains(owners, n.NodeID.String()) {
+			continue
+		}
+		if reader == nil {
+			reader = n
+		} else {
+			bystanders = append(bystanders, n.NodeID.String())
+		}
+	}
+	assert.NotEmpty(t, bystanders)
+
+	assert.Nil(t, writer.Store(key, bytes.NewReader([]byte("found through the dht"))))
+	for _, n := range nodes {
+		if slices.Contains(owners, n.NodeID.String()) {
+			assert.Eventually(t, func() bool { return n.store.Exists(key) }, 3*time.Second, 20*time.Millisecond)
+		}
+	}
+
+	// 只向负责该key的节点和登记的提供者(写入节点)请求 不向其他节点广播
+	for _, peer := range reader.sourcesFor(key) {
+		name := peerName(peer)
+		assert.True(t, name == writer.NodeID.String() || slices.Contains(owners, name), name)
+		assert.NotContains(t, bystanders, name)
+	}
+	r, err := reader.Get(key)
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "found through the dht", string(got))
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/**
+信封加密: 每个文件使用随机生成的数据密钥加密内容
+数据密钥再用节点的主密钥(Encrypter.Key())加密后保存在与文件同目录的元数据文件中
+轮换主密钥时只需要重新加密元数据文件中的数据密钥 不需要重写文件内容
+元数据同时记录文件原始写入的时间 作为文件的版本随副本一起复制 复制和修复都不改变它
+纠删码的分片在元数据中标记 分片按文件的分片清单放置 不按自己的key复制和修复
+*/
+
+const (
+	metaSuffix      = ".meta"
+	fileMetaVersion = 1
+)
+
+var ErrNoMeta = errors.New("store: file has no metadata")
+
+// FileMeta 文件的元数据 Written是文件原始写入的时间 Shard表示文件是纠删码的分片
+type FileMeta struct {
+	Version    int       `json:"version"`
+	WrappedKey []byte    `json:"wrapped_key"`
+	Written    time.Time `json:"written"`
+	Shard      bool      `json:"shard,omitempty"`
+}
+
+// wrapDataKey 用主密钥加密数据密钥 返回编码后的元数据 写入时间为当前时间
+func wrapDataKey(encrypter Encrypter, dataKey []byte) ([]byte, error) {
+	wrapped, err := wrapKey(encrypter, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(FileMeta{
+		Version:    fileMetaVersion,
+		WrappedKey: wrapped,
+		Written:    time.Now().UTC(),
+	})
+}
+
+func wrapKey(encrypter Encrypter, dataKey []byte) ([]byte, error) {
+	wrapped := new(bytes.Buffer)
+	if _, err := encrypter.Encrypt(encrypter.Key(), bytes.NewReader(dataKey), wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped.Bytes(), nil
+}
+
+// parseMeta 解析元数据 没有元数据或者无法解析时返回零值
+func parseMeta(meta []byte) FileMeta {
+	var m FileMeta
+	if len(meta) == 0 || json.Unmarshal(meta, &m) != nil {
+		return FileMeta{}
+	}
+	return m
+}
+
+// metaWritten 元数据中记录的写入时间 没有元数据或者无法解析时返回零值
+func metaWritten(meta []byte) time.Time {
+	return parseMeta(meta).Written
+}
+
+// markShard 在元数据中标记文件是纠删码的分片
+func markShard(meta []byte) ([]byte, error) {
+	var m FileMeta
+	if err := json.Unmarshal(meta, &m); err != nil {
+		return nil, err
+	}
+	m.Shard = true
+	return json.Marshal(m)
+}
+
+// unwrapDataKey 从元数据中解出数据密钥
+func unwrapDataKey(encrypter Encrypter, meta []byte) ([]byte, error) {
+	var m FileMeta
+	if err := json.Unmarshal(meta, &m); err != nil {
+		return nil, err
+	}
+	if m.Version != fileMetaVersion {
+		return nil, fmt.Errorf("store: unsupported metadata version %d", m.Version)
+	}
+	dataKey := new(bytes.Buffer)
+	if _, err := encrypter.Decrypt(encrypter.Key(), bytes.NewReader(m.WrappedKey), dataKey); err != nil {
+		return nil, err
+	}
+	return dataKey.Bytes(), nil
+}
+
+func (s *Store) metaPath(key string) string {
+	return s.Root + "/" + s.PathTransformFunc(key).FullPath() + metaSuffix
+}
+
+// ReadMeta 读取文件的元数据 文件没有元数据时返回ErrNoMeta
+func (s *Store) ReadMeta(key string) ([]byte, error) {
+	meta, err := os.ReadFile(s.metaPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoMeta
+	}
+	return meta, err
+}
+
+// WriteMeta 写入文件的元数据
+func (s *Store) WriteMeta(key string, meta []byte) error {
+	pathKey := s.PathTransformFunc(key)
+	if err := os.MkdirAll(s.Root+"/"+pathKey.PathName, os.ModePerm); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.metaPath(key), meta)
+}
+
+// Written 返回文件的版本 即元数据中记录的原始写入时间 没有元数据的文件返回零值
+func (s *Store) Written(key string) time.Time {
+	meta, err := s.ReadMeta(key)
+	if err != nil {
+		return time.Time{}
+	}
+	return metaWritten(meta)
+}
+
+// IsShard 文件是否是纠删码的分片
+func (s *Store) IsShard(key string) bool {
+	meta, err := s.ReadMeta(key)
+	return err == nil && parseMeta(meta).Shard
+}
+
+// RemoveMeta 删除文件的元数据 没有元数据时不做任何事
+func (s *Store) RemoveMeta(key string) error {
+	err := os.Remove(s.metaPath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// RewrapKeys 遍历所有元数据文件 用当前的主密钥重新加密其中的数据密钥 返回更新的文件数
+// 每个文件在它的key的锁内重新读取元数据 不会覆盖同时提交的新元数据 也不会恢复已经删除的元数据
+func (s *Store) RewrapKeys(encrypter *KeyringEncrypter) (int, error) {
+	activeID, _ := encrypter.Keyring.Active()
+	count := 0
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+		_, unlock := s.lockPath(strings.TrimSuffix(path, metaSuffix))
+		defer unlock()
+		meta, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var m FileMeta
+		if err := json.Unmarshal(meta, &m); err != nil {
+			return fmt.Errorf("rewrap %s: %w", path, err)
+		}
+		if id, tagged, _, err := readKeyID(bytes.NewReader(m.WrappedKey)); err == nil && tagged && id == activeID {
+			return nil
+		}
+		dataKey, err := unwrapDataKey(encrypter, meta)
+		if err != nil {
+			return fmt.Errorf("rewrap %s: %w", path, err)
+		}
+		// 只替换加密后的数据密钥 保留写入时间
+		if m.WrappedKey, err = wrapKey(encrypter, dataKey); err != nil {
+			return fmt.Errorf("rewrap %s: %w", path, err)
+		}
+		if meta, err = json.Marshal(m); err != nil {
+			return fmt.Errorf("rewrap %s: %w", path, err)
+		}
+		if err := writeFileAtomic(path, meta); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// writeFileAtomic 先写入同目录下的临时文件再重命名
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "*"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore_WriteEncryptEnvelope(t *testing.T) {
+	keyring, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	e := NewKeyringEncrypter(keyring, NewGCMEncrypter())
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+
+	assert.Nil(t, s.WriteEncrypt("file_a", e, bytes.NewReader([]byte("envelope a"))))
+	assert.Nil(t, s.WriteEncrypt("file_b", e, bytes.NewReader([]byte("envelope b"))))
+
+	// 每个文件有自己的数据密钥
+	metaA, err := s.ReadMeta("file_a")
+	assert.Nil(t, err)
+	metaB, err := s.ReadMeta("file_b")
+	assert.Nil(t, err)
+	keyA, err := unwrapDataKey(e, metaA)
+	assert.Nil(t, err)
+	keyB, err := unwrapDataKey(e, metaB)
+	assert.Nil(t, err)
+	assert.NotEqual(t, keyA, keyB)
+	assert.NotEqual(t, e.Key(), keyA)
+
+	_, err = s.ReadMeta("missing")
+	assert.Equal(t, ErrNoMeta, err)
+
+	// 没有元数据的文件覆盖之后 旧的元数据被删除
+	assert.Nil(t, s.Write("file_a", bytes.NewReader([]byte("plain a"))))
+	_, err = s.ReadMeta("file_a")
+	assert.Equal(t, ErrNoMeta, err)
+}
+
+func TestStore_RewrapKeys(t *testing.T) {
+	keyring, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	e := NewKeyringEncrypter(keyring, NewGCMEncrypter())
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+	key := "rewrapped_file"
+	assert.Nil(t, s.WriteEncrypt(key, e, bytes.NewReader([]byte("payload stays the same"))))
+	path := s.Root + "/" + s.PathTransformFunc(key).FullPath()
+	before, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	written := s.Written(key)
+	assert.False(t, written.IsZero())
+
+	newID, err := keyring.Rotate(e.KeyGeneration())
+	assert.Nil(t, err)
+	n, err := s.RewrapKeys(e)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+
+	// 只重写了元数据 文件内容不变 并且只用新的主密钥就能读取
+	after, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+	assert.True(t, written.Equal(s.Written(key)))
+	keyring.keys = map[KeyID][]byte{newID: keyring.keys[newID]}
+	res := new(bytes.Buffer)
+	assert.Nil(t, s.ReadDecrypt(key, e, res))
+	assert.Equal(t, "payload stays the same", res.String())
+
+	n, err = s.RewrapKeys(e)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// 等待锁期间被删除的文件 元数据不会被重新写回
+	_, err = keyring.Rotate(e.KeyGeneration())
+	assert.Nil(t, err)
+	unlock := s.locks.Lock(key)
+	done := make(chan int)
+	go func() {
+		n, err := s.RewrapKeys(e)
+		assert.Nil(t, err)
+		done <- n
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, s.Delete(key))
+	unlock()
+	assert.Equal(t, 0, <-done)
+	_, err = s.ReadMeta(key)
+	assert.Equal(t, ErrNoMeta, err)
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"Etherfile/erasure"
+	"Etherfile/p2p"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+/**
+纠删码存储: 文件编码为k个数据分片和m个校验分片 每个分片以文件的key加上分片明文的CID为key加密后
+存储到哈希环上负责该文件的不同节点 分片清单以文件的key按普通方式复制存储
+分片的key包含文件的key 内容相同的两个文件不共用分片 删除文件时连同分片一起删除
+文件按条带(StripeSize字节)依次编码 每个分片是各个条带中对应分片的拼接 内存中只保存一个条带
+分片发送给负责的节点并等待确认 没有确认时保留在本地
+读取时打开任意k个分片的数据流 逐个条带还原文件 最多可以容忍m个节点不可用 读取的分片不保存在本地
+分片的元数据标记为分片 分片的位置由文件的key决定 反熵修复和补充副本都不处理分片
+*/
+
+const (
+	erasureManifestVersion = 3
+	// 版本1的分片清单中分片以CID为key 多个文件可能共用 版本1和2只有一个条带
+	erasureManifestV1 = 1
+	erasureManifestV2 = 2
+
+	DefaultErasureStripeSize = 4 * 1024 * 1024
+)
+
+var ErrBadErasureManifest = errors.New("erasure manifest: invalid shard layout")
+
+// ErasureOpts 纠删码的分片数 DataShards为0时不使用纠删码
+type ErasureOpts struct {
+	DataShards   int
+	ParityShards int
+	// StripeSize 每次编码的数据大小 为0时使用DefaultErasureStripeSize
+	StripeSize int
+}
+
+func (o ErasureOpts) Enabled() bool {
+	return o.DataShards > 0
+}
+
+// ErasureManifest 纠删码存储的文件的分片清单 Shards按分片序号排列 CID是整个分片明文的CID
+type ErasureManifest struct {
+	Version      int   `json:"version"`
+	Size         int64 `json:"size"`
+	DataShards   int   `json:"data_shards"`
+	ParityShards int   `json:"parity_shards"`
+	StripeSize   int64 `json:"stripe_size,omitempty"`
+	Shards       []CID `json:"shards"`
+}
+
+func (m *ErasureManifest) Verify() error {
+	if m.Version < erasureManifestV1 || m.Version > erasureManifestVersion {
+		return fmt.Errorf("erasure manifest: unsupported version %d", m.Version)
+	}
+	if m.DataShards <= 0 || m.ParityShards < 0 || len(m.Shards) != m.DataShards+m.ParityShards {
+		return ErrBadErasureManifest
+	}
+	if m.Size < 0 || m.StripeSize < 0 || (m.Version == erasureManifestVersion && m.StripeSize == 0) {
+		return ErrBadErasureManifest
+	}
+	return nil
+}
+
+// stripes 条带数和每个条带的数据大小 最后一个条带可能较小 空文件也有一个条带
+func (m *ErasureManifest) stripes() (int64, int64) {
+	if m.StripeSize == 0 || m.Size <= m.StripeSize {
+		return 1, m.Size
+	}
+	return (m.Size + m.StripeSize - 1) / m.StripeSize, m.StripeSize
+}
+
+// ShardKey 文件key的第i个分片存储使用的key
+func (m *ErasureManifest) ShardKey(key string, i int) string {
+	if m.Version == erasureManifestV1 {
+		return m.Shards[i].String()
+	}
+	return key + "#" + m.Shards[i].String()
+}
+
+// StoreErasure 将文件按条带编码为分片 第i个分片存储到哈希环上负责key的第i个可用节点
+// 节点数少于分片数时一个节点存储多个分片
+func (fs *FileServer) StoreErasure(key string, r io.Reader) (*ErasureManifest, error) {
+	enc, err := erasure.New(fs.Erasure.DataShards, fs.Erasure.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	stripeSize := fs.Erasure.StripeSize
+	if stripeSize <= 0 {
+		stripeSize = DefaultErasureStripeSize
+	}
+	m := &ErasureManifest{
+		Version:      erasureManifestVersion,
+		DataShards:   enc.DataShards(),
+		ParityShards: enc.ParityShards(),
+		StripeSize:   int64(stripeSize),
+		Shards:       make([]CID, enc.TotalShards()),
+	}
+	files, err := fs.stageShards(enc, m, r)
+	if err != nil {
+		return nil, err
+	}
+
+	// 并行发送分片 等待所有分片存储完成
+	owners := fs.ring.OwnersFunc(key, len(files), fs.available)
+	errs := make(chan error, len(files))
+	for i, f := range files {
+		go func(i int, f *StagedFile) {
+			if err := fs.placeShard(owners[i%len(owners)], m.ShardKey(key, i), f); err != nil {
+				errs <- fmt.Errorf("store shard %d: %w", i, err)
+				return
+			}
+			errs <- nil
+		}(i, f)
+	}
+	for range files {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.storeReplicated(key, bytes.NewReader(manifest)); err != nil {
+		return nil, err
+	}
+	log.Printf("[%s] stored %s as %d+%d shards\n", fs.ListenAddr, key, m.DataShards, m.ParityShards)
+	return m, nil
+}
+
+// stageShards 逐个条带读取r并编码 每个分片边加密边写入自己的临时文件 同时计算分片的CID和文件大小
+func (fs *FileServer) stageShards(enc *erasure.Encoder, m *ErasureManifest, r io.Reader) ([]*StagedFile, error) {
+	type staged struct {
+		index int
+		file  *StagedFile
+		err   error
+	}
+	var (
+		writers = make([]*io.PipeWriter, enc.TotalShards())
+		hashers = make([]*cidHasher, enc.TotalShards())
+		results = make(chan staged, enc.TotalShards())
+	)
+	for i := range writers {
+		pr, pw := io.Pipe()
+		writers[i], hashers[i] = pw, newCIDHasher()
+		go func(i int) {
+			f, err := fs.stageShard(io.TeeReader(pr, hashers[i]))
+			// 暂存失败时让写入方停止
+			pr.CloseWithError(err)
+			results <- staged{index: i, file: f, err: err}
+		}(i)
+	}
+
+	err := encodeStripes(enc, m, r, writers)
+	for _, w := range writers {
+		w.CloseWithError(err)
+	}
+	files := make([]*StagedFile, len(writers))
+	for range writers {
+		res := <-results
+		files[res.index] = res.file
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+	}
+	if err != nil {
+		for _, f := range files {
+			if f != nil {
+				_ = fs.store.Discard(f)
+			}
+		}
+		return nil, err
+	}
+	for i, h := range hashers {
+		m.Shards[i] = h.CID()
+	}
+	return files, nil
+}
+
+// encodeStripes 每次读取一个条带 编码后把每个分片写入对应的writer 记录文件大小
+func encodeStripes(enc *erasure.Encoder, m *ErasureManifest, r io.Reader, writers []*io.PipeWriter) error {
+	buf := make([]byte, m.StripeSize)
+	for first := true; ; first = false {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && !first {
+			return nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		m.Size += int64(n)
+		shards := enc.Split(buf[:n])
+		if err := enc.Encode(shards); err != nil {
+			return err
+		}
+		for i, shard := range shards {
+			if _, err := writers[i].Write(shard); err != nil {
+				return err
+			}
+		}
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// placeShard 将暂存的分片存储到owner 对方确认后删除临时文件 本地不保留
+// owner是本节点或者没有确认时保存在本地
+func (fs *FileServer) placeShard(owner, key string, f *StagedFile) error {
+	if owner != fs.NodeID.String() {
+		if peer, ok := fs.getPeer(owner); ok {
+			err := fs.pushStaged(peer, key, f)
+			if err == nil {
+				return fs.store.Discard(f)
+			}
+			log.Printf("[%s] Error sending shard %s to %s: %s, keeping it locally\n", fs.ListenAddr, key, owner, err)
+		}
+	}
+	if fs.store.Exists(key) {
+		_ = fs.store.Discard(f)
+	} else if err := fs.store.Commit(key, f); err != nil {
+		_ = fs.store.Discard(f)
+		return err
+	}
+	fs.provide(key)
+	return nil
+}
+
+// stageShard 将分片加密到临时文件 元数据中标记为分片
+func (fs *FileServer) stageShard(r io.Reader) (*StagedFile, error) {
+	f, err := fs.store.StageEncrypt(fs.Encrypter, r)
+	if err != nil {
+		return nil, err
+	}
+	if f.meta, err = markShard(f.meta); err != nil {
+		_ = fs.store.Discard(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+// pushStaged 让peer存储临时文件中的密文并等待确认 与push相同 先发送存储命令再发送数据流
+func (fs *FileServer) pushStaged(peer p2p.Peer, key string, f *StagedFile) error {
+	size, r, err := fs.store.OpenStaged(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	msg := Message{
+		ID: newRequestID(),
+		Payload: MessageStoreFile{
+			Key:  key,
+			Size: size,
+			Meta: f.meta,
+			Time: f.version,
+		},
+	}
+	req := fs.addPending(msg.ID, peerName(peer))
+	defer fs.removePending(msg.ID)
+	if err := fs.send(peer, &msg); err != nil {
+		return err
+	}
+	if err := writeFileReply(peer, msg.ID, f.meta, size, 0, size, r); err != nil {
+		return err
+	}
+	if _, err := req.waitMessage(replyTimeout); err != nil {
+		return fmt.Errorf("%s did not confirm storing %s: %w", peerName(peer), key, err)
+	}
+	return nil
+}
+
+// GetErasureManifest 获取并校验纠删码存储的文件的分片清单
+func (fs *FileServer) GetErasureManifest(key string) (*ErasureManifest, error) {
+	r, err := fs.getReplicated(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	m := new(ErasureManifest)
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	if err := m.Verify(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetErasure 获取纠删码存储的文件 打开任意k个分片的数据流后逐个条带还原
+func (fs *FileServer) GetErasure(key string) (io.ReadCloser, error) {
+	m, err := fs.GetErasureManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := erasure.New(m.DataShards, m.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := fs.openShards(key, m)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		err := streams.join(enc, pw)
+		streams.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+type shardResult struct {
+	index int
+	r     io.ReadCloser
+	err   error
+}
+
+// shardStreams 读取中的分片数据流 readers中没有打开的分片为nil
+type shardStreams struct {
+	fs      *FileServer
+	key     string
+	m       *ErasureManifest
+	readers []io.ReadCloser
+	// failed 打开或读取失败的分片
+	failed []bool
+	// pos 每个分片已经读取的字节数
+	pos int64
+}
+
+// openShards 并行打开文件key的所有分片 有k个分片打开时立即返回 之后打开的分片直接关闭
+func (fs *FileServer) openShards(key string, m *ErasureManifest) (*shardStreams, error) {
+	s := &shardStreams{
+		fs:      fs,
+		key:     key,
+		m:       m,
+		readers: make([]io.ReadCloser, len(m.Shards)),
+		failed:  make([]bool, len(m.Shards)),
+	}
+	results := make(chan shardResult, len(m.Shards))
+	for i := range m.Shards {
+		go func(i int) {
+			r, err := s.open(i)
+			results <- shardResult{index: i, r: r, err: err}
+		}(i)
+	}
+	opened := 0
+	for n := range m.Shards {
+		res := <-results
+		if res.err != nil {
+			log.Printf("[%s] Error opening shard %d (%s): %s\n", fs.ListenAddr, res.index, m.Shards[res.index], res.err)
+			s.failed[res.index] = true
+			continue
+		}
+		s.readers[res.index] = res.r
+		if opened++; opened == m.DataShards {
+			go func(remaining int) {
+				for ; remaining > 0; remaining-- {
+					if res := <-results; res.err == nil {
+						res.r.Close()
+					}
+				}
+			}(len(m.Shards) - n - 1)
+			return s, nil
+		}
+	}
+	s.Close()
+	return nil, fmt.Errorf("%w: %d of %d available", erasure.ErrTooFewShards, opened, m.DataShards)
+}
+
+// open 打开第i个分片的明文数据流 本地没有时从网络中按需读取 读到结尾时校验内容
+func (s *shardStreams) open(i int) (io.ReadCloser, error) {
+	key := s.m.ShardKey(s.key, i)
+	var r io.ReadCloser
+	if s.fs.store.Exists(key) {
+		r = s.fs.openDecrypt(key)
+	} else {
+		var err error
+		if r, err = s.fs.openRemote(key); err != nil {
+			return nil, err
+		}
+	}
+	// 以CID为key的分片已经在打开时校验
+	if _, err := ParseCID(key); err != nil {
+		r = newCIDVerifyReader(r, s.m.Shards[i])
+	}
+	return r, nil
+}
+
+// read 从第i个分片读取size个字节 失败时改为打开一个没有使用过的分片 跳过已经读取的部分
+func (s *shardStreams) read(i int, size int) (int, []byte, error) {
+	buf := make([]byte, size)
+	for {
+		_, err := io.ReadFull(s.readers[i], buf)
+		if err == nil {
+			return i, buf, nil
+		}
+		log.Printf("[%s] Error reading shard %d of %s: %s\n", s.fs.ListenAddr, i, s.key, err)
+		s.readers[i].Close()
+		s.readers[i], s.failed[i] = nil, true
+		if i = s.spare(); i < 0 {
+			return 0, nil, erasure.ErrTooFewShards
+		}
+	}
+}
+
+// spare 打开一个没有使用过也没有失败的分片 并跳过已经读取的部分 没有可用的分片时返回-1
+func (s *shardStreams) spare() int {
+	for i := range s.readers {
+		if s.readers[i] != nil || s.failed[i] {
+			continue
+		}
+		r, err := s.open(i)
+		if err == nil {
+			if _, err = io.CopyN(io.Discard, r, s.pos); err == nil {
+				s.readers[i] = r
+				return i
+			}
+			r.Close()
+		}
+		log.Printf("[%s] Error opening shard %d of %s: %s\n", s.fs.ListenAddr, i, s.key, err)
+		s.failed[i] = true
+	}
+	return -1
+}
+
+// join 逐个条带读取k个分片 还原后写入dst 最后确认每个分片都已经读到结尾并通过校验
+func (s *shardStreams) join(enc *erasure.Encoder, dst io.Writer) error {
+	count, stripeSize := s.m.stripes()
+	for j := int64(0); j < count; j++ {
+		size := min(stripeSize, s.m.Size-j*stripeSize)
+		shardSize := enc.ShardSize(int(size))
+		shards := make([][]byte, len(s.readers))
+		// 读取失败的分片会被替换为另一个分片 先记下这个条带要读取的分片
+		var active []int
+		for i, r := range s.readers {
+			if r != nil {
+				active = append(active, i)
+			}
+		}
+		for _, i := range active {
+			i, data, err := s.read(i, shardSize)
+			if err != nil {
+				return err
+			}
+			shards[i] = data
+		}
+		if err := enc.Reconstruct(shards); err != nil {
+			return err
+		}
+		if err := enc.Join(dst, shards, int(size)); err != nil {
+			return err
+		}
+		s.pos += int64(shardSize)
+	}
+	for i, r := range s.readers {
+		if r == nil {
+			continue
+		}
+		if n, err := io.Copy(io.Discard, r); err != nil || n > 0 {
+			return fmt.Errorf("shard %d of %s: %d trailing bytes: %v", i, s.key, n, err)
+		}
+	}
+	return nil
+}
+
+func (s *shardStreams) Close() {
+	for _, r := range s.readers {
+		if r != nil {
+			r.Close()
+		}
+	}
+}
+
+// erasureShardKeys 纠删码存储的文件key的所有分片的key 不是纠删码存储的文件时返回nil
+func (fs *FileServer) erasureShardKeys(key string) []string {
+	if !fs.Erasure.Enabled() {
+		return nil
+	}
+	m, err := fs.GetErasureManifest(key)
+	if err != nil {
+		if !errors.Is(err, ErrFileDeleted) {
+			log.Printf("[%s] Error reading shard manifest of %s: %s\n", fs.ListenAddr, key, err)
+		}
+		return nil
+	}
+	keys := make([]string, len(m.Shards))
+	for i := range m.Shards {
+		keys[i] = m.ShardKey(key, i)
+	}
+	return keys
+}
@@ -0,0 +1,176 @@
+package erasure
+
+import (
+	"errors"
+	"io"
+)
+
+/**
+Reed-Solomon纠删码: 数据切分为k个数据分片 再计算出m个校验分片
+编码矩阵由范德蒙矩阵变换而来 前k行是单位矩阵(数据分片保持原样) 任意k行组成的方阵都可逆
+所以k+m个分片中任意k个都能恢复出全部数据 最多可以丢失m个分片
+*/
+
+// MaxShards 分片总数的上限 受GF(2^8)元素个数的限制
+const MaxShards = 256
+
+var (
+	ErrInvalidShardCount = errors.New("erasure: invalid number of shards")
+	ErrShardSize         = errors.New("erasure: shards have different sizes")
+	ErrTooFewShards      = errors.New("erasure: too few shards to reconstruct")
+)
+
+type Encoder struct {
+	dataShards   int
+	parityShards int
+	// (k+m)*k的编码矩阵
+	matrix matrix
+}
+
+func New(dataShards, parityShards int) (*Encoder, error) {
+	if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > MaxShards {
+		return nil, ErrInvalidShardCount
+	}
+	total := dataShards + parityShards
+	v := vandermonde(total, dataShards)
+	top, err := v[:dataShards].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Encoder{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		matrix:       v.mul(top),
+	}, nil
+}
+
+func (e *Encoder) DataShards() int {
+	return e.dataShards
+}
+
+func (e *Encoder) ParityShards() int {
+	return e.parityShards
+}
+
+func (e *Encoder) TotalShards() int {
+	return e.dataShards + e.parityShards
+}
+
+// ShardSize 长度为size的数据切分后每个分片的大小 空数据的分片也有1个字节
+func (e *Encoder) ShardSize(size int) int {
+	return max(1, (size+e.dataShards-1)/e.dataShards)
+}
+
+// Split 将数据切分为k个数据分片 最后一个分片不足的部分补0 同时分配m个空的校验分片
+func (e *Encoder) Split(data []byte) [][]byte {
+	size := e.ShardSize(len(data))
+	shards := make([][]byte, e.TotalShards())
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < e.dataShards && i*size < len(data) {
+			copy(shards[i], data[i*size:])
+		}
+	}
+	return shards
+}
+
+// Encode 由数据分片计算校验分片 所有分片的大小必须相同
+func (e *Encoder) Encode(shards [][]byte) error {
+	if len(shards) != e.TotalShards() {
+		return ErrInvalidShardCount
+	}
+	size := len(shards[0])
+	for _, s := range shards {
+		if len(s) != size {
+			return ErrShardSize
+		}
+	}
+	for i := e.dataShards; i < len(shards); i++ {
+		clear(shards[i])
+		e.encodeRow(e.matrix[i], shards[:e.dataShards], shards[i])
+	}
+	return nil
+}
+
+func (e *Encoder) encodeRow(row []byte, inputs [][]byte, out []byte) {
+	for j, c := range row {
+		mulAdd(c, inputs[j], out)
+	}
+}
+
+// Reconstruct 恢复缺少的分片 缺少的分片为nil或者长度为0 至少需要k个分片
+func (e *Encoder) Reconstruct(shards [][]byte) error {
+	if len(shards) != e.TotalShards() {
+		return ErrInvalidShardCount
+	}
+	var (
+		size    = -1
+		present []int
+	)
+	for i, s := range shards {
+		if len(s) == 0 {
+			continue
+		}
+		if size >= 0 && len(s) != size {
+			return ErrShardSize
+		}
+		size = len(s)
+		present = append(present, i)
+	}
+	if len(present) < e.dataShards {
+		return ErrTooFewShards
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+
+	// 取前k个存在的分片 它们对应的编码矩阵行的逆矩阵将分片还原为数据
+	present = present[:e.dataShards]
+	sub := make(matrix, e.dataShards)
+	inputs := make([][]byte, e.dataShards)
+	for i, idx := range present {
+		sub[i] = e.matrix[idx]
+		inputs[i] = shards[idx]
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < e.dataShards; i++ {
+		if len(shards[i]) == 0 {
+			shards[i] = make([]byte, size)
+			e.encodeRow(decode[i], inputs, shards[i])
+		}
+	}
+	for i := e.dataShards; i < len(shards); i++ {
+		if len(shards[i]) == 0 {
+			shards[i] = make([]byte, size)
+			e.encodeRow(e.matrix[i], shards[:e.dataShards], shards[i])
+		}
+	}
+	return nil
+}
+
+// Join 将数据分片按顺序写入dst 只写入前size个字节(去掉Split时补的0)
+func (e *Encoder) Join(dst io.Writer, shards [][]byte, size int) error {
+	if len(shards) < e.dataShards {
+		return ErrTooFewShards
+	}
+	for _, s := range shards[:e.dataShards] {
+		if len(s) == 0 {
+			return ErrTooFewShards
+		}
+		if size <= 0 {
+			break
+		}
+		n := min(len(s), size)
+		if _, err := dst.Write(s[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+	if size > 0 {
+		return ErrShardSize
+	}
+	return nil
+}
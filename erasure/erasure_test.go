@@ -0,0 +1,62 @@
+package erasure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGalois(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			p := gfMul(byte(a), byte(b))
+			assert.Equal(t, byte(a), gfDiv(p, byte(b)))
+		}
+	}
+	assert.Equal(t, byte(0), gfMul(0, 7))
+}
+
+func TestEncoder_ReconstructAnyK(t *testing.T) {
+	e, err := New(4, 2)
+	assert.Nil(t, err)
+	data := make([]byte, 10000+3)
+	_, _ = io.ReadFull(rand.Reader, data)
+
+	shards := e.Split(data)
+	assert.Nil(t, e.Encode(shards))
+	// 数据分片保持原样
+	assert.Equal(t, data[:e.ShardSize(len(data))], shards[0])
+
+	// 每一种丢失两个分片的情况都能恢复
+	for i := 0; i < e.TotalShards(); i++ {
+		for j := i + 1; j < e.TotalShards(); j++ {
+			damaged := make([][]byte, len(shards))
+			copy(damaged, shards)
+			damaged[i], damaged[j] = nil, nil
+			assert.Nil(t, e.Reconstruct(damaged))
+			assert.Equal(t, shards, damaged)
+
+			buf := new(bytes.Buffer)
+			assert.Nil(t, e.Join(buf, damaged, len(data)))
+			assert.Equal(t, data, buf.Bytes())
+		}
+	}
+
+	damaged := make([][]byte, len(shards))
+	copy(damaged, shards)
+	damaged[0], damaged[2], damaged[5] = nil, nil, nil
+	assert.Equal(t, ErrTooFewShards, e.Reconstruct(damaged))
+}
+
+func TestNew_InvalidShards(t *testing.T) {
+	_, err := New(0, 2)
+	assert.Equal(t, ErrInvalidShardCount, err)
+	_, err = New(200, 57)
+	assert.Equal(t, ErrInvalidShardCount, err)
+	e, err := New(3, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrShardSize, e.Encode([][]byte{{1}, {2, 3}, {4}}))
+}
@@ -0,0 +1,66 @@
+package erasure
+
+/**
+GF(2^8)上的运算 使用多项式x^8+x^4+x^3+x^2+1(0x11d) 生成元为2
+加法和减法都是异或 乘法和除法通过对数表计算 常用的乘法结果预先计算在乘法表中
+*/
+
+const fieldPoly = 0x11d
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= fieldPoly
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	return mulTable[a][b]
+}
+
+// gfDiv b不能为0
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+// gfPow a的n次方 0的0次方为1
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])*n%255]
+}
+
+// mulAdd dst[i] ^= c * src[i]
+func mulAdd(c byte, src, dst []byte) {
+	if c == 0 {
+		return
+	}
+	row := &mulTable[c]
+	for i, v := range src {
+		dst[i] ^= row[v]
+	}
+}
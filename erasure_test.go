@@ -0,0 +1,236 @@
+package main
+
+import (
+	"Etherfile/erasure"
+	"Etherfile/p2p"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newClusterNode 启动一个通过TCP与bootstrap节点连接的FileServer
+func newClusterNode(t *testing.T, kr *Keyring, opts FileServerOpts, bootstrap ...string) *FileServer {
+	return newWrappedNode(t, kr, opts, nil, bootstrap...)
+}
+
+// newWrappedNode 与newClusterNode相同 wrap不为nil时由它包装节点使用的transport
+func newWrappedNode(t *testing.T, kr *Keyring, opts FileServerOpts, wrap func(p2p.Transport) p2p.Transport, bootstrap ...string) *FileServer {
+	enc := NewKeyringEncrypter(kr, NewGCMEncrypter())
+	root := t.TempDir()
+	id, err := LoadOrCreateNodeID(root)
+	assert.Nil(t, err)
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    opts.ListenAddr,
+		HandshakeFunc: p2p.NewHandshakeFunc(NewHandshakeOpts(id, opts.ListenAddr, enc)),
+	})
+	opts.NodeID, opts.Encrypter, opts.StorageRoot = id, enc, root
+	opts.PathTransformFunc, opts.Transport, opts.BootstrapNodes = SHA1PathTransformFunc, tr, bootstrap
+	if wrap != nil {
+		opts.Transport = wrap(tr)
+	}
+	fs := NewFileServer(opts)
+	tr.OnPeer = fs.OnPeer
+	tr.OnPeerClosed = fs.OnPeerClosed
+	go fs.Start()
+	return fs
+}
+
+// isolate 断开节点的所有连接 模拟节点宕机
+func isolate(fs *FileServer) {
+	for _, p := range fs.peerList() {
+		_ = p.Close()
+	}
+}
+
+func TestFileServer_ErasureSurvivesNodeLoss(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	addrs := []string{"127.0.0.1:4400", "127.0.0.1:4401", "127.0.0.1:4402", "127.0.0.1:4403", "127.0.0.1:4404"}
+	nodes := make([]*FileServer, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = newClusterNode(t, kr, FileServerOpts{
+			ListenAddr: addr,
+			// 小的条带让文件分成多个条带编码
+			Erasure: ErasureOpts{DataShards: 3, ParityShards: 2, StripeSize: 64 * 1024},
+		}, addrs[:i]...)
+		t.Cleanup(nodes[i].Stop)
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return len(n.peerList()) == len(nodes)-1 }, 3*time.Second, 20*time.Millisecond)
+	}
+
+	data := make([]byte, 300*1024+7)
+	_, _ = io.ReadFull(rand.Reader, data)
+	writer := nodes[0]
+	m, err := writer.StoreErasure("ec_file", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Len(t, m.Shards, 5)
+	assert.Equal(t, int64(len(data)), m.Size)
+	stripes, _ := m.stripes()
+	assert.Equal(t, int64(5), stripes)
+
+	// 每个分片只存储在负责它的节点上
+	byName := make(map[string]*FileServer)
+	for _, n := range nodes {
+		byName[n.NodeID.String()] = n
+	}
+	owners := writer.ring.Owners("ec_file", 5)
+	assert.Len(t, owners, 5)
+	for i := range m.Shards {
+		owner, shard := byName[owners[i]], m.ShardKey("ec_file", i)
+		assert.Eventually(t, func() bool { return owner.store.Exists(shard) }, 3*time.Second, 20*time.Millisecond)
+		assert.True(t, owner.store.IsShard(shard))
+		for _, n := range nodes {
+			if n != owner {
+				assert.False(t, n.store.Exists(shard))
+			}
+		}
+	}
+
+	// 分片不按自己的key修复或补充副本 只有分片清单参与
+	for _, n := range nodes {
+		keys, err := n.replicatedKeys()
+		assert.Nil(t, err)
+		for i := range m.Shards {
+			assert.NotContains(t, keys, m.ShardKey("ec_file", i))
+		}
+		inventory, err := n.sharedInventory("")
+		assert.Nil(t, err)
+		for _, entries := range inventory {
+			for _, e := range entries {
+				assert.Equal(t, "ec_file", e.Key)
+			}
+		}
+	}
+
+	// 写入的节点和另一个节点宕机后 剩下的三个分片仍然可以还原文件
+	var reader *FileServer
+	for _, n := range nodes[1:] {
+		if reader == nil && n.NodeID.String() != owners[0] {
+			reader = n
+		}
+	}
+	victims := []*FileServer{writer}
+	for _, n := range nodes[1:] {
+		if n != reader && len(victims) < 2 {
+			victims = append(victims, n)
+		}
+	}
+	for _, v := range victims {
+		isolate(v)
+	}
+	r, err := reader.Get("ec_file")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, got))
+
+	// 读取的分片不保存在本地
+	for i := range m.Shards {
+		assert.Equal(t, owners[i] == reader.NodeID.String(), reader.store.Exists(m.ShardKey("ec_file", i)))
+	}
+}
+
+func TestFileServer_DeleteErasure(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	addrs := []string{"127.0.0.1:4480", "127.0.0.1:4481", "127.0.0.1:4482"}
+	nodes := make([]*FileServer, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = newClusterNode(t, kr, FileServerOpts{
+			ListenAddr: addr,
+			Erasure:    ErasureOpts{DataShards: 2, ParityShards: 1},
+		}, addrs[:i]...)
+		t.Cleanup(nodes[i].Stop)
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return len(n.peerList()) == len(nodes)-1 }, 3*time.Second, 20*time.Millisecond)
+	}
+
+	// 内容相同的两个文件不共用分片
+	data := []byte("erasure coded and then deleted")
+	m, err := nodes[0].StoreErasure("ec_deleted", bytes.NewReader(data))
+	assert.Nil(t, err)
+	kept, err := nodes[0].StoreErasure("ec_kept", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, m.Shards, kept.Shards)
+	holds := func(key string) func() bool {
+		return func() bool {
+			for _, n := range nodes {
+				if n.store.Exists(key) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	for i := range m.Shards {
+		assert.Eventually(t, holds(m.ShardKey("ec_deleted", i)), 3*time.Second, 20*time.Millisecond)
+		assert.Eventually(t, holds(kept.ShardKey("ec_kept", i)), 3*time.Second, 20*time.Millisecond)
+	}
+
+	// 删除分片清单的同时删除所有分片
+	assert.Nil(t, nodes[1].Delete("ec_deleted"))
+	for i := range m.Shards {
+		shard := m.ShardKey("ec_deleted", i)
+		assert.Eventually(t, func() bool { return !holds(shard)() }, 3*time.Second, 20*time.Millisecond)
+		for _, n := range nodes {
+			assert.Eventually(t, func() bool {
+				_, ok := n.store.Tombstone(shard)
+				return ok
+			}, 3*time.Second, 20*time.Millisecond)
+		}
+	}
+	_, err = nodes[2].Get("ec_deleted")
+	assert.True(t, errors.Is(err, ErrFileDeleted))
+
+	r, err := nodes[2].Get("ec_kept")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestFileServer_ErasureReadSwitchesShards(t *testing.T) {
+	fs := newTestServer(t)
+	fs.Erasure = ErasureOpts{DataShards: 2, ParityShards: 1, StripeSize: 1024}
+	data := make([]byte, 300*1024+5)
+	_, _ = io.ReadFull(rand.Reader, data)
+	m, err := fs.StoreErasure("ec_local", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	// 分片0的密文中间被破坏 读到这里时改为读取校验分片
+	path := fs.store.Root + "/" + fs.store.PathTransformFunc(m.ShardKey("ec_local", 0)).FullPath()
+	sealed, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	sealed[len(sealed)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, sealed, 0o644))
+
+	s := &shardStreams{fs: fs, key: "ec_local", m: m, readers: make([]io.ReadCloser, 3), failed: make([]bool, 3)}
+	defer s.Close()
+	for i := range 2 {
+		s.readers[i], err = s.open(i)
+		assert.Nil(t, err)
+	}
+	enc, err := erasure.New(2, 1)
+	assert.Nil(t, err)
+	got := new(bytes.Buffer)
+	assert.Nil(t, s.join(enc, got))
+	assert.True(t, bytes.Equal(data, got.Bytes()))
+	assert.Equal(t, []bool{true, false, false}, s.failed)
+
+	r, err := fs.Get("ec_local")
+	assert.Nil(t, err)
+	all, err := io.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(data, all))
+}
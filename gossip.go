@@ -0,0 +1,185 @@
+package main
+
+import (
+	"Etherfile/dht"
+	"Etherfile/membership"
+	"Etherfile/p2p"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+/**
+成员管理: 支持gossip的节点通过SWIM协议探测彼此是否存活
+连接到一个新的成员时与它交换成员列表 得知的其他成员会被主动连接 所以只需要一个引导节点
+成员被确认失效时从peers 哈希环和DHT路由表中删除 成员重新加入时再次连接
+不支持gossip的节点(握手时没有声明CapGossip)不参与探测 也不会因此被删除
+*/
+
+// MessagePing 直接探测 Updates是附带传播的成员状态
+type MessagePing struct {
+	Updates []membership.Member
+}
+
+// MessagePingReq 请求代为探测Target
+type MessagePingReq struct {
+	Target  membership.Member
+	Updates []membership.Member
+}
+
+// MessageSync 交换完整的成员列表
+type MessageSync struct {
+	Members []membership.Member
+}
+
+// MessageGossipReply 成员管理请求的回复 Err不为空时表示代为探测失败
+type MessageGossipReply struct {
+	Updates []membership.Member
+	Err     string
+}
+
+// gossipNetwork 通过FileServer的连接发送成员管理请求
+type gossipNetwork struct {
+	fs *FileServer
+}
+
+func (n gossipNetwork) Ping(to membership.Member, updates []membership.Member) ([]membership.Member, error) {
+	return n.fs.callMember(to, MessagePing{Updates: updates}, n.fs.members.ProbeTimeout)
+}
+
+func (n gossipNetwork) PingReq(via, target membership.Member, updates []membership.Member) ([]membership.Member, error) {
+	// 对方还要等待target的回复
+	return n.fs.callMember(via, MessagePingReq{Target: target, Updates: updates}, 2*n.fs.members.ProbeTimeout)
+}
+
+func (n gossipNetwork) Sync(to membership.Member, state []membership.Member) ([]membership.Member, error) {
+	return n.fs.callMember(to, MessageSync{Members: state}, replyTimeout)
+}
+
+// callMember 向成员发送请求 没有连接时先建立连接
+func (fs *FileServer) callMember(to membership.Member, payload any, timeout time.Duration) ([]membership.Member, error) {
+	peer, err := fs.connect(dht.Contact{ID: to.ID, Addr: to.Addr})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fs.callTimeout(peer, payload, timeout)
+	if err != nil {
+		return nil, err
+	}
+	reply, ok := resp.(MessageGossipReply)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %T from %s", resp, to.ID)
+	}
+	if reply.Err != "" {
+		return nil, errors.New(reply.Err)
+	}
+	return withSenderAddr(peer, reply.Updates), nil
+}
+
+// withSenderAddr 发送方关于自己的状态中只有监听地址 替换为连接时看到的地址
+func withSenderAddr(peer p2p.Peer, updates []membership.Member) []membership.Member {
+	sender := memberOf(peer)
+	for i := range updates {
+		if updates[i].ID == sender.ID {
+			updates[i].Addr = sender.Addr
+		}
+	}
+	return updates
+}
+
+// memberOf 对方节点在成员列表中的信息
+func memberOf(peer p2p.Peer) membership.Member {
+	c := contactOf(peer)
+	return membership.Member{ID: c.ID, Addr: c.Addr}
+}
+
+// supportsGossip 握手时交换了节点标识并且声明支持gossip
+func supportsGossip(peer p2p.Peer) bool {
+	info := peer.Info()
+	return !info.NodeID.IsZero() && info.HasCapability(CapGossip)
+}
+
+// joinMember 与新连接的成员交换成员列表
+func (fs *FileServer) joinMember(peer p2p.Peer) {
+	if err := fs.members.Join(memberOf(peer)); err != nil {
+		log.Printf("[%s] Error syncing members with %s: %s\n", fs.ListenAddr, peerName(peer), err)
+	}
+}
+
+// onMemberJoin 保持与新加入的成员的连接
+func (fs *FileServer) onMemberJoin(m membership.Member) {
+	log.Printf("[%s] member %s at %s joined\n", fs.ListenAddr, m.ID, m.Addr)
+	fs.conns.Add(m.Addr, m.ID.String())
+}
+
+// onMemberLeave 删除失效的成员并断开连接
+func (fs *FileServer) onMemberLeave(m membership.Member) {
+	log.Printf("[%s] member %s at %s left\n", fs.ListenAddr, m.ID, m.Addr)
+	fs.conns.Remove(m.Addr)
+	fs.removePeer(m.ID.String())
+}
+
+// removePeer 从peers 哈希环和DHT路由表中删除节点 并关闭连接
+func (fs *FileServer) removePeer(name string) {
+	fs.Lock()
+	peer, ok := fs.peers[name]
+	delete(fs.peers, name)
+	fs.Unlock()
+	fs.ring.Remove(name)
+	if id, err := p2p.ParseNodeID(name); err == nil {
+		fs.dht.RemoveContact(id)
+	}
+	if ok {
+		_ = peer.Close()
+	}
+}
+
+func (fs *FileServer) handleMsgPing(from string, id uint64, msg MessagePing) error {
+	peer, err := fs.gossipSender(from)
+	if err != nil {
+		return err
+	}
+	updates := fs.members.HandlePing(withSenderAddr(peer, msg.Updates))
+	return fs.reply(from, id, MessageGossipReply{Updates: updates})
+}
+
+// handleMsgPingReq 在后台代为探测 等待回复时不阻塞消息的处理
+func (fs *FileServer) handleMsgPingReq(from string, id uint64, msg MessagePingReq) error {
+	peer, err := fs.gossipSender(from)
+	if err != nil {
+		return err
+	}
+	go func() {
+		var reply MessageGossipReply
+		updates, err := fs.members.HandlePingReq(msg.Target, withSenderAddr(peer, msg.Updates))
+		if err != nil {
+			reply.Err = err.Error()
+		}
+		reply.Updates = updates
+		if err := fs.reply(from, id, reply); err != nil {
+			log.Printf("[%s] Error replying ping request to %s: %s\n", fs.ListenAddr, from, err)
+		}
+	}()
+	return nil
+}
+
+func (fs *FileServer) handleMsgSync(from string, id uint64, msg MessageSync) error {
+	peer, err := fs.gossipSender(from)
+	if err != nil {
+		return err
+	}
+	members := fs.members.HandleSync(withSenderAddr(peer, msg.Members))
+	return fs.reply(from, id, MessageGossipReply{Updates: members})
+}
+
+func (fs *FileServer) gossipSender(from string) (p2p.Peer, error) {
+	peer, ok := fs.getPeer(from)
+	if !ok {
+		return nil, fmt.Errorf("peer %s not found", from)
+	}
+	if !supportsGossip(peer) {
+		return nil, fmt.Errorf("peer %s does not support gossip", from)
+	}
+	return peer, nil
+}
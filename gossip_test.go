@@ -0,0 +1,108 @@
+package main
+
+import (
+	"Etherfile/membership"
+	"Etherfile/p2p"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// muteTransport mute之后丢弃收到的消息和数据流 也不再拨号 但不断开已有的连接
+// 对方看到的是一个失去响应的节点
+type muteTransport struct {
+	p2p.Transport
+	muted     atomic.Bool
+	rc        chan p2p.Msg
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newMuteTransport(tr p2p.Transport) p2p.Transport {
+	t := &muteTransport{Transport: tr, rc: make(chan p2p.Msg), quit: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case msg := <-tr.Consume():
+				if t.muted.Load() {
+					if msg.Stream != nil {
+						_ = msg.Stream.Close()
+					}
+					continue
+				}
+				select {
+				case t.rc <- msg:
+				case <-t.quit:
+					return
+				}
+			case <-t.quit:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+func (t *muteTransport) Consume() <-chan p2p.Msg { return t.rc }
+
+func (t *muteTransport) Dial(addr string) (p2p.Peer, error) {
+	if t.muted.Load() {
+		return nil, errors.New("transport muted")
+	}
+	return t.Transport.Dial(addr)
+}
+
+func (t *muteTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.quit) })
+	return t.Transport.Close()
+}
+
+// freeze 停止成员探测并丢弃收到的消息 模拟节点失去响应
+func freeze(fs *FileServer) {
+	fs.members.Stop()
+	fs.Transport.(*muteTransport).muted.Store(true)
+}
+
+func TestFileServer_GossipMembership(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	opts := func(addr string) FileServerOpts {
+		return FileServerOpts{
+			ListenAddr:       addr,
+			ProbeInterval:    50 * time.Millisecond,
+			SuspicionTimeout: 300 * time.Millisecond,
+		}
+	}
+	a := newClusterNode(t, kr, opts("127.0.0.1:4410"))
+	time.Sleep(50 * time.Millisecond)
+	// 后加入的节点都只知道第一个节点
+	b := newClusterNode(t, kr, opts("127.0.0.1:4411"), "127.0.0.1:4410")
+	c := newWrappedNode(t, kr, opts("127.0.0.1:4412"), newMuteTransport, "127.0.0.1:4410")
+	nodes := []*FileServer{a, b, c}
+	for _, n := range nodes {
+		t.Cleanup(n.Stop)
+	}
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			return len(n.peerList()) == 2 && len(n.members.Members()) == 2
+		}, 3*time.Second, 20*time.Millisecond)
+	}
+	_, ok := b.getPeer(c.NodeID.String())
+	assert.True(t, ok)
+
+	// c停止响应后被其他节点确认失效并删除
+	freeze(c)
+	for _, n := range []*FileServer{a, b} {
+		assert.Eventually(t, func() bool {
+			m, _ := n.members.Member(c.NodeID)
+			_, connected := n.getPeer(c.NodeID.String())
+			return m.State == membership.StateDead && !connected
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Len(t, n.members.Members(), 1)
+		assert.Equal(t, 1, n.ring.Len()-1)
+	}
+}
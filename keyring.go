@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+/**
+密钥环: 保存多个密钥 每个密钥由其SHA-256指纹的前8字节作为密钥ID
+KeyringEncrypter 在密文前写入 [标记 1B][密钥ID 8B] 解密时按ID选择密钥
+密钥文件每行一个十六进制密钥('#'开头为注释) 按从旧到新排列
+最后一个为当前使用的密钥 第一个用于解密没有密钥ID的旧密文
+*/
+
+const (
+	KeyIDSize        = 8
+	keyringHeader    = 'K'
+	keyringHeaderLen = 1 + KeyIDSize
+	// scrypt的参数 派生一个密钥约需要32MB内存
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	ErrUnknownKey   = errors.New("keyring: unknown key id")
+	ErrEmptyKeyring = errors.New("keyring: no keys")
+)
+
+type KeyID [KeyIDSize]byte
+
+// KeyIDOf 计算密钥的ID
+func KeyIDOf(key []byte) KeyID {
+	var id KeyID
+	sum := sha256.Sum256(key)
+	copy(id[:], sum[:])
+	return id
+}
+
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Keyring 密钥环
+type Keyring struct {
+	sync.RWMutex
+	keys   map[KeyID][]byte
+	order  []KeyID
+	active KeyID
+}
+
+// NewKeyring 创建密钥环 最后一个密钥为当前使用的密钥
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[KeyID][]byte)}
+	for _, key := range keys {
+		if _, err := k.Rotate(key); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// LoadKeyringFile 从密钥文件加载密钥环
+func LoadKeyringFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("keyring: invalid key in %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrEmptyKeyring
+	}
+	return NewKeyring(keys...)
+}
+
+// LoadKeyringEnv 从环境变量加载密钥环 多个十六进制密钥用逗号分隔
+func LoadKeyringEnv(name string) (*Keyring, error) {
+	value := strings.TrimSpace(os.Getenv(name))
+	if len(value) == 0 {
+		return nil, ErrEmptyKeyring
+	}
+	var keys [][]byte
+	for _, s := range strings.Split(value, ",") {
+		key, err := hex.DecodeString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("keyring: invalid key in $%s: %w", name, err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
+
+// KeyringFromPassphrase 使用scrypt从口令派生密钥 所有节点需要使用相同的salt
+func KeyringFromPassphrase(passphrase string, salt []byte) (*Keyring, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, DefaultKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyring(key)
+}
+
+// Add 加入一个密钥 不改变当前使用的密钥
+func (k *Keyring) Add(key []byte) (KeyID, error) {
+	if len(key) != DefaultKeyLength {
+		return KeyID{}, fmt.Errorf("keyring: invalid key length %d", len(key))
+	}
+	id := KeyIDOf(key)
+	k.Lock()
+	defer k.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		k.keys[id] = key
+		k.order = append(k.order, id)
+	}
+	if len(k.order) == 1 {
+		k.active = id
+	}
+	return id, nil
+}
+
+// Rotate 加入一个密钥并将其设为当前使用的密钥
+func (k *Keyring) Rotate(key []byte) (KeyID, error) {
+	id, err := k.Add(key)
+	if err != nil {
+		return id, err
+	}
+	k.Lock()
+	k.active = id
+	k.Unlock()
+	return id, nil
+}
+
+// Active 返回当前使用的密钥
+func (k *Keyring) Active() (KeyID, []byte) {
+	k.RLock()
+	defer k.RUnlock()
+	return k.active, k.keys[k.active]
+}
+
+// Oldest 返回最早加入的密钥 用于解密没有密钥ID的旧密文
+func (k *Keyring) Oldest() []byte {
+	k.RLock()
+	defer k.RUnlock()
+	if len(k.order) == 0 {
+		return nil
+	}
+	return k.keys[k.order[0]]
+}
+
+// Lookup 根据ID查找密钥
+func (k *Keyring) Lookup(id KeyID) ([]byte, bool) {
+	k.RLock()
+	defer k.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// KeyringEncrypter 为另一个Encrypter的密文加上密钥ID 解密时从密钥环中选择对应的密钥
+type KeyringEncrypter struct {
+	Keyring   *Keyring
+	Encrypter Encrypter
+}
+
+func NewKeyringEncrypter(keyring *Keyring, encrypter Encrypter) *KeyringEncrypter {
+	return &KeyringEncrypter{
+		Keyring:   keyring,
+		Encrypter: encrypter,
+	}
+}
+
+// Key 返回当前使用的密钥
+func (e *KeyringEncrypter) Key() []byte {
+	_, key := e.Keyring.Active()
+	return key
+}
+
+func (e *KeyringEncrypter) KeyGeneration() []byte {
+	return e.Encrypter.KeyGeneration()
+}
+
+func (e *KeyringEncrypter) Encrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	id := KeyIDOf(key)
+	header := append([]byte{keyringHeader}, id[:]...)
+	if _, err := dst.Write(header); err != nil {
+		return 0, err
+	}
+	return e.Encrypter.Encrypt(key, src, dst)
+}
+
+// Decrypt 按密文头部的密钥ID选择密钥 传入的key与该ID一致时直接使用传入的key
+func (e *KeyringEncrypter) Decrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	id, tagged, src, err := readKeyID(src)
+	if err != nil {
+		return 0, err
+	}
+	if !tagged {
+		return e.Encrypter.Decrypt(e.Keyring.Oldest(), src, dst)
+	}
+	if KeyIDOf(key) != id {
+		var ok bool
+		if key, ok = e.Keyring.Lookup(id); !ok {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+		}
+	}
+	return e.Encrypter.Decrypt(key, src, dst)
+}
+
+// DecryptRange 按密文头部的密钥ID选择密钥 再交给内部的Encrypter解密一段明文
+func (e *KeyringEncrypter) DecryptRange(key []byte, src io.ReaderAt, offset, length int64, dst io.Writer) (int64, error) {
+	id, tagged, _, err := readKeyID(io.NewSectionReader(src, 0, keyringHeaderLen))
+	if err != nil {
+		return 0, err
+	}
+	if !tagged {
+		return DecryptRange(e.Encrypter, e.Keyring.Oldest(), src, offset, length, dst)
+	}
+	if KeyIDOf(key) != id {
+		var ok bool
+		if key, ok = e.Keyring.Lookup(id); !ok {
+			return 0, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+		}
+	}
+	body := io.NewSectionReader(src, keyringHeaderLen, maxStreamSize-keyringHeaderLen)
+	return DecryptRange(e.Encrypter, key, body, offset, length, dst)
+}
+
+// readKeyID 读取密文头部的密钥ID 没有密钥ID时返回的reader会把已读的字节放回去
+func readKeyID(src io.Reader) (KeyID, bool, io.Reader, error) {
+	var id KeyID
+	peek := make([]byte, 1)
+	if _, err := io.ReadFull(src, peek); err != nil {
+		return id, false, nil, err
+	}
+	if peek[0] != keyringHeader {
+		return id, false, io.MultiReader(bytes.NewReader(peek), src), nil
+	}
+	if _, err := io.ReadFull(src, id[:]); err != nil {
+		return id, false, nil, err
+	}
+	return id, true, src, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadKeyringFile(t *testing.T) {
+	e := NewDefaultEncrypter()
+	oldKey, newKey := e.KeyGeneration(), e.KeyGeneration()
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# etherfile keys\n" + hex.EncodeToString(oldKey) + "\n\n" + hex.EncodeToString(newKey) + "\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0600))
+
+	keyring, err := LoadKeyringFile(path)
+	assert.Nil(t, err)
+	id, key := keyring.Active()
+	assert.Equal(t, KeyIDOf(newKey), id)
+	assert.Equal(t, newKey, key)
+	assert.Equal(t, oldKey, keyring.Oldest())
+
+	t.Setenv("ETHERFILE_TEST_KEYS", hex.EncodeToString(oldKey)+","+hex.EncodeToString(newKey))
+	keyring, err = LoadKeyringEnv("ETHERFILE_TEST_KEYS")
+	assert.Nil(t, err)
+	_, key = keyring.Active()
+	assert.Equal(t, newKey, key)
+}
+
+func TestKeyringFromPassphrase(t *testing.T) {
+	k1, err := KeyringFromPassphrase("correct horse battery staple", []byte("salt"))
+	assert.Nil(t, err)
+	k2, err := KeyringFromPassphrase("correct horse battery staple", []byte("salt"))
+	assert.Nil(t, err)
+	id1, _ := k1.Active()
+	id2, _ := k2.Active()
+	assert.Equal(t, id1, id2)
+}
+
+func TestKeyringEncrypter_Rotate(t *testing.T) {
+	keyring, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	e := NewKeyringEncrypter(keyring, NewGCMEncrypter())
+
+	data := []byte("encrypted before rotation")
+	ciphertext := new(bytes.Buffer)
+	_, err = e.Encrypt(e.Key(), bytes.NewReader(data), ciphertext)
+	assert.Nil(t, err)
+
+	_, err = keyring.Rotate(e.KeyGeneration())
+	assert.Nil(t, err)
+	res := new(bytes.Buffer)
+	_, err = e.Decrypt(e.Key(), bytes.NewReader(ciphertext.Bytes()), res)
+	assert.Nil(t, err)
+	assert.Equal(t, data, res.Bytes())
+
+	other := NewKeyringEncrypter(&Keyring{keys: map[KeyID][]byte{}}, NewGCMEncrypter())
+	_, err = other.Decrypt(other.KeyGeneration(), bytes.NewReader(ciphertext.Bytes()), io.Discard)
+	assert.True(t, errors.Is(err, ErrUnknownKey))
+}
+
+func TestStore_ReEncrypt(t *testing.T) {
+	oldKey := NewDefaultEncrypter().Key()
+	keyring, err := NewKeyring(oldKey)
+	assert.Nil(t, err)
+	e := NewKeyringEncrypter(keyring, NewDefaultEncrypter())
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+
+	// 两个没有元数据的旧文件: 一个没有密钥ID 一个带密钥ID
+	legacy := new(bytes.Buffer)
+	_, err = e.Encrypter.Encrypt(oldKey, bytes.NewReader([]byte("legacy")), legacy)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Write("legacy", legacy))
+	tagged := new(bytes.Buffer)
+	_, err = e.Encrypt(oldKey, bytes.NewReader([]byte("tagged")), tagged)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Write("tagged", tagged))
+	// 用未知密钥加密的文件无法重新加密 不影响其他文件
+	strangerKeyring, err := NewKeyring(NewDefaultEncrypter().Key())
+	assert.Nil(t, err)
+	stranger := NewKeyringEncrypter(strangerKeyring, NewDefaultEncrypter())
+	broken := new(bytes.Buffer)
+	_, err = stranger.Encrypt(stranger.Key(), bytes.NewReader([]byte("broken")), broken)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Write("broken", broken))
+
+	newID, err := keyring.Rotate(e.KeyGeneration())
+	assert.Nil(t, err)
+	n, err := s.ReEncrypt(e)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, n)
+
+	// 旧密钥移除后仍然可以读取
+	keyring.keys = map[KeyID][]byte{newID: keyring.keys[newID]}
+	for _, key := range []string{"legacy", "tagged"} {
+		res := new(bytes.Buffer)
+		assert.Nil(t, s.ReadDecrypt(key, e, res))
+		assert.Equal(t, key, res.String())
+	}
+
+	assert.Nil(t, s.Delete("broken"))
+	n, err = s.ReEncrypt(e)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// 等待锁期间被删除的文件不会被重新写回
+	_, err = keyring.Rotate(e.KeyGeneration())
+	assert.Nil(t, err)
+	unlock := s.locks.Lock("legacy")
+	done := make(chan int)
+	go func() {
+		n, err := s.ReEncrypt(e)
+		assert.Nil(t, err)
+		done <- n
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, s.Delete("legacy"))
+	assert.Nil(t, s.WriteTombstone("legacy", time.Now()))
+	unlock()
+	assert.Equal(t, 1, <-done)
+	assert.False(t, s.Exists("legacy"))
+}
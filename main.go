@@ -2,40 +2,148 @@ package main
 
 import (
 	"Etherfile/p2p"
+	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func makeServer(addr string, nodes ...string) *FileServer {
+const (
+	// 没有配置密钥时使用的演示密钥
+	demoKey     = "984eb1fdd6e12dfcf5bf0a8c71c3cb65d7d4506b392bf2f56051cc025ad37a6d"
+	defaultSalt = "etherfile"
+	// 本地CA和节点证书的有效期
+	certValidity = 365 * 24 * time.Hour
+)
+
+// loadKeyring 依次尝试从密钥文件、环境变量、口令加载密钥环 都没有配置时使用演示密钥
+func loadKeyring() (*Keyring, error) {
+	if path := os.Getenv("ETHERFILE_KEYFILE"); len(path) > 0 {
+		return LoadKeyringFile(path)
+	}
+	if len(os.Getenv("ETHERFILE_KEYS")) > 0 {
+		return LoadKeyringEnv("ETHERFILE_KEYS")
+	}
+	if passphrase := os.Getenv("ETHERFILE_PASSPHRASE"); len(passphrase) > 0 {
+		salt := os.Getenv("ETHERFILE_SALT")
+		if len(salt) == 0 {
+			salt = defaultSalt
+		}
+		return KeyringFromPassphrase(passphrase, []byte(salt))
+	}
+	key, _ := hex.DecodeString(demoKey)
+	return NewKeyring(key)
+}
+
+// loadTLS 使用dir中的本地CA 没有时创建CA 并为监听addr的节点签发证书
+// 节点标识由证书公钥得到
+func loadTLS(dir, addr string) (*tls.Config, p2p.NodeID, error) {
+	var (
+		caCert  = filepath.Join(dir, "ca.pem")
+		caKey   = filepath.Join(dir, "ca-key.pem")
+		name    = "node" + strings.ReplaceAll(addr, ":", "_")
+		crtFile = filepath.Join(dir, name+".pem")
+		keyFile = filepath.Join(dir, name+"-key.pem")
+	)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, p2p.NodeID{}, err
+	}
+	ca, err := p2p.LoadCA(caCert, caKey)
+	if errors.Is(err, os.ErrNotExist) {
+		if ca, err = p2p.NewCA("etherfile local ca", certValidity); err == nil {
+			err = ca.Save(caCert, caKey)
+		}
+	}
+	if err != nil {
+		return nil, p2p.NodeID{}, err
+	}
+	cert, err := p2p.LoadCertificate(crtFile, keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		host, _, _ := net.SplitHostPort(addr)
+		if cert, err = ca.IssueNodeCert([]string{host, "127.0.0.1", "localhost"}, certValidity); err == nil {
+			err = p2p.SaveCertificate(cert, crtFile, keyFile)
+		}
+	}
+	if err != nil {
+		return nil, p2p.NodeID{}, err
+	}
+	return p2p.MutualTLSConfig(cert, ca.Pool()), p2p.NodeIDFromCertificate(cert.Leaf), nil
+}
+
+func makeServer(keyring *Keyring, addr string, nodes ...string) *FileServer {
+	encrypter := NewKeyringEncrypter(keyring, NewGCMEncrypter())
+	storageRoot := addr + "_path"
+	var (
+		nodeID    p2p.NodeID
+		tlsConfig *tls.Config
+		identity  *p2p.Identity
+		err       error
+	)
+	if dir := os.Getenv("ETHERFILE_TLS_DIR"); len(dir) > 0 {
+		tlsConfig, nodeID, err = loadTLS(dir, addr)
+	} else if os.Getenv("ETHERFILE_NOISE") == "1" {
+		// Noise握手使用持久化的静态身份密钥 节点标识由身份公钥得到
+		if identity, err = LoadOrCreateIdentity(storageRoot, addr+"_identity.json"); err == nil {
+			nodeID = identity.NodeID()
+		}
+	} else {
+		nodeID, err = LoadOrCreateNodeID(storageRoot)
+	}
+	if err != nil {
+		log.Fatalf("Error loading node identity: %v", err)
+	}
+	handshake := p2p.NewHandshakeFunc(NewHandshakeOpts(nodeID, addr, encrypter))
+	if identity != nil {
+		handshake = p2p.ChainHandshakes(p2p.NewNoiseHandshakeFunc(identity), handshake)
+	}
 	trOpts := p2p.TCPTransportOpts{
 		ListenAddr:    addr,
-		HandshakeFunc: p2p.DefaultHandShakeFunc,
+		HandshakeFunc: handshake,
 		Decoder:       p2p.DefaultDecoder{},
+		Encoder:       p2p.DefaultEncoder{},
+		TLSConfig:     tlsConfig,
 		// ToDo OnPeer func
 	}
-	key, _ := hex.DecodeString("984eb1fdd6e12dfcf5bf0a8c71c3cb65d7d4506b392bf2f56051cc025ad37a6d")
 	transport := p2p.NewTCPTransport(trOpts)
+	// 每个文件的副本数 未设置时使用默认值
+	replicas, _ := strconv.Atoi(os.Getenv("ETHERFILE_REPLICAS"))
+	// 设置了数据分片数时使用纠删码存储
+	dataShards, _ := strconv.Atoi(os.Getenv("ETHERFILE_DATA_SHARDS"))
+	parityShards, _ := strconv.Atoi(os.Getenv("ETHERFILE_PARITY_SHARDS"))
 	fileServerOpts := FileServerOpts{
-		Encrypter:         NewDefaultEncrypter(key),
+		NodeID:            nodeID,
+		Encrypter:         encrypter,
 		ListenAddr:        addr,
-		StorageRoot:       addr + "_path",
+		StorageRoot:       storageRoot,
 		PathTransformFunc: SHA1PathTransformFunc,
 		Transport:         transport,
 		BootstrapNodes:    nodes,
+		ReplicationFactor: replicas,
+		Erasure:           ErasureOpts{DataShards: dataShards, ParityShards: parityShards},
 	}
 	fs := NewFileServer(fileServerOpts)
 	transport.OnPeer = fs.OnPeer
+	transport.OnPeerClosed = fs.OnPeerClosed
 	return fs
 
 }
 
 func main() {
-	fs1 := makeServer(":3000")
-	fs2 := makeServer(":3001", ":3000")
-	fs3 := makeServer(":3002", ":3000", ":3001")
+	keyring, err := loadKeyring()
+	if err != nil {
+		log.Fatalf("Error loading keyring: %v", err)
+	}
+	fs1 := makeServer(keyring, ":3000")
+	fs2 := makeServer(keyring, ":3001", ":3000")
+	fs3 := makeServer(keyring, ":3002", ":3000")
 	//go func() {
 	//	time.Sleep(3 * time.Second)
 	//	fs.quit <- struct{}{}
@@ -70,6 +178,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("Error getting file: %v", err)
 	}
+	defer f.Close()
 	fileData, err := ioutil.ReadAll(f)
 	if err != nil {
 		log.Fatalf("Error reading file: %v\n", err)
@@ -0,0 +1,49 @@
+package membership
+
+import (
+	"math/bits"
+	"slices"
+)
+
+// broadcast 等待传播的成员状态 transmits是已经附带发送的次数
+type broadcast struct {
+	member    Member
+	transmits int
+}
+
+// broadcastQueue 成员状态的变化附带在探测消息中传播 每个变化传播有限次后丢弃
+// 同一个成员只保留最新的状态
+type broadcastQueue struct {
+	items []*broadcast
+}
+
+func (q *broadcastQueue) enqueue(m Member) {
+	q.items = slices.DeleteFunc(q.items, func(b *broadcast) bool {
+		return b.member.ID == m.ID
+	})
+	q.items = append(q.items, &broadcast{member: m})
+}
+
+// retransmitLimit 每个变化传播的次数 随集群规模对数增长
+func retransmitLimit(mult, members int) int {
+	return mult * bits.Len(uint(members+1))
+}
+
+// take 取出最多max个传播次数最少的状态 传播次数达到limit的状态从队列中删除
+func (q *broadcastQueue) take(max, limit int) []Member {
+	slices.SortStableFunc(q.items, func(a, b *broadcast) int {
+		return a.transmits - b.transmits
+	})
+	var out []Member
+	for _, b := range q.items {
+		if len(out) == max {
+			break
+		}
+		out = append(out, b.member)
+		b.transmits++
+	}
+	q.items = slices.DeleteFunc(q.items, func(b *broadcast) bool {
+		return b.transmits >= limit
+	})
+	return out
+}
@@ -0,0 +1,414 @@
+package membership
+
+import (
+	"Etherfile/p2p"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+/**
+SWIM风格的成员管理: 每个周期随机探测一个成员 直接探测没有回应时请其他几个成员代为探测
+仍然没有回应就把它标记为疑似失效 超过SuspicionTimeout没有被推翻则确认失效
+成员状态的变化附带在探测消息和回复中传播(gossip) 而不是单独广播
+被怀疑的成员收到关于自己的怀疑后增加incarnation宣布自己存活 推翻怀疑
+新节点与任意一个成员交换完整的成员列表(Join)即可得知整个集群
+确认失效的成员保留DeadRetention 让失效的消息传播出去并挡住旧的存活消息 之后从列表中删除
+Memberlist不关心节点之间如何通信 由上层通过Network发送请求 收到请求时调用Handle*方法
+*/
+
+const (
+	DefaultProbeInterval    = time.Second
+	DefaultProbeTimeout     = 500 * time.Millisecond
+	DefaultSuspicionTimeout = 5 * time.Second
+	DefaultDeadRetention    = time.Minute
+	DefaultIndirectProbes   = 3
+	DefaultMaxPiggyback     = 8
+	// 每个状态变化传播的次数是这个值乘以集群规模的对数
+	retransmitMult = 3
+)
+
+var ErrNoAck = errors.New("membership: no ack from member")
+
+type State uint8
+
+const (
+	StateAlive State = iota
+	StateSuspect
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member 集群中的一个成员 Incarnation只由成员自己增加 用于推翻关于它的旧状态
+type Member struct {
+	ID          p2p.NodeID
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+// Network 向其他成员发送请求 请求和回复都附带需要传播的状态
+type Network interface {
+	// Ping 直接探测to 返回to附带的状态
+	Ping(to Member, updates []Member) ([]Member, error)
+	// PingReq 请via代为探测target
+	PingReq(via, target Member, updates []Member) ([]Member, error)
+	// Sync 与to交换完整的成员列表
+	Sync(to Member, state []Member) ([]Member, error)
+}
+
+type Opts struct {
+	Self    Member
+	Network Network
+	// 探测周期 每个周期探测一个成员
+	ProbeInterval time.Duration
+	// 等待探测回复的时间 由Network使用
+	ProbeTimeout     time.Duration
+	SuspicionTimeout time.Duration
+	// 确认失效的成员保留的时间
+	DeadRetention time.Duration
+	// 直接探测失败后代为探测的成员数
+	IndirectProbes int
+	// 每个消息最多附带的状态数
+	MaxPiggyback int
+	// OnJoin 成员加入或者失效后重新加入
+	OnJoin func(Member)
+	// OnLeave 成员被确认失效
+	OnLeave func(Member)
+}
+
+type memberState struct {
+	Member
+	suspectedAt time.Time
+	deadAt      time.Time
+}
+
+type Memberlist struct {
+	Opts
+
+	mu         sync.Mutex
+	members    map[p2p.NodeID]*memberState
+	queue      broadcastQueue
+	probeOrder []p2p.NodeID
+
+	quit     chan struct{}
+	stopOnce sync.Once
+}
+
+func New(opts Opts) *Memberlist {
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = DefaultProbeInterval
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = DefaultProbeTimeout
+	}
+	if opts.SuspicionTimeout <= 0 {
+		opts.SuspicionTimeout = DefaultSuspicionTimeout
+	}
+	if opts.DeadRetention <= 0 {
+		opts.DeadRetention = DefaultDeadRetention
+	}
+	if opts.IndirectProbes <= 0 {
+		opts.IndirectProbes = DefaultIndirectProbes
+	}
+	if opts.MaxPiggyback <= 0 {
+		opts.MaxPiggyback = DefaultMaxPiggyback
+	}
+	opts.Self.State = StateAlive
+	return &Memberlist{
+		Opts:    opts,
+		members: make(map[p2p.NodeID]*memberState),
+		quit:    make(chan struct{}),
+	}
+}
+
+// LocalMember 本节点当前的状态
+func (l *Memberlist) LocalMember() Member {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Self
+}
+
+// Members 没有被确认失效的其他成员
+func (l *Memberlist) Members() []Member {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []Member
+	for _, m := range l.members {
+		if m.State != StateDead {
+			out = append(out, m.Member)
+		}
+	}
+	return out
+}
+
+// Member 返回id对应的成员
+func (l *Memberlist) Member(id p2p.NodeID) (Member, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	m, ok := l.members[id]
+	if !ok {
+		return Member{}, false
+	}
+	return m.Member, true
+}
+
+// Join 与seed交换完整的成员列表
+func (l *Memberlist) Join(seed Member) error {
+	state, err := l.Network.Sync(seed, l.snapshot())
+	if err != nil {
+		return err
+	}
+	l.Merge(state)
+	return nil
+}
+
+// Start 在后台周期性地探测成员
+func (l *Memberlist) Start() {
+	go func() {
+		ticker := time.NewTicker(l.ProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.Probe()
+			case <-l.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (l *Memberlist) Stop() {
+	l.stopOnce.Do(func() {
+		close(l.quit)
+	})
+}
+
+// HandlePing 处理直接探测 返回附带的状态
+func (l *Memberlist) HandlePing(updates []Member) []Member {
+	l.Merge(updates)
+	return l.piggyback()
+}
+
+// HandlePingReq 代为探测target target有回复时才返回成功
+func (l *Memberlist) HandlePingReq(target Member, updates []Member) ([]Member, error) {
+	l.Merge(updates)
+	ack, err := l.Network.Ping(target, l.piggyback())
+	if err != nil {
+		return nil, err
+	}
+	l.Merge(ack)
+	return l.piggyback(), nil
+}
+
+// HandleSync 合并对方的成员列表 返回本节点的完整成员列表
+func (l *Memberlist) HandleSync(state []Member) []Member {
+	l.Merge(state)
+	return l.snapshot()
+}
+
+// snapshot 包括本节点在内的所有成员的状态
+func (l *Memberlist) snapshot() []Member {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []Member{l.Self}
+	for _, m := range l.members {
+		out = append(out, m.Member)
+	}
+	return out
+}
+
+func (l *Memberlist) piggyback() []Member {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queue.take(l.MaxPiggyback, retransmitLimit(retransmitMult, len(l.members)+1))
+}
+
+// Probe 执行一轮探测 确认超时的疑似失效成员 并删除保留时间已过的失效成员
+func (l *Memberlist) Probe() {
+	now := time.Now()
+	l.reapSuspects(now)
+	l.reapDead(now)
+	target, ok := l.nextTarget()
+	if !ok {
+		return
+	}
+	if ack, err := l.Network.Ping(target, l.piggyback()); err == nil {
+		l.Merge(ack)
+		return
+	}
+	if l.probeIndirect(target) {
+		return
+	}
+	// 当前的incarnation 成员自己宣布存活时会使用更大的incarnation推翻怀疑
+	target.State = StateSuspect
+	l.Merge([]Member{target})
+}
+
+// nextTarget 按随机顺序轮流探测所有成员 每一轮开始时重新打乱顺序
+func (l *Memberlist) nextTarget() (Member, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		if len(l.probeOrder) == 0 {
+			for id, m := range l.members {
+				if m.State != StateDead {
+					l.probeOrder = append(l.probeOrder, id)
+				}
+			}
+			if len(l.probeOrder) == 0 {
+				return Member{}, false
+			}
+			rand.Shuffle(len(l.probeOrder), func(i, j int) {
+				l.probeOrder[i], l.probeOrder[j] = l.probeOrder[j], l.probeOrder[i]
+			})
+		}
+		id := l.probeOrder[0]
+		l.probeOrder = l.probeOrder[1:]
+		if m, ok := l.members[id]; ok && m.State != StateDead {
+			return m.Member, true
+		}
+	}
+}
+
+// probeIndirect 请最多IndirectProbes个其他成员代为探测target 任意一个成功即可
+func (l *Memberlist) probeIndirect(target Member) bool {
+	var helpers []Member
+	for _, m := range l.Members() {
+		if m.ID != target.ID && m.State == StateAlive {
+			helpers = append(helpers, m)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	if len(helpers) > l.IndirectProbes {
+		helpers = helpers[:l.IndirectProbes]
+	}
+	acks := make(chan []Member, len(helpers))
+	var wg sync.WaitGroup
+	for _, via := range helpers {
+		wg.Add(1)
+		go func(via Member) {
+			defer wg.Done()
+			if ack, err := l.Network.PingReq(via, target, l.piggyback()); err == nil {
+				acks <- ack
+			}
+		}(via)
+	}
+	wg.Wait()
+	close(acks)
+	ok := false
+	for ack := range acks {
+		l.Merge(ack)
+		ok = true
+	}
+	return ok
+}
+
+// reapSuspects 怀疑超过SuspicionTimeout仍未被推翻的成员确认失效
+func (l *Memberlist) reapSuspects(now time.Time) {
+	var dead []Member
+	l.mu.Lock()
+	for _, m := range l.members {
+		if m.State == StateSuspect && now.Sub(m.suspectedAt) >= l.SuspicionTimeout {
+			d := m.Member
+			d.State = StateDead
+			dead = append(dead, d)
+		}
+	}
+	l.mu.Unlock()
+	l.Merge(dead)
+}
+
+// reapDead 删除失效超过DeadRetention的成员
+func (l *Memberlist) reapDead(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, m := range l.members {
+		if m.State == StateDead && now.Sub(m.deadAt) >= l.DeadRetention {
+			delete(l.members, id)
+		}
+	}
+}
+
+// Merge 合并收到的成员状态 状态发生变化时继续传播 并触发加入和离开事件
+func (l *Memberlist) Merge(updates []Member) {
+	var joined, left []Member
+	l.mu.Lock()
+	for _, u := range updates {
+		if u.ID == l.Self.ID {
+			l.refute(u)
+			continue
+		}
+		cur, ok := l.members[u.ID]
+		if ok && !supersedes(u, cur.Member) {
+			continue
+		}
+		wasLive := ok && cur.State != StateDead
+		if !ok {
+			cur = &memberState{}
+			l.members[u.ID] = cur
+		}
+		if u.State == StateSuspect && cur.State != StateSuspect {
+			cur.suspectedAt = time.Now()
+		}
+		if u.State == StateDead && (!ok || cur.State != StateDead) {
+			cur.deadAt = time.Now()
+		}
+		if u.Addr == "" {
+			u.Addr = cur.Addr
+		}
+		cur.Member = u
+		l.queue.enqueue(u)
+		switch {
+		case !wasLive && u.State != StateDead:
+			joined = append(joined, u)
+		case wasLive && u.State == StateDead:
+			left = append(left, u)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, m := range joined {
+		if l.OnJoin != nil {
+			l.OnJoin(m)
+		}
+	}
+	for _, m := range left {
+		if l.OnLeave != nil {
+			l.OnLeave(m)
+		}
+	}
+}
+
+// refute 其他成员认为本节点疑似失效或已失效时 增加incarnation宣布自己存活
+func (l *Memberlist) refute(u Member) {
+	if u.State == StateAlive || u.Incarnation < l.Self.Incarnation {
+		return
+	}
+	l.Self.Incarnation = u.Incarnation + 1
+	l.queue.enqueue(l.Self)
+}
+
+// supersedes 状态u是否比cur更新 incarnation更大的状态总是更新
+// incarnation相同时 失效优先于疑似 疑似优先于存活
+func supersedes(u, cur Member) bool {
+	if u.Incarnation != cur.Incarnation {
+		return u.Incarnation > cur.Incarnation
+	}
+	return u.State > cur.State
+}
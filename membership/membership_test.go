@@ -0,0 +1,185 @@
+package membership
+
+import (
+	"Etherfile/p2p"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memNetwork 直接调用其他成员的Handle方法 down中的成员不响应
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[p2p.NodeID]*Memberlist
+	down  map[p2p.NodeID]bool
+}
+
+type memClient struct {
+	net *memNetwork
+}
+
+var errDown = errors.New("member down")
+
+func (n *memNetwork) node(id p2p.NodeID) (*Memberlist, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.down[id] {
+		return nil, errDown
+	}
+	return n.nodes[id], nil
+}
+
+func (c memClient) Ping(to Member, updates []Member) ([]Member, error) {
+	l, err := c.net.node(to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return l.HandlePing(updates), nil
+}
+
+func (c memClient) PingReq(via, target Member, updates []Member) ([]Member, error) {
+	l, err := c.net.node(via.ID)
+	if err != nil {
+		return nil, err
+	}
+	return l.HandlePingReq(target, updates)
+}
+
+func (c memClient) Sync(to Member, state []Member) ([]Member, error) {
+	l, err := c.net.node(to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return l.HandleSync(state), nil
+}
+
+type events struct {
+	mu     sync.Mutex
+	joined map[p2p.NodeID]int
+	left   map[p2p.NodeID]int
+}
+
+func newCluster(t *testing.T, n int, ev *events) (*memNetwork, []*Memberlist) {
+	net := &memNetwork{nodes: map[p2p.NodeID]*Memberlist{}, down: map[p2p.NodeID]bool{}}
+	lists := make([]*Memberlist, n)
+	for i := range lists {
+		lists[i] = New(Opts{
+			Self:             Member{ID: p2p.NewNodeID(), Addr: "node"},
+			Network:          memClient{net: net},
+			SuspicionTimeout: 20 * time.Millisecond,
+			OnJoin: func(m Member) {
+				ev.mu.Lock()
+				ev.joined[m.ID]++
+				ev.mu.Unlock()
+			},
+			OnLeave: func(m Member) {
+				ev.mu.Lock()
+				ev.left[m.ID]++
+				ev.mu.Unlock()
+			},
+		})
+		net.nodes[lists[i].Self.ID] = lists[i]
+	}
+	// 每个节点只知道第一个节点
+	for _, l := range lists[1:] {
+		assert.Nil(t, l.Join(lists[0].LocalMember()))
+	}
+	return net, lists
+}
+
+func rounds(n int, lists ...*Memberlist) {
+	for i := 0; i < n; i++ {
+		for _, l := range lists {
+			l.Probe()
+		}
+	}
+}
+
+func TestMemberlist_JoinDiscoversCluster(t *testing.T) {
+	ev := &events{joined: map[p2p.NodeID]int{}, left: map[p2p.NodeID]int{}}
+	_, lists := newCluster(t, 8, ev)
+	rounds(10, lists...)
+	for _, l := range lists {
+		assert.Len(t, l.Members(), len(lists)-1)
+	}
+	// 每个节点被其他所有节点各记录一次加入
+	for _, l := range lists {
+		assert.Equal(t, len(lists)-1, ev.joined[l.Self.ID])
+	}
+}
+
+func TestMemberlist_DetectsFailure(t *testing.T) {
+	ev := &events{joined: map[p2p.NodeID]int{}, left: map[p2p.NodeID]int{}}
+	net, lists := newCluster(t, 6, ev)
+	rounds(10, lists...)
+
+	dead := lists[5]
+	net.mu.Lock()
+	net.down[dead.Self.ID] = true
+	net.mu.Unlock()
+	alive := lists[:5]
+	for i := 0; i < 20 && ev.left[dead.Self.ID] < len(alive); i++ {
+		rounds(1, alive...)
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, l := range alive {
+		m, ok := l.Member(dead.Self.ID)
+		assert.True(t, ok)
+		assert.Equal(t, StateDead, m.State)
+		assert.Len(t, l.Members(), len(alive)-1)
+	}
+	assert.Equal(t, len(alive), ev.left[dead.Self.ID])
+}
+
+func TestMemberlist_ForgetsDeadMembers(t *testing.T) {
+	l := New(Opts{Self: Member{ID: p2p.NewNodeID()}, DeadRetention: 20 * time.Millisecond})
+	dead := Member{ID: p2p.NewNodeID(), Addr: "node", State: StateDead}
+	alive := Member{ID: p2p.NewNodeID(), Addr: "node"}
+	l.Merge([]Member{dead, alive})
+
+	// 保留期间仍然记得失效的成员 旧的存活消息不会让它重新加入
+	l.reapDead(time.Now())
+	l.Merge([]Member{{ID: dead.ID, Addr: "node", State: StateAlive}})
+	m, ok := l.Member(dead.ID)
+	assert.True(t, ok)
+	assert.Equal(t, StateDead, m.State)
+
+	// 保留时间过后删除 存活的成员不受影响
+	l.reapDead(time.Now().Add(time.Second))
+	_, ok = l.Member(dead.ID)
+	assert.False(t, ok)
+	_, ok = l.Member(alive.ID)
+	assert.True(t, ok)
+	assert.Len(t, l.snapshot(), 2)
+}
+
+func TestMemberlist_RefuteSuspicion(t *testing.T) {
+	ev := &events{joined: map[p2p.NodeID]int{}, left: map[p2p.NodeID]int{}}
+	_, lists := newCluster(t, 3, ev)
+	rounds(5, lists...)
+
+	// 错误的怀疑传到被怀疑的节点后 它以更大的incarnation宣布存活
+	a, b := lists[0], lists[1]
+	b.Merge([]Member{{ID: a.Self.ID, State: StateSuspect}})
+	m, _ := b.Member(a.Self.ID)
+	assert.Equal(t, StateSuspect, m.State)
+	rounds(5, lists...)
+	assert.Equal(t, uint64(1), a.LocalMember().Incarnation)
+	for _, l := range lists[1:] {
+		m, _ := l.Member(a.Self.ID)
+		assert.Equal(t, StateAlive, m.State)
+		assert.Equal(t, uint64(1), m.Incarnation)
+	}
+	assert.Zero(t, ev.left[a.Self.ID])
+}
+
+func TestSupersedes(t *testing.T) {
+	alive := Member{State: StateAlive, Incarnation: 2}
+	assert.True(t, supersedes(Member{State: StateSuspect, Incarnation: 2}, alive))
+	assert.False(t, supersedes(Member{State: StateSuspect, Incarnation: 1}, alive))
+	assert.True(t, supersedes(Member{State: StateAlive, Incarnation: 3}, Member{State: StateDead, Incarnation: 2}))
+	assert.False(t, supersedes(Member{State: StateAlive, Incarnation: 2}, Member{State: StateSuspect, Incarnation: 2}))
+}
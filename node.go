@@ -0,0 +1,89 @@
+package main
+
+import (
+	"Etherfile/p2p"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+节点标识: 第一次启动时随机生成并保存在存储根目录下 之后重启保持不变
+使用TLS或Noise时节点标识由证书或身份公钥得到 不使用这里保存的标识
+节点之间以节点标识而不是连接地址区分 入站连接的地址是临时端口 重连之后会变化
+Noise身份以前保存在存储根目录之外 启动时迁移到存储根目录下 保持节点标识不变
+*/
+
+// 存储根目录下以.开头的文件不是存储的数据
+const (
+	nodeIDFileName   = ".node_id"
+	identityFileName = ".identity"
+)
+
+// LoadOrCreateNodeID 读取root下保存的节点标识 没有时生成并保存
+func LoadOrCreateNodeID(root string) (p2p.NodeID, error) {
+	path := filepath.Join(root, nodeIDFileName)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return p2p.ParseNodeID(strings.TrimSpace(string(data)))
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return p2p.NodeID{}, err
+	}
+	id := p2p.NewNodeID()
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return p2p.NodeID{}, err
+	}
+	if err := writeFileAtomic(path, []byte(id.String()+"\n")); err != nil {
+		return p2p.NodeID{}, fmt.Errorf("save node id: %w", err)
+	}
+	return id, nil
+}
+
+// peerKey 节点在peers中的key 握手没有交换节点标识时退回到连接地址
+func peerKey(id p2p.NodeID, addr net.Addr) string {
+	if id.IsZero() {
+		return addr.String()
+	}
+	return id.String()
+}
+
+func peerName(p p2p.Peer) string {
+	return peerKey(p.Info().NodeID, p.RemoteAddr())
+}
+
+// LoadOrCreateIdentity 读取root下保存的Noise身份 没有时先从legacyPath迁移 都没有时生成并保存
+func LoadOrCreateIdentity(root, legacyPath string) (*p2p.Identity, error) {
+	path := filepath.Join(root, identityFileName)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && len(legacyPath) > 0 {
+		if err := migrateFile(legacyPath, path); err != nil {
+			return nil, fmt.Errorf("migrate identity: %w", err)
+		}
+	}
+	return p2p.LoadOrCreateIdentity(path)
+}
+
+// migrateFile 将from移动到to from不存在时不做任何事
+func migrateFile(from, to string) error {
+	if _, err := os.Stat(from); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	// 不在同一个文件系统时复制后删除
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(to, data); err != nil {
+		return err
+	}
+	return os.Remove(from)
+}
@@ -1,31 +1,74 @@
 package p2p
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 )
 
+var (
+	ErrFrameTooLarge = errors.New("frame payload too large")
+	ErrBadChecksum   = errors.New("frame checksum mismatch")
+)
+
 type Decoder interface {
 	Decode(io.Reader, *Msg) error
 }
 
-type DefaultDecoder struct{}
+// DefaultDecoder 解码一个完整的帧 不会读取帧之后的数据
+type DefaultDecoder struct {
+	// MaxPayloadSize 允许的最大负载长度 为0时使用DefaultMaxPayloadSize
+	MaxPayloadSize int
+}
 
 func (d DefaultDecoder) Decode(r io.Reader, msg *Msg) error {
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
+	br := byteReader{r}
+	typ, err := br.ReadByte()
+	if err != nil {
 		return err
 	}
-	//In case of a stream we are not decoding what is being sent over the network
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		msg.Stream = true
-		return nil
+	if typ&^flagChecksum != IncomingMessage {
+		return fmt.Errorf("unknown frame type 0x%x", typ)
 	}
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
+	size, err := binary.ReadUvarint(br)
 	if err != nil {
 		return err
 	}
-	msg.Payload = buf[:n]
+	maxSize := d.MaxPayloadSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxPayloadSize
+	}
+	if size > uint64(maxSize) {
+		return ErrFrameTooLarge
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	if typ&flagChecksum != 0 {
+		var sum uint32
+		if err := binary.Read(r, binary.BigEndian, &sum); err != nil {
+			return err
+		}
+		if sum != crc32.ChecksumIEEE(payload) {
+			return ErrBadChecksum
+		}
+	}
+	msg.Payload = payload
 	return nil
 }
+
+// byteReader 每次只从连接中读取一个字节 避免缓冲读走下一帧或数据流的数据
+type byteReader struct {
+	r io.Reader
+}
+
+func (b byteReader) ReadByte() (byte, error) {
+	var buf [1]byte
+	if _, err := io.ReadFull(b.r, buf[:]); err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDecoder_Framing(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		enc   = DefaultEncoder{}
+		dec   = DefaultDecoder{}
+		large = bytes.Repeat([]byte("etherfile"), 1024)
+	)
+	// 大于旧缓冲区的消息 和连续写入的多个消息 之后紧跟其他数据
+	assert.Nil(t, enc.Encode(&buf, &Msg{Payload: large}))
+	assert.Nil(t, enc.Encode(&buf, &Msg{Payload: []byte("second")}))
+	assert.Nil(t, enc.Encode(&buf, &Msg{Payload: nil}))
+	buf.WriteString("raw stream data")
+
+	for _, want := range [][]byte{large, []byte("second"), {}} {
+		msg := Msg{}
+		assert.Nil(t, dec.Decode(&buf, &msg))
+		assert.True(t, bytes.Equal(want, msg.Payload))
+	}
+	// 解码器没有读走帧之后的数据
+	rest, err := io.ReadAll(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "raw stream data", string(rest))
+}
+
+func TestDefaultDecoder_Checksum(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, DefaultEncoder{Checksum: true}.Encode(&buf, &Msg{Payload: []byte("checked")}))
+	frame := buf.Bytes()
+
+	msg := Msg{}
+	assert.Nil(t, DefaultDecoder{}.Decode(bytes.NewReader(frame), &msg))
+	assert.Equal(t, "checked", string(msg.Payload))
+
+	corrupt := bytes.Clone(frame)
+	corrupt[3] ^= 0xff
+	assert.Equal(t, ErrBadChecksum, DefaultDecoder{}.Decode(bytes.NewReader(corrupt), &Msg{}))
+}
+
+func TestDefaultDecoder_Errors(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, DefaultEncoder{}.Encode(&buf, &Msg{Payload: make([]byte, 100)}))
+	frame := buf.Bytes()
+
+	assert.Equal(t, ErrFrameTooLarge, DefaultDecoder{MaxPayloadSize: 99}.Decode(bytes.NewReader(frame), &Msg{}))
+	assert.Equal(t, io.ErrUnexpectedEOF, DefaultDecoder{}.Decode(bytes.NewReader(frame[:50]), &Msg{}))
+	assert.NotNil(t, DefaultDecoder{}.Decode(bytes.NewReader([]byte{0x7f, 0}), &Msg{}))
+}
@@ -0,0 +1,34 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+type Encoder interface {
+	Encode(io.Writer, *Msg) error
+}
+
+// DefaultEncoder 按DefaultDecoder的帧格式编码消息
+type DefaultEncoder struct {
+	// Checksum 为true时在帧末尾附加负载的CRC32
+	Checksum bool
+}
+
+func (e DefaultEncoder) Encode(w io.Writer, msg *Msg) error {
+	// 整个帧一次写入 多个协程同时发送消息时不会交错
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(msg.Payload)+4)
+	typ := byte(IncomingMessage)
+	if e.Checksum {
+		typ |= flagChecksum
+	}
+	buf = append(buf, typ)
+	buf = binary.AppendUvarint(buf, uint64(len(msg.Payload)))
+	buf = append(buf, msg.Payload...)
+	if e.Checksum {
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(msg.Payload))
+	}
+	_, err := w.Write(buf)
+	return err
+}
@@ -1,6 +1,27 @@
 package p2p
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+/**
+握手: 连接建立后双方同时发送自己的PeerInfo 再读取对方的PeerInfo
+PeerInfo以JSON编码 放在一个带校验和的消息帧中
+协议版本不兼容或者对方缺少必需的能力时拒绝连接
+*/
+
+const (
+	// ProtocolVersion 当前的协议版本 MinProtocolVersion 能够兼容的最低版本
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+
+	defaultHandshakeTimeout = 5 * time.Second
+	maxHandshakeSize        = 64 * 1024
+)
 
 var ErrInvalidHandshake = errors.New("invalid handshake")
 
@@ -9,3 +30,127 @@ type HandshakeFunc func(Peer) error
 func DefaultHandShakeFunc(Peer) error {
 	return nil
 }
+
+// PeerInfo 握手时交换的节点信息
+type PeerInfo struct {
+	// 节点支持的协议版本范围[MinVersion, Version]
+	Version      uint16   `json:"version"`
+	MinVersion   uint16   `json:"min_version"`
+	NodeID       NodeID   `json:"node_id"`
+	ListenAddr   string   `json:"listen_addr"`
+	Capabilities []string `json:"capabilities"`
+}
+
+func (info PeerInfo) HasCapability(c string) bool {
+	return slices.Contains(info.Capabilities, c)
+}
+
+type HandshakeOpts struct {
+	// Local 本节点的信息 Version为0时使用ProtocolVersion和MinProtocolVersion
+	Local PeerInfo
+	// Required 对方必须支持的能力
+	Required []string
+	// Timeout 握手超时时间 为0时使用默认值
+	Timeout time.Duration
+}
+
+// peerInfoSetter 握手完成后记录对方的信息
+type peerInfoSetter interface {
+	setInfo(PeerInfo)
+}
+
+// NewHandshakeFunc 交换节点信息并协商版本和能力 协商结果通过Peer.Info获取
+// Info中的Version为双方都支持的版本 Capabilities为双方都支持的能力
+func NewHandshakeFunc(opts HandshakeOpts) HandshakeFunc {
+	if opts.Local.Version == 0 {
+		opts.Local.Version, opts.Local.MinVersion = ProtocolVersion, MinProtocolVersion
+	}
+	if opts.Local.MinVersion == 0 || opts.Local.MinVersion > opts.Local.Version {
+		opts.Local.MinVersion = opts.Local.Version
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultHandshakeTimeout
+	}
+	return func(p Peer) error {
+		if err := p.SetDeadline(time.Now().Add(opts.Timeout)); err != nil {
+			return err
+		}
+		defer func() {
+			_ = p.SetDeadline(time.Time{})
+		}()
+
+		remote, err := exchangeInfo(p, opts.Local)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+		}
+		info, err := negotiate(opts, remote)
+		if err != nil {
+			return err
+		}
+		// 对方的证书已经证明了身份 声明的节点标识必须一致
+		if id, ok := p.Identity(); ok && id != info.NodeID {
+			return fmt.Errorf("%w: node id %s does not match certificate %s", ErrInvalidHandshake, info.NodeID, id)
+		}
+		if s, ok := p.(peerInfoSetter); ok {
+			s.setInfo(info)
+		}
+		return nil
+	}
+}
+
+// exchangeInfo 发送和读取同时进行 双方都先发送时不会互相等待
+func exchangeInfo(p Peer, local PeerInfo) (PeerInfo, error) {
+	var remote PeerInfo
+	payload, err := json.Marshal(local)
+	if err != nil {
+		return remote, err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- DefaultEncoder{Checksum: true}.Encode(p, &Msg{Payload: payload})
+	}()
+
+	msg := Msg{}
+	readErr := DefaultDecoder{MaxPayloadSize: maxHandshakeSize}.Decode(p, &msg)
+	if err := <-errc; err != nil {
+		return remote, err
+	}
+	if readErr != nil {
+		return remote, readErr
+	}
+	if err := json.Unmarshal(msg.Payload, &remote); err != nil {
+		return remote, err
+	}
+	if remote.MinVersion == 0 || remote.MinVersion > remote.Version {
+		remote.MinVersion = remote.Version
+	}
+	return remote, nil
+}
+
+func negotiate(opts HandshakeOpts, remote PeerInfo) (PeerInfo, error) {
+	// 双方支持的版本范围没有交集
+	if remote.Version < opts.Local.MinVersion || remote.MinVersion > opts.Local.Version {
+		return remote, fmt.Errorf("%w: incompatible protocol version %d-%d (local %d-%d)", ErrInvalidHandshake,
+			remote.MinVersion, remote.Version, opts.Local.MinVersion, opts.Local.Version)
+	}
+	if remote.NodeID.IsZero() {
+		return remote, fmt.Errorf("%w: missing node id", ErrInvalidHandshake)
+	}
+	if remote.NodeID == opts.Local.NodeID {
+		return remote, fmt.Errorf("%w: connected to self", ErrInvalidHandshake)
+	}
+	for _, c := range opts.Required {
+		if !remote.HasCapability(c) {
+			return remote, fmt.Errorf("%w: peer does not support %s", ErrInvalidHandshake, c)
+		}
+	}
+	info := remote
+	info.Version = min(remote.Version, opts.Local.Version)
+	info.Capabilities = nil
+	for _, c := range remote.Capabilities {
+		if opts.Local.HasCapability(c) && !info.HasCapability(c) {
+			info.Capabilities = append(info.Capabilities, c)
+		}
+	}
+	return info, nil
+}
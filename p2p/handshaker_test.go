@@ -0,0 +1,86 @@
+package p2p
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// handshakePair 在一对连接上同时握手 返回双方的结果
+func handshakePair(a, b HandshakeOpts) (*TCPPeer, *TCPPeer, error, error) {
+	c1, c2 := net.Pipe()
+	p1, p2 := NewTCPPeer(c1, true, nil), NewTCPPeer(c2, false, nil)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- NewHandshakeFunc(b)(p2)
+	}()
+	err1 := NewHandshakeFunc(a)(p1)
+	if err1 != nil {
+		_ = c1.Close()
+	}
+	err2 := <-errc
+	_ = c1.Close()
+	_ = c2.Close()
+	return p1, p2, err1, err2
+}
+
+func TestHandshake_Negotiate(t *testing.T) {
+	a := HandshakeOpts{Local: PeerInfo{
+		NodeID:       NewNodeID(),
+		ListenAddr:   ":3000",
+		Capabilities: []string{"enc:gcm", "chunked", "range"},
+	}, Required: []string{"enc:gcm"}}
+	b := HandshakeOpts{Local: PeerInfo{
+		NodeID:       NewNodeID(),
+		ListenAddr:   ":3001",
+		Capabilities: []string{"enc:gcm", "chunked", "compress:zstd"},
+	}, Required: []string{"enc:gcm"}}
+
+	p1, p2, err1, err2 := handshakePair(a, b)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	assert.Equal(t, b.Local.NodeID, p1.Info().NodeID)
+	assert.Equal(t, ":3001", p1.Info().ListenAddr)
+	assert.Equal(t, a.Local.NodeID, p2.Info().NodeID)
+	assert.Equal(t, uint16(ProtocolVersion), p1.Info().Version)
+	// 只保留双方都支持的能力
+	assert.Equal(t, []string{"enc:gcm", "chunked"}, p1.Info().Capabilities)
+	assert.Equal(t, []string{"enc:gcm", "chunked"}, p2.Info().Capabilities)
+}
+
+func TestHandshake_Reject(t *testing.T) {
+	gcm := HandshakeOpts{Local: PeerInfo{NodeID: NewNodeID(), Capabilities: []string{"enc:gcm"}}, Required: []string{"enc:gcm"}}
+	ctr := HandshakeOpts{Local: PeerInfo{NodeID: NewNodeID(), Capabilities: []string{"enc:ctr"}}, Required: []string{"enc:ctr"}}
+	newer := HandshakeOpts{Local: PeerInfo{NodeID: NewNodeID(), Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1}}
+
+	tests := []struct {
+		name string
+		a, b HandshakeOpts
+	}{
+		{"missing capability", gcm, ctr},
+		{"incompatible version", gcm, newer},
+		{"self", gcm, gcm},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err1, err2 := handshakePair(tt.a, tt.b)
+			assert.True(t, errors.Is(err1, ErrInvalidHandshake), "%v", err1)
+			assert.True(t, errors.Is(err2, ErrInvalidHandshake), "%v", err2)
+		})
+	}
+}
+
+func TestHandshake_Garbage(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	// 对方不是etherfile节点 net.Pipe没有缓冲 只写入解码器会读取的一个字节
+	go func() {
+		_, _ = c2.Write([]byte("G"))
+		_, _ = io.Copy(io.Discard, c2)
+	}()
+	err := NewHandshakeFunc(HandshakeOpts{Local: PeerInfo{NodeID: NewNodeID()}})(NewTCPPeer(c1, true, nil))
+	assert.True(t, errors.Is(err, ErrInvalidHandshake))
+}
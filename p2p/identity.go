@@ -0,0 +1,110 @@
+package p2p
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+/**
+节点的静态身份密钥: Ed25519密钥用于签名证明身份 X25519密钥用于Noise握手中的密钥交换
+X25519公钥由Ed25519密钥签名 对方验证签名后就确认了握手的另一端持有该Ed25519私钥
+节点标识是Ed25519公钥的摘要
+*/
+
+// Identity 节点的静态身份密钥
+type Identity struct {
+	SignKey ed25519.PrivateKey
+	DHKey   *ecdh.PrivateKey
+}
+
+type identityFile struct {
+	Ed25519 string `json:"ed25519"`
+	X25519  string `json:"x25519"`
+}
+
+// NewIdentity 生成新的身份密钥
+func NewIdentity() (*Identity, error) {
+	_, signKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dhKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{SignKey: signKey, DHKey: dhKey}, nil
+}
+
+// LoadOrCreateIdentity 从path加载身份密钥 文件不存在时生成并保存 文件只有所有者可读写
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	id, err := LoadIdentity(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return id, err
+	}
+	if id, err = NewIdentity(); err != nil {
+		return nil, err
+	}
+	if err := id.Save(path); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f identityFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("identity %s: %w", path, err)
+	}
+	seed, err := hex.DecodeString(f.Ed25519)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("identity %s: invalid ed25519 key", path)
+	}
+	dh, err := hex.DecodeString(f.X25519)
+	if err != nil {
+		return nil, fmt.Errorf("identity %s: invalid x25519 key", path)
+	}
+	dhKey, err := ecdh.X25519().NewPrivateKey(dh)
+	if err != nil {
+		return nil, fmt.Errorf("identity %s: %w", path, err)
+	}
+	return &Identity{SignKey: ed25519.NewKeyFromSeed(seed), DHKey: dhKey}, nil
+}
+
+func (id *Identity) Save(path string) error {
+	data, err := json.Marshal(identityFile{
+		Ed25519: hex.EncodeToString(id.SignKey.Seed()),
+		X25519:  hex.EncodeToString(id.DHKey.Bytes()),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.SignKey.Public().(ed25519.PublicKey)
+}
+
+// NodeID 由Ed25519公钥得到的节点标识
+func (id *Identity) NodeID() NodeID {
+	return NodeIDFromPublicKey(id.PublicKey())
+}
+
+func NodeIDFromPublicKey(pub ed25519.PublicKey) NodeID {
+	return sha256.Sum256(pub)
+}
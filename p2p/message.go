@@ -2,13 +2,26 @@ package p2p
 
 import "net"
 
+/**
+消息帧格式: [类型(1B)][负载长度(uvarint)][负载][CRC32(4B 可选)]
+类型的最高位表示帧末尾带有负载的CRC32校验和
+消息在多路复用的控制数据流上传输 文件数据使用单独的数据流
+*/
+
 const (
 	IncomingMessage = 0x1
-	IncomingStream  = 0x2
+
+	// flagChecksum 类型字节中表示带有校验和的标志位
+	flagChecksum = 0x80
+	// DefaultMaxPayloadSize 默认允许的最大负载长度
+	DefaultMaxPayloadSize = 16 * 1024 * 1024
 )
 
 type Msg struct {
-	From    net.Addr
+	From net.Addr
+	// FromID 发送方的节点标识 握手没有交换节点信息时为零值
+	FromID  NodeID
 	Payload []byte
-	Stream  bool
+	// Stream 对方打开的数据流 为nil时表示普通消息
+	Stream *Stream
 }
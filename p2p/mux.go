@@ -0,0 +1,437 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+/**
+连接多路复用(类似yamux): 一个TCP连接上同时存在多个逻辑数据流 每个数据流有自己的流量控制窗口
+帧格式: [类型(1B)][标志(1B)][数据流ID(4B)][长度(4B)][负载]
+数据帧的长度是负载的长度 窗口更新帧的长度是对方增加的发送窗口 没有负载
+ID为0的数据流在连接建立时就存在 用于传输消息 主动发起连接的一方使用奇数ID 另一方使用偶数ID
+*/
+
+const (
+	muxTypeData   = 0x0
+	muxTypeWindow = 0x1
+
+	muxFlagSYN = 0x1 // 打开数据流
+	muxFlagFIN = 0x2 // 发送方不再写入
+	muxFlagRST = 0x4 // 立即关闭数据流
+
+	muxHeaderSize = 10
+	// 每个数据流初始的接收窗口
+	muxInitialWindow = 256 * 1024
+	// 单个数据帧的最大负载
+	muxMaxFrame = 32 * 1024
+	// 等待上层接收的数据流的数量
+	muxAcceptBacklog = 64
+
+	controlStreamID = 0
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamClosed  = errors.New("mux: stream closed")
+	ErrStreamReset   = errors.New("mux: stream reset by peer")
+	errMuxProtocol   = errors.New("mux: protocol error")
+)
+
+// Session 一个连接上的所有数据流
+type Session struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	control *Stream
+
+	accept    chan *Stream
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewSession 在conn上开始多路复用 client为主动发起连接的一方
+func NewSession(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*Stream),
+		nextID:  2,
+		accept:  make(chan *Stream, muxAcceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	s.control = newStream(s, controlStreamID)
+	s.streams[controlStreamID] = s.control
+	go s.recvLoop()
+	return s
+}
+
+// Control 返回用于传输消息的数据流
+func (s *Session) Control() *Stream {
+	return s.control
+}
+
+// Open 打开一个新的数据流
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxTypeWindow, muxFlagSYN, id, 0, nil); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept 等待对方打开的数据流
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, ErrSessionClosed
+	}
+}
+
+// Done 返回连接关闭时关闭的channel
+func (s *Session) Done() <-chan struct{} {
+	return s.closed
+}
+
+// Close 关闭连接 所有数据流的读写都会返回错误
+func (s *Session) Close() error {
+	s.closeWithErr(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithErr(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.closed)
+		streams := make([]*Stream, 0, len(s.streams))
+		for _, st := range s.streams {
+			streams = append(streams, st)
+		}
+		s.mu.Unlock()
+
+		_ = s.conn.Close()
+		for _, st := range streams {
+			st.fail(err)
+		}
+	})
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// writeFrame 整个帧一次写入 不同数据流的帧不会交错
+func (s *Session) writeFrame(typ, flags byte, id, length uint32, payload []byte) error {
+	buf := make([]byte, muxHeaderSize+len(payload))
+	buf[0], buf[1] = typ, flags
+	binary.BigEndian.PutUint32(buf[2:6], id)
+	binary.BigEndian.PutUint32(buf[6:10], length)
+	copy(buf[muxHeaderSize:], payload)
+
+	select {
+	case <-s.closed:
+		return ErrSessionClosed
+	default:
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := s.conn.Write(buf); err != nil {
+		go s.closeWithErr(err)
+		return err
+	}
+	return nil
+}
+
+// recvLoop 读取连接上的帧并分发给各个数据流 不会因为上层没有读取而阻塞
+func (s *Session) recvLoop() {
+	hdr := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			s.closeWithErr(err)
+			return
+		}
+		var (
+			typ, flags = hdr[0], hdr[1]
+			id         = binary.BigEndian.Uint32(hdr[2:6])
+			length     = binary.BigEndian.Uint32(hdr[6:10])
+			err        error
+		)
+		switch typ {
+		case muxTypeData:
+			err = s.handleData(flags, id, length)
+		case muxTypeWindow:
+			err = s.handleWindow(flags, id, length)
+		default:
+			err = fmt.Errorf("%w: unknown frame type 0x%x", errMuxProtocol, typ)
+		}
+		if err != nil {
+			s.closeWithErr(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleData(flags byte, id, length uint32) error {
+	if length > muxMaxFrame {
+		return fmt.Errorf("%w: frame of %d bytes", errMuxProtocol, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(s.conn, payload); err != nil {
+		return err
+	}
+	st, err := s.lookup(flags, id)
+	if err != nil || st == nil {
+		return err
+	}
+	return st.receive(flags, payload)
+}
+
+func (s *Session) handleWindow(flags byte, id, delta uint32) error {
+	st, err := s.lookup(flags, id)
+	if err != nil || st == nil {
+		return err
+	}
+	st.update(flags, delta)
+	return nil
+}
+
+// lookup 找到帧所属的数据流 带有SYN标志时创建数据流 数据流已经关闭时返回nil
+func (s *Session) lookup(flags byte, id uint32) (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[id]
+	if flags&muxFlagSYN == 0 {
+		return st, nil
+	}
+	if ok || id == controlStreamID || id%2 == s.nextID%2 {
+		return nil, fmt.Errorf("%w: unexpected SYN for stream %d", errMuxProtocol, id)
+	}
+	st = newStream(s, id)
+	select {
+	case s.accept <- st:
+		s.streams[id] = st
+		return st, nil
+	default:
+		// 上层来不及接收 拒绝这个数据流
+		go func() {
+			_ = s.writeFrame(muxTypeWindow, muxFlagRST, id, 0, nil)
+		}()
+		return nil, nil
+	}
+}
+
+// Stream 连接上的一个逻辑数据流 Close只关闭本地一侧 对方关闭后读取返回io.EOF
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// 对方还能发送的字节数
+	recvWindow uint32
+	// 已经读取但还没有通知对方的字节数
+	consumed   uint32
+	sendWindow uint32
+
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	st := &Stream{
+		id:         id,
+		sess:       s,
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mu.Lock()
+	for st.buf.Len() == 0 {
+		switch {
+		case st.localClosed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		st.cond.Wait()
+	}
+	n, _ := st.buf.Read(p)
+	// 读取超过半个窗口后通知对方可以继续发送
+	st.consumed += uint32(n)
+	delta := uint32(0)
+	if st.consumed >= muxInitialWindow/2 && !st.remoteClosed {
+		delta, st.consumed = st.consumed, 0
+		st.recvWindow += delta
+	}
+	st.mu.Unlock()
+
+	if delta > 0 {
+		if err := st.sess.writeFrame(muxTypeWindow, 0, st.id, delta, nil); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Write 发送窗口用完时阻塞 直到对方读取了数据
+func (st *Stream) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		st.mu.Lock()
+		for st.sendWindow == 0 && !st.localClosed && st.err == nil {
+			st.cond.Wait()
+		}
+		if st.localClosed {
+			st.mu.Unlock()
+			return total, ErrStreamClosed
+		}
+		if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return total, err
+		}
+		n := min(uint32(len(p)), st.sendWindow, muxMaxFrame)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(muxTypeData, 0, st.id, n, p[:n]); err != nil {
+			return total, err
+		}
+		total += int(n)
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// Close 不再读写这个数据流 对方之后发送的数据会被丢弃
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	// 没有读取的数据直接丢弃 并归还给对方的发送窗口
+	release := uint32(0)
+	if !st.remoteClosed {
+		release = uint32(st.buf.Len()) + st.consumed
+		st.recvWindow += release
+	}
+	st.buf.Reset()
+	st.consumed = 0
+	st.cond.Broadcast()
+	failed, done := st.err != nil, st.remoteClosed || st.err != nil
+	st.mu.Unlock()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+	if failed {
+		return nil
+	}
+	if release > 0 {
+		if err := st.sess.writeFrame(muxTypeWindow, 0, st.id, release, nil); err != nil {
+			return err
+		}
+	}
+	return st.sess.writeFrame(muxTypeData, muxFlagFIN, st.id, 0, nil)
+}
+
+func (st *Stream) receive(flags byte, payload []byte) error {
+	n := uint32(len(payload))
+	st.mu.Lock()
+	if n > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("%w: stream %d exceeded receive window", errMuxProtocol, st.id)
+	}
+	release := uint32(0)
+	if st.localClosed {
+		release = n
+	} else {
+		st.recvWindow -= n
+		st.buf.Write(payload)
+	}
+	done := st.applyFlags(flags)
+	st.mu.Unlock()
+
+	if done {
+		st.sess.remove(st.id)
+	}
+	if release > 0 && !done {
+		// 在接收协程之外发送 避免两端同时阻塞在写入上
+		go func() {
+			_ = st.sess.writeFrame(muxTypeWindow, 0, st.id, release, nil)
+		}()
+	}
+	return nil
+}
+
+func (st *Stream) update(flags byte, delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	done := st.applyFlags(flags)
+	st.mu.Unlock()
+	if done {
+		st.sess.remove(st.id)
+	}
+}
+
+// applyFlags 处理FIN和RST 返回数据流是否已经结束 调用时持有st.mu
+func (st *Stream) applyFlags(flags byte) bool {
+	if flags&muxFlagFIN != 0 {
+		st.remoteClosed = true
+	}
+	if flags&muxFlagRST != 0 && st.err == nil {
+		st.err = ErrStreamReset
+	}
+	st.cond.Broadcast()
+	return (st.localClosed && st.remoteClosed) || st.err != nil
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
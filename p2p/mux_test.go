@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSessionPair() (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	return NewSession(c1, true), NewSession(c2, false)
+}
+
+func TestSession_ConcurrentStreams(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	// 多个超过接收窗口的数据流同时传输
+	const streams = 4
+	payloads := make([][]byte, streams)
+	for i := range payloads {
+		payloads[i] = make([]byte, 3*muxInitialWindow+i)
+		_, _ = rand.Read(payloads[i])
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(p []byte) {
+			defer wg.Done()
+			st, err := client.Open()
+			assert.Nil(t, err)
+			_, err = st.Write(p)
+			assert.Nil(t, err)
+			assert.Nil(t, st.Close())
+		}(payloads[i])
+	}
+
+	received := make([][]byte, 0, streams)
+	for i := 0; i < streams; i++ {
+		st, err := server.Accept()
+		assert.Nil(t, err)
+		data, err := io.ReadAll(st)
+		assert.Nil(t, err)
+		assert.Nil(t, st.Close())
+		received = append(received, data)
+	}
+	wg.Wait()
+
+	for _, p := range payloads {
+		found := false
+		for _, r := range received {
+			found = found || bytes.Equal(p, r)
+		}
+		assert.True(t, found)
+	}
+}
+
+func TestSession_ControlNotBlockedByStream(t *testing.T) {
+	client, server := newSessionPair()
+	defer client.Close()
+	defer server.Close()
+
+	// 对方没有读取的数据流用完窗口后 控制数据流上的消息仍然可以传输
+	st, err := client.Open()
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = st.Write(make([]byte, 2*muxInitialWindow))
+	}()
+	accepted, err := server.Accept()
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, DefaultEncoder{}.Encode(&buf, &Msg{Payload: []byte("ping")}))
+	_, err = client.Control().Write(buf.Bytes())
+	assert.Nil(t, err)
+	msg := Msg{}
+	assert.Nil(t, DefaultDecoder{}.Decode(server.Control(), &msg))
+	assert.Equal(t, "ping", string(msg.Payload))
+
+	// 接收方关闭数据流后 发送方剩余的数据被丢弃而不是一直阻塞
+	assert.Nil(t, accepted.Close())
+	<-done
+}
+
+func TestSession_Close(t *testing.T) {
+	client, server := newSessionPair()
+	st, err := client.Open()
+	assert.Nil(t, err)
+	_, err = server.Accept()
+	assert.Nil(t, err)
+
+	assert.Nil(t, server.Close())
+	_, err = st.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	_, err = client.Open()
+	assert.Equal(t, ErrSessionClosed, err)
+	_, err = server.Accept()
+	assert.Equal(t, ErrSessionClosed, err)
+	// 对方关闭连接后本端也会结束
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("client session not closed")
+	}
+}
@@ -0,0 +1,455 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+Noise握手: Noise_XX_25519_AESGCM_SHA256
+  -> e
+  <- e, ee, s, es
+  -> s, se
+双方的静态X25519公钥在握手中加密传输 第二和第三个消息的负载是Ed25519公钥和它对静态公钥的签名
+握手完成后连接上的数据按Noise传输消息加密 每个消息是[长度(2B)][密文]
+*/
+
+const (
+	noiseProtocolName = "Noise_XX_25519_AESGCM_SHA256"
+	noisePrologue     = "etherfile-noise-1"
+	// 签名静态公钥时的前缀 避免签名被用于其他用途
+	noiseSignPrefix = "etherfile-noise-static-key:"
+
+	noiseMaxMessage = 65535
+	noiseTagSize    = 16
+	noiseKeySize    = 32
+	// 静态公钥密文的长度
+	noiseStaticSize  = noiseKeySize + noiseTagSize
+	noisePayloadSize = ed25519.PublicKeySize + ed25519.SignatureSize
+)
+
+var ErrNoiseNonceExhausted = errors.New("noise: nonce exhausted")
+
+// noiseCipher Noise中的CipherState
+type noiseCipher struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newNoiseCipher(k []byte) *noiseCipher {
+	block, _ := aes.NewCipher(k)
+	aead, _ := cipher.NewGCM(block)
+	return &noiseCipher{aead: aead}
+}
+
+// nonce AESGCM的nonce为4个0字节和大端序的计数器
+func (c *noiseCipher) nonce() ([]byte, error) {
+	if c.n == ^uint64(0) {
+		return nil, ErrNoiseNonceExhausted
+	}
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], c.n)
+	c.n++
+	return nonce, nil
+}
+
+func (c *noiseCipher) encrypt(ad, plaintext []byte) ([]byte, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func (c *noiseCipher) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// noiseSymmetric Noise中的SymmetricState
+type noiseSymmetric struct {
+	ck, h [32]byte
+	c     *noiseCipher
+}
+
+func newNoiseSymmetric() *noiseSymmetric {
+	s := &noiseSymmetric{}
+	// 协议名不超过32字节时直接补0作为初始的h
+	copy(s.h[:], noiseProtocolName)
+	s.ck = s.h
+	s.mixHash([]byte(noisePrologue))
+	return s
+}
+
+func (s *noiseSymmetric) mixHash(data []byte) {
+	s.h = sha256.Sum256(append(s.h[:], data...))
+}
+
+func (s *noiseSymmetric) mixKey(ikm []byte) {
+	ck, k := noiseHKDF(s.ck[:], ikm)
+	copy(s.ck[:], ck)
+	s.c = newNoiseCipher(k)
+}
+
+func (s *noiseSymmetric) encryptAndHash(plaintext []byte) ([]byte, error) {
+	out := plaintext
+	if s.c != nil {
+		var err error
+		if out, err = s.c.encrypt(s.h[:], plaintext); err != nil {
+			return nil, err
+		}
+	}
+	s.mixHash(out)
+	return out, nil
+}
+
+func (s *noiseSymmetric) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	out := ciphertext
+	if s.c != nil {
+		var err error
+		if out, err = s.c.decrypt(s.h[:], ciphertext); err != nil {
+			return nil, err
+		}
+	}
+	s.mixHash(ciphertext)
+	return out, nil
+}
+
+// split 握手结束 得到发起方发送和接收方发送时使用的两个密钥
+func (s *noiseSymmetric) split() (*noiseCipher, *noiseCipher) {
+	k1, k2 := noiseHKDF(s.ck[:], nil)
+	return newNoiseCipher(k1), newNoiseCipher(k2)
+}
+
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{0x01})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1)
+	mac.Write([]byte{0x02})
+	return out1, mac.Sum(nil)
+}
+
+func noiseDH(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) ([]byte, error) {
+	return priv.ECDH(pub)
+}
+
+// noisePayload 用Ed25519密钥签名静态公钥 证明静态公钥属于该身份
+func noisePayload(id *Identity) []byte {
+	sig := ed25519.Sign(id.SignKey, append([]byte(noiseSignPrefix), id.DHKey.PublicKey().Bytes()...))
+	return append(id.PublicKey(), sig...)
+}
+
+// verifyNoisePayload 验证对方的签名 返回对方的Ed25519公钥
+func verifyNoisePayload(payload []byte, rs *ecdh.PublicKey) (ed25519.PublicKey, error) {
+	if len(payload) != noisePayloadSize {
+		return nil, fmt.Errorf("noise: invalid identity payload")
+	}
+	pub := ed25519.PublicKey(bytes.Clone(payload[:ed25519.PublicKeySize]))
+	if !ed25519.Verify(pub, append([]byte(noiseSignPrefix), rs.Bytes()...), payload[ed25519.PublicKeySize:]) {
+		return nil, fmt.Errorf("noise: invalid identity signature")
+	}
+	return pub, nil
+}
+
+// noiseHandshake 在conn上完成XX握手 返回加密的连接和对方的Ed25519公钥
+func noiseHandshake(conn net.Conn, id *Identity, initiator bool) (*noiseConn, ed25519.PublicKey, error) {
+	var (
+		s      = newNoiseSymmetric()
+		curve  = ecdh.X25519()
+		remote ed25519.PublicKey
+	)
+	e, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// mixDH 计算DH并混入密钥
+	mixDH := func(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+		shared, err := noiseDH(priv, pub)
+		if err != nil {
+			return err
+		}
+		s.mixKey(shared)
+		return nil
+	}
+	// readEphemeral 读取对方的临时公钥
+	readEphemeral := func(msg []byte) (*ecdh.PublicKey, []byte, error) {
+		if len(msg) < noiseKeySize {
+			return nil, nil, fmt.Errorf("noise: short handshake message")
+		}
+		re, err := curve.NewPublicKey(msg[:noiseKeySize])
+		if err != nil {
+			return nil, nil, err
+		}
+		s.mixHash(msg[:noiseKeySize])
+		return re, msg[noiseKeySize:], nil
+	}
+	// readStatic 解密对方的静态公钥和负载 验证签名
+	readStatic := func(msg []byte) (*ecdh.PublicKey, []byte, error) {
+		if len(msg) < noiseStaticSize {
+			return nil, nil, fmt.Errorf("noise: short handshake message")
+		}
+		plain, err := s.decryptAndHash(msg[:noiseStaticSize])
+		if err != nil {
+			return nil, nil, err
+		}
+		rs, err := curve.NewPublicKey(plain)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rs, msg[noiseStaticSize:], nil
+	}
+	// writeStatic 加密本节点的静态公钥
+	writeStatic := func(msg []byte) ([]byte, error) {
+		ct, err := s.encryptAndHash(id.DHKey.PublicKey().Bytes())
+		return append(msg, ct...), err
+	}
+	readPayload := func(rest []byte, rs *ecdh.PublicKey) error {
+		payload, err := s.decryptAndHash(rest)
+		if err != nil {
+			return err
+		}
+		remote, err = verifyNoisePayload(payload, rs)
+		return err
+	}
+	writePayload := func(msg []byte) ([]byte, error) {
+		ct, err := s.encryptAndHash(noisePayload(id))
+		return append(msg, ct...), err
+	}
+
+	if initiator {
+		// -> e
+		s.mixHash(e.PublicKey().Bytes())
+		msg1, _ := s.encryptAndHash(nil)
+		if err := writeNoiseMessage(conn, append(e.PublicKey().Bytes(), msg1...)); err != nil {
+			return nil, nil, err
+		}
+		// <- e, ee, s, es
+		msg2, err := readNoiseMessage(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		re, rest, err := readEphemeral(msg2)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := mixDH(e, re); err != nil {
+			return nil, nil, err
+		}
+		rs, rest, err := readStatic(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := mixDH(e, rs); err != nil {
+			return nil, nil, err
+		}
+		if err := readPayload(rest, rs); err != nil {
+			return nil, nil, err
+		}
+		// -> s, se
+		msg3, err := writeStatic(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := mixDH(id.DHKey, re); err != nil {
+			return nil, nil, err
+		}
+		if msg3, err = writePayload(msg3); err != nil {
+			return nil, nil, err
+		}
+		if err := writeNoiseMessage(conn, msg3); err != nil {
+			return nil, nil, err
+		}
+		send, recv := s.split()
+		return newNoiseConn(conn, send, recv), remote, nil
+	}
+
+	// -> e
+	msg1, err := readNoiseMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	re, rest, err := readEphemeral(msg1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := s.decryptAndHash(rest); err != nil {
+		return nil, nil, err
+	}
+	// <- e, ee, s, es
+	msg2 := e.PublicKey().Bytes()
+	s.mixHash(msg2)
+	if err := mixDH(e, re); err != nil {
+		return nil, nil, err
+	}
+	if msg2, err = writeStatic(msg2); err != nil {
+		return nil, nil, err
+	}
+	if err := mixDH(id.DHKey, re); err != nil {
+		return nil, nil, err
+	}
+	if msg2, err = writePayload(msg2); err != nil {
+		return nil, nil, err
+	}
+	if err := writeNoiseMessage(conn, msg2); err != nil {
+		return nil, nil, err
+	}
+	// -> s, se
+	msg3, err := readNoiseMessage(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	rs, rest, err := readStatic(msg3)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := mixDH(e, rs); err != nil {
+		return nil, nil, err
+	}
+	if err := readPayload(rest, rs); err != nil {
+		return nil, nil, err
+	}
+	recv, send := s.split()
+	return newNoiseConn(conn, send, recv), remote, nil
+}
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	if len(msg) > noiseMaxMessage {
+		return fmt.Errorf("noise: message of %d bytes too large", len(msg))
+	}
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// noiseConn 握手完成后加密的连接
+type noiseConn struct {
+	net.Conn
+
+	writeMu sync.Mutex
+	send    *noiseCipher
+
+	readMu sync.Mutex
+	recv   *noiseCipher
+	buf    []byte
+}
+
+func newNoiseConn(conn net.Conn, send, recv *noiseCipher) *noiseConn {
+	return &noiseConn{Conn: conn, send: send, recv: recv}
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.buf) == 0 {
+		ct, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if c.buf, err = c.recv.decrypt(nil, ct); err != nil {
+			return 0, fmt.Errorf("noise: %w", err)
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	total := 0
+	for len(p) > 0 {
+		n := min(len(p), noiseMaxMessage-noiseTagSize)
+		ct, err := c.send.encrypt(nil, p[:n])
+		if err != nil {
+			return total, err
+		}
+		if err := writeNoiseMessage(c.Conn, ct); err != nil {
+			return total, err
+		}
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// noisePeer 握手时需要替换连接并记录对方身份的节点
+type noisePeer interface {
+	isOutbound() bool
+	rawConn() net.Conn
+	upgrade(conn net.Conn)
+	setIdentity(id NodeID, pub crypto.PublicKey)
+}
+
+// NewNoiseHandshakeFunc 使用Noise XX握手加密连接 握手完成后Peer.Identity为对方Ed25519公钥对应的节点标识
+// 通常和NewHandshakeFunc组合使用
+func NewNoiseHandshakeFunc(id *Identity) HandshakeFunc {
+	return func(p Peer) error {
+		np, ok := p.(noisePeer)
+		if !ok {
+			return fmt.Errorf("noise: unsupported peer type %T", p)
+		}
+		if err := p.SetDeadline(time.Now().Add(defaultHandshakeTimeout)); err != nil {
+			return err
+		}
+		defer func() {
+			_ = p.SetDeadline(time.Time{})
+		}()
+		conn, remote, err := noiseHandshake(np.rawConn(), id, np.isOutbound())
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidHandshake, err)
+		}
+		np.upgrade(conn)
+		np.setIdentity(NodeIDFromPublicKey(remote), remote)
+		return nil
+	}
+}
+
+// ChainHandshakes 依次执行多个握手 任何一个失败时拒绝连接
+func ChainHandshakes(fns ...HandshakeFunc) HandshakeFunc {
+	return func(p Peer) error {
+		for _, fn := range fns {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,166 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentity_Persist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.json")
+	id, err := LoadOrCreateIdentity(path)
+	assert.Nil(t, err)
+	again, err := LoadOrCreateIdentity(path)
+	assert.Nil(t, err)
+	assert.Equal(t, id.NodeID(), again.NodeID())
+	assert.Equal(t, id.DHKey.Bytes(), again.DHKey.Bytes())
+}
+
+// noisePair 在一对连接上完成Noise握手
+func noisePair(t *testing.T, a, b *Identity) (*TCPPeer, *TCPPeer, error, error) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	})
+	p1, p2 := NewTCPPeer(c1, true, nil), NewTCPPeer(c2, false, nil)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- NewNoiseHandshakeFunc(b)(p2)
+	}()
+	err1 := NewNoiseHandshakeFunc(a)(p1)
+	if err1 != nil {
+		_ = c1.Close()
+	}
+	return p1, p2, err1, <-errc
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	a, err := NewIdentity()
+	assert.Nil(t, err)
+	b, err := NewIdentity()
+	assert.Nil(t, err)
+
+	p1, p2, err1, err2 := noisePair(t, a, b)
+	assert.Nil(t, err1)
+	assert.Nil(t, err2)
+	id, ok := p1.Identity()
+	assert.True(t, ok)
+	assert.Equal(t, b.NodeID(), id)
+	assert.Equal(t, b.PublicKey(), p1.PublicKey().(ed25519.PublicKey))
+	id, _ = p2.Identity()
+	assert.Equal(t, a.NodeID(), id)
+
+	// 握手之后双向传输 大于单个Noise消息的数据被拆分
+	data := bytes.Repeat([]byte("noise"), 30000)
+	go func() {
+		_, _ = p1.Write(data)
+	}()
+	got := make([]byte, len(data))
+	_, err = io.ReadFull(p2, got)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestNoiseHandshake_Tampered(t *testing.T) {
+	a, err := NewIdentity()
+	assert.Nil(t, err)
+	b, err := NewIdentity()
+	assert.Nil(t, err)
+
+	// 中间人原样转发a发出的数据 修改b回复的第二个握手消息
+	c1, c2 := net.Pipe()
+	c3, c4 := net.Pipe()
+	defer c1.Close()
+	defer c4.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := c2.Read(buf)
+			if err != nil {
+				return
+			}
+			if _, err := c3.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		msg, err := readNoiseMessage(c3)
+		if err != nil {
+			return
+		}
+		msg[len(msg)-1] ^= 0xff
+		_ = writeNoiseMessage(c2, msg)
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- NewNoiseHandshakeFunc(b)(NewTCPPeer(c4, false, nil))
+	}()
+	err = NewNoiseHandshakeFunc(a)(NewTCPPeer(c1, true, nil))
+	assert.True(t, errors.Is(err, ErrInvalidHandshake))
+	_ = c1.Close()
+	_ = c2.Close()
+	_ = c3.Close()
+	select {
+	case <-errc:
+	case <-time.After(defaultHandshakeTimeout + time.Second):
+		t.Fatal("responder did not finish")
+	}
+}
+
+func TestNoiseTransport(t *testing.T) {
+	ids := make([]*Identity, 2)
+	peers := make([]chan Peer, 2)
+	trs := make([]*TCPTransport, 2)
+	for i, addr := range []string{"127.0.0.1:4320", "127.0.0.1:4321"} {
+		id, err := NewIdentity()
+		assert.Nil(t, err)
+		ch := make(chan Peer, 1)
+		ids[i], peers[i] = id, ch
+		trs[i] = NewTCPTransport(TCPTransportOpts{
+			ListenAddr: addr,
+			HandshakeFunc: ChainHandshakes(NewNoiseHandshakeFunc(id), NewHandshakeFunc(HandshakeOpts{
+				Local: PeerInfo{NodeID: id.NodeID(), ListenAddr: addr},
+			})),
+			OnPeer: func(p Peer) error {
+				ch <- p
+				return nil
+			},
+		})
+		assert.Nil(t, trs[i].ListenAndAccept())
+		defer trs[i].Close()
+	}
+	dialed, err := trs[1].Dial("127.0.0.1:4320")
+	assert.Nil(t, err)
+
+	var remote Peer
+	select {
+	case remote = <-peers[1]:
+	case <-time.After(3 * time.Second):
+		t.Fatal("peer did not connect")
+	}
+	<-peers[0]
+	// Dial返回的就是交给OnPeer的节点
+	assert.Equal(t, dialed, remote)
+	id, _ := remote.Identity()
+	assert.Equal(t, ids[0].NodeID(), id)
+	assert.Equal(t, ids[0].NodeID(), remote.Info().NodeID)
+
+	// 消息经过加密的连接到达对方
+	assert.Nil(t, remote.Send([]byte("over noise")))
+	select {
+	case msg := <-trs[0].Consume():
+		assert.Equal(t, "over noise", string(msg.Payload))
+	case <-time.After(3 * time.Second):
+		t.Fatal("message not delivered")
+	}
+}
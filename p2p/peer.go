@@ -1,16 +1,30 @@
 package p2p
 
 import (
+	"crypto"
+	"crypto/tls"
 	"net"
 	"sync"
+	"time"
 )
 
 // Peer 代表网络中的对等节点
+// 握手完成后连接上的数据由多路复用接管 不能再直接读写net.Conn
 type Peer interface {
 	net.Conn
+	// Send 将数据编码为一个消息帧发送
 	Send([]byte) error
+	// OpenStream 打开一个新的数据流 可以和消息以及其他数据流同时传输
+	OpenStream() (*Stream, error)
+	// Info 握手时协商的对方节点信息 没有交换节点信息时为零值
+	Info() PeerInfo
+	// Identity 通过对方证书或Noise握手验证的节点标识 没有验证时返回false
+	Identity() (NodeID, bool)
+	// PublicKey 对方经过验证的公钥 没有验证时为nil
+	PublicKey() crypto.PublicKey
+	// Done 连接断开时关闭
+	Done() <-chan struct{}
 	Close() error
-	CloseStream()
 }
 
 // TCPPeer 代表一个TCP客户端节点
@@ -18,26 +32,105 @@ type TCPPeer struct {
 	net.Conn
 	// 当前主动发起连接 则为一个出站节点 该值为true
 	// 被动接收其他节点连接 则为一个入站节点 该值为false
-	outbound bool
-	wg       sync.WaitGroup
+	outbound  bool
+	encoder   Encoder
+	info      PeerInfo
+	identity  *NodeID
+	publicKey crypto.PublicKey
+	session   *Session
+	// 消息较大时会被拆成多个帧 同一时间只能发送一个消息
+	sendMu sync.Mutex
 }
 
-func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
+func NewTCPPeer(conn net.Conn, outbound bool, encoder Encoder) *TCPPeer {
+	if encoder == nil {
+		encoder = DefaultEncoder{}
+	}
 	return &TCPPeer{
 		Conn:     conn,
 		outbound: outbound,
+		encoder:  encoder,
 	}
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+// startSession 握手完成后开始多路复用
+func (p *TCPPeer) startSession() *Session {
+	p.session = NewSession(p.Conn, p.outbound)
+	return p.session
+}
+
+func (p *TCPPeer) Info() PeerInfo {
+	return p.info
+}
+
+func (p *TCPPeer) setInfo(info PeerInfo) {
+	p.info = info
 }
 
-func (p *TCPPeer) Send(msg []byte) error {
-	_, err := p.Write(msg)
-	return err
+func (p *TCPPeer) Identity() (NodeID, bool) {
+	if p.identity == nil {
+		return NodeID{}, false
+	}
+	return *p.identity, true
+}
+
+// tlsHandshake 完成TLS握手 并由对方的证书得到节点标识
+func (p *TCPPeer) tlsHandshake(conn *tls.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(defaultHandshakeTimeout)); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ErrNoPeerCertificate
+	}
+	p.setIdentity(NodeIDFromCertificate(certs[0]), certs[0].PublicKey)
+	return nil
+}
+
+func (p *TCPPeer) PublicKey() crypto.PublicKey {
+	return p.publicKey
+}
+
+func (p *TCPPeer) setIdentity(id NodeID, pub crypto.PublicKey) {
+	p.identity, p.publicKey = &id, pub
+}
+
+func (p *TCPPeer) isOutbound() bool {
+	return p.outbound
+}
+
+func (p *TCPPeer) rawConn() net.Conn {
+	return p.Conn
+}
+
+// upgrade 握手之后使用加密的连接
+func (p *TCPPeer) upgrade(conn net.Conn) {
+	p.Conn = conn
+}
+
+func (p *TCPPeer) Send(payload []byte) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	return p.encoder.Encode(p.session.Control(), &Msg{Payload: payload})
+}
+
+func (p *TCPPeer) OpenStream() (*Stream, error) {
+	return p.session.Open()
+}
+
+func (p *TCPPeer) Done() <-chan struct{} {
+	return p.session.Done()
 }
 
 func (p *TCPPeer) Close() error {
-	return p.Close()
+	if p.session != nil {
+		return p.session.Close()
+	}
+	return p.Conn.Close()
 }
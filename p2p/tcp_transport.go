@@ -1,18 +1,29 @@
 package p2p
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
+// 建立TCP连接的超时时间 不包括握手
+const defaultDialTimeout = 3 * time.Second
+
 type TCPTransportOpts struct {
 	ListenAddr    string
 	HandshakeFunc HandshakeFunc
 	Decoder       Decoder
+	Encoder       Encoder
 	OnPeer        func(Peer) error
+	// OnPeerClosed 经过OnPeer接受的连接断开后调用 每个连接只调用一次
+	OnPeerClosed func(Peer)
+	// TLSConfig 不为空时所有连接都使用TLS 通常由MutualTLSConfig生成
+	TLSConfig *tls.Config
 }
 
 // TCPTransport 实现Transport接口 需要维护对等点信息
@@ -20,16 +31,26 @@ type TCPTransport struct {
 	TCPTransportOpts
 	listerner net.Listener
 	rc        chan Msg
+	quit      chan struct{}
+	closeOnce sync.Once
 
 	sync.RWMutex
-	peers map[net.Addr]*Peer
+	// peers 正在服务的连接 Close时全部断开
+	peers map[*TCPPeer]struct{}
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	if opts.Decoder == nil {
+		opts.Decoder = DefaultDecoder{}
+	}
+	if opts.Encoder == nil {
+		opts.Encoder = DefaultEncoder{}
+	}
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rc:               make(chan Msg),
-		peers:            make(map[net.Addr]*Peer),
+		quit:             make(chan struct{}),
+		peers:            make(map[*TCPPeer]struct{}),
 	}
 }
 
@@ -37,14 +58,22 @@ func (t *TCPTransport) ListenAddr() string {
 	return t.TCPTransportOpts.ListenAddr
 }
 
-// Dial 向其他节点发起建立连接
-func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+// Dial 向其他节点发起建立连接 握手完成后在后台接收消息
+func (t *TCPTransport) Dial(addr string) (Peer, error) {
+	conn, err := net.DialTimeout("tcp", addr, defaultDialTimeout)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	go t.handleConn(conn, true)
-	return nil
+	if t.TLSConfig != nil {
+		conn = tls.Client(conn, t.TLSConfig)
+	}
+	peer, err := t.setupPeer(conn, true)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	go t.serve(peer)
+	return peer, nil
 }
 
 // 轮询监听请求
@@ -57,6 +86,7 @@ func (t *TCPTransport) startAcceptLoop() {
 				return
 			}
 			fmt.Println("TCP: Accept error:", err)
+			continue
 		}
 		// 每有一个请求到来创建一个协程处理
 		go func() {
@@ -72,6 +102,9 @@ func (t *TCPTransport) ListenAndAccept() error {
 	if err != nil {
 		return err
 	}
+	if t.TLSConfig != nil {
+		t.listerner = tls.NewListener(t.listerner, t.TLSConfig)
+	}
 	go t.startAcceptLoop()
 	log.Printf("TCP transport listening on %s\n", t.ListenAddr())
 	return nil
@@ -84,52 +117,129 @@ func (t *TCPTransport) Consume() <-chan Msg {
 
 // 处理请求
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-	var err error
-	defer func() {
+	peer, err := t.setupPeer(conn, outbound)
+	if err != nil {
+		fmt.Printf("TCP: %v\n", err)
 		_ = conn.Close()
-	}()
+		return
+	}
+	t.serve(peer)
+}
 
+// setupPeer 完成TLS和节点握手 开始多路复用并交给OnPeer
+func (t *TCPTransport) setupPeer(conn net.Conn, outbound bool) (*TCPPeer, error) {
 	// peer的conn和其transport的conn是同一个
-	peer := NewTCPPeer(conn, outbound)
+	peer := NewTCPPeer(conn, outbound, t.Encoder)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := peer.tlsHandshake(tlsConn); err != nil {
+			return nil, fmt.Errorf("tls handshake error: %w", err)
+		}
+	}
 	// 握手
-	if err = t.HandshakeFunc(peer); err != nil {
-		fmt.Printf("TCP: handshake error: %v\n", err)
-		return
+	if err := t.HandshakeFunc(peer); err != nil {
+		return nil, fmt.Errorf("handshake error: %w", err)
 	}
+	// 握手之后连接上的数据都经过多路复用
+	session := peer.startSession()
 
 	// 握手成功后进行OnPeer(回调函数 允许一些自定义逻辑)
 	if t.OnPeer != nil {
-		if err = t.OnPeer(peer); err != nil {
-			fmt.Printf("TCP: OnPeer error: %v\n", err)
-			return
+		if err := t.OnPeer(peer); err != nil {
+			_ = session.Close()
+			return nil, fmt.Errorf("OnPeer error: %w", err)
 		}
 	}
-	// 阻塞读
+	if !t.addPeer(peer) {
+		// transport已经关闭 不再接受新的连接
+		_ = session.Close()
+		t.peerClosed(peer)
+		return nil, net.ErrClosed
+	}
+	return peer, nil
+}
+
+func (t *TCPTransport) addPeer(peer *TCPPeer) bool {
+	t.Lock()
+	defer t.Unlock()
+	select {
+	case <-t.quit:
+		return false
+	default:
+	}
+	t.peers[peer] = struct{}{}
+	return true
+}
+
+// peerClosed 连接断开后从peers中删除并通知上层
+func (t *TCPTransport) peerClosed(peer *TCPPeer) {
+	t.Lock()
+	delete(t.peers, peer)
+	t.Unlock()
+	if t.OnPeerClosed != nil {
+		t.OnPeerClosed(peer)
+	}
+}
+
+// serve 接收对方发来的消息和数据流 直到连接断开
+func (t *TCPTransport) serve(peer *TCPPeer) {
+	defer func() {
+		_ = peer.Close()
+		t.peerClosed(peer)
+	}()
+	go t.acceptStreams(peer)
+
+	// 阻塞读控制数据流上的消息
+	control := bufio.NewReader(peer.session.Control())
 	for {
 		msg := Msg{}
-		if errors.Is(err, net.ErrClosed) {
-			fmt.Println("TCP: connection closed")
+		if err := t.Decoder.Decode(control, &msg); err != nil {
+			// 帧解码失败后无法再找到下一帧的边界 只能断开连接
+			fmt.Println("TCP: decoder error:", err)
 			return
 		}
-		if err = t.Decoder.Decode(conn, &msg); err != nil {
-			fmt.Println("TCP: decoder error:", err)
+		msg.From, msg.FromID = peer.RemoteAddr(), peer.Info().NodeID
+		select {
+		case t.rc <- msg:
+		case <-t.quit:
+			return
 		}
-		msg.From = conn.RemoteAddr()
-		if msg.Stream {
-			peer.wg.Add(1)
-			log.Println("TCP: incoming stream...")
-			peer.wg.Wait()
-			log.Println("TCP: completed received stream...")
-			continue
+	}
+}
+
+// acceptStreams 将对方打开的数据流交给上层读取 上层读取完成后关闭数据流
+func (t *TCPTransport) acceptStreams(peer *TCPPeer) {
+	for {
+		st, err := peer.session.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case t.rc <- Msg{From: peer.RemoteAddr(), FromID: peer.Info().NodeID, Stream: st}:
+		case <-t.quit:
+			_ = st.Close()
+			return
 		}
-		t.rc <- msg
-		//log.Println("TCP: message delivered.")
-		//fmt.Printf("TCP: from: %s message: %v\n", conn.RemoteAddr(), string(rpc.Payload))
 	}
 }
 
-// Close 实现transport结构
+// Close 停止监听并断开所有连接 可以重复调用
+// Consume返回的channel不会被关闭 上层需要自己决定何时停止读取
 func (t *TCPTransport) Close() error {
-	close(t.rc)
-	return t.listerner.Close()
+	var err error
+	t.closeOnce.Do(func() {
+		t.Lock()
+		close(t.quit)
+		peers := make([]*TCPPeer, 0, len(t.peers))
+		for peer := range t.peers {
+			peers = append(peers, peer)
+		}
+		t.Unlock()
+		if t.listerner != nil {
+			err = t.listerner.Close()
+		}
+		for _, peer := range peers {
+			_ = peer.Close()
+		}
+	})
+	return err
 }
@@ -1,8 +1,10 @@
 package p2p
 
 import (
-	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewTCPTransport(t *testing.T) {
@@ -11,3 +13,56 @@ func TestNewTCPTransport(t *testing.T) {
 	})
 	assert.Nil(t, tcpT.ListenAndAccept())
 }
+
+func TestTCPTransport_OnPeerClosed(t *testing.T) {
+	closed := make([]chan Peer, 3)
+	trs := make([]*TCPTransport, 3)
+	for i, addr := range []string{"127.0.0.1:4330", "127.0.0.1:4331", "127.0.0.1:4332"} {
+		ch := make(chan Peer, 4)
+		closed[i] = ch
+		trs[i] = NewTCPTransport(TCPTransportOpts{
+			ListenAddr:    addr,
+			HandshakeFunc: DefaultHandShakeFunc,
+			OnPeerClosed: func(p Peer) {
+				ch <- p
+			},
+		})
+		assert.Nil(t, trs[i].ListenAndAccept())
+	}
+	defer trs[1].Close()
+	defer trs[2].Close()
+
+	waitClosed := func(ch chan Peer) Peer {
+		select {
+		case p := <-ch:
+			return p
+		case <-time.After(3 * time.Second):
+			t.Fatal("OnPeerClosed not called")
+			return nil
+		}
+	}
+
+	// 一方关闭连接时双方都收到通知
+	peer, err := trs[1].Dial("127.0.0.1:4330")
+	assert.Nil(t, err)
+	assert.Nil(t, peer.Close())
+	assert.Equal(t, peer, waitClosed(closed[1]))
+	waitClosed(closed[0])
+
+	// Close断开所有连接 可以重复调用
+	_, err = trs[2].Dial("127.0.0.1:4330")
+	assert.Nil(t, err)
+	assert.Nil(t, trs[0].Close())
+	assert.Nil(t, trs[0].Close())
+	waitClosed(closed[0])
+	waitClosed(closed[2])
+	_, err = trs[2].Dial("127.0.0.1:4330")
+	assert.NotNil(t, err)
+
+	// 每个连接只通知一次
+	select {
+	case <-closed[0]:
+		t.Fatal("OnPeerClosed called twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,203 @@
+package p2p
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+/**
+双向TLS: 节点证书由本地CA签发 连接双方都必须出示由CA签发的证书
+节点之间通过IP:port连接 不校验主机名 节点的身份是证书公钥的摘要(NodeIDFromCertificate)
+*/
+
+var ErrNoPeerCertificate = errors.New("tls: peer did not present a certificate")
+
+// NodeIDFromCertificate 由证书的公钥得到节点标识 重新签发证书时只要公钥不变标识就不变
+func NodeIDFromCertificate(cert *x509.Certificate) NodeID {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// CA 用于签发节点证书的本地证书颁发机构
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewCA 生成一个自签名的CA
+func NewCA(commonName string, validFor time.Duration) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := certTemplate(commonName, validFor)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// LoadCA 从PEM文件加载CA证书和私钥
+func LoadCA(certFile, keyFile string) (*CA, error) {
+	pair, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("tls: unsupported CA key type %T", pair.PrivateKey)
+	}
+	return &CA{Cert: pair.Leaf, Key: signer}, nil
+}
+
+// Save 将CA证书和私钥保存为PEM文件 私钥文件只有所有者可读
+func (ca *CA) Save(certFile, keyFile string) error {
+	return saveKeyPair(certFile, keyFile, ca.Cert.Raw, ca.Key)
+}
+
+// Pool 只包含该CA的证书池
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	return pool
+}
+
+// IssueNodeCert 为节点签发同时用于服务端和客户端认证的证书 hosts为证书中的IP或域名
+func (ca *CA) IssueNodeCert(hosts []string, validFor time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	spki, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	id := NodeID(sha256.Sum256(spki))
+	tmpl, err := certTemplate(id.String(), validFor)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if len(h) > 0 {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// SaveCertificate 将节点证书和私钥保存为PEM文件
+func SaveCertificate(cert tls.Certificate, certFile, keyFile string) error {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("tls: unsupported key type %T", cert.PrivateKey)
+	}
+	return saveKeyPair(certFile, keyFile, cert.Certificate[0], signer)
+}
+
+// LoadCertificate 从PEM文件加载证书和私钥 并解析出Leaf
+// go1.23之前tls.LoadX509KeyPair不会填充Leaf
+func LoadCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return cert, nil
+}
+
+// MutualTLSConfig 双向认证的TLS配置 作为服务端和客户端时都要求对方出示由roots签发的证书
+func MutualTLSConfig(cert tls.Certificate, roots *x509.CertPool) *tls.Config {
+	verify := func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrNoPeerCertificate
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		})
+		return err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS13,
+		// 不按主机名校验 由VerifyConnection校验证书链
+		InsecureSkipVerify: true,
+		VerifyConnection:   verify,
+	}
+}
+
+func certTemplate(commonName string, validFor time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Etherfile"}},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validFor),
+	}, nil
+}
+
+func saveKeyPair(certFile, keyFile string, der []byte, key crypto.Signer) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return os.WriteFile(keyFile, keyPEM, 0o600)
+}
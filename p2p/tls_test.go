@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTLSTransport 启动一个使用双向TLS的节点 连接成功的对方节点写入peers
+func newTLSTransport(t *testing.T, addr string, cert tls.Certificate, ca *CA) (*TCPTransport, chan Peer) {
+	peers := make(chan Peer, 1)
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr: addr,
+		HandshakeFunc: NewHandshakeFunc(HandshakeOpts{Local: PeerInfo{
+			NodeID:     NodeIDFromCertificate(cert.Leaf),
+			ListenAddr: addr,
+		}}),
+		TLSConfig: MutualTLSConfig(cert, ca.Pool()),
+		OnPeer: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() {
+		_ = tr.Close()
+	})
+	return tr, peers
+}
+
+func TestTLSTransport_MutualAuth(t *testing.T) {
+	ca, err := NewCA("etherfile test ca", time.Hour)
+	assert.Nil(t, err)
+	// CA和节点证书保存后重新加载
+	dir := t.TempDir()
+	assert.Nil(t, ca.Save(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")))
+	ca, err = LoadCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	assert.Nil(t, err)
+	assert.NotNil(t, ca.Cert)
+
+	certA, err := ca.IssueNodeCert([]string{"127.0.0.1"}, time.Hour)
+	assert.Nil(t, err)
+	certB, err := ca.IssueNodeCert([]string{"127.0.0.1"}, time.Hour)
+	assert.Nil(t, err)
+	assert.Nil(t, SaveCertificate(certB, filepath.Join(dir, "b.pem"), filepath.Join(dir, "b-key.pem")))
+	certB, err = LoadCertificate(filepath.Join(dir, "b.pem"), filepath.Join(dir, "b-key.pem"))
+	assert.Nil(t, err)
+	assert.NotNil(t, certB.Leaf)
+
+	_, peersA := newTLSTransport(t, "127.0.0.1:4310", certA, ca)
+	trB, peersB := newTLSTransport(t, "127.0.0.1:4311", certB, ca)
+	_, err = trB.Dial("127.0.0.1:4310")
+	assert.Nil(t, err)
+
+	for _, c := range []struct {
+		peers chan Peer
+		want  tls.Certificate
+	}{{peersA, certB}, {peersB, certA}} {
+		select {
+		case p := <-c.peers:
+			id, ok := p.Identity()
+			assert.True(t, ok)
+			assert.Equal(t, NodeIDFromCertificate(c.want.Leaf), id)
+			assert.Equal(t, id, p.Info().NodeID)
+		case <-time.After(3 * time.Second):
+			t.Fatal("peer did not connect")
+		}
+	}
+}
+
+func TestTLSTransport_RejectUnknownCA(t *testing.T) {
+	ca, err := NewCA("etherfile test ca", time.Hour)
+	assert.Nil(t, err)
+	rogue, err := NewCA("rogue ca", time.Hour)
+	assert.Nil(t, err)
+	cert, err := ca.IssueNodeCert([]string{"127.0.0.1"}, time.Hour)
+	assert.Nil(t, err)
+	rogueCert, err := rogue.IssueNodeCert([]string{"127.0.0.1"}, time.Hour)
+	assert.Nil(t, err)
+
+	_, peers := newTLSTransport(t, "127.0.0.1:4312", cert, ca)
+	// 对方信任两个CA 但本节点不信任rogue签发的证书
+	trusting := ca.Pool()
+	trusting.AddCert(rogue.Cert)
+	rogueTr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr: "127.0.0.1:4313",
+		HandshakeFunc: NewHandshakeFunc(HandshakeOpts{Local: PeerInfo{
+			NodeID: NodeIDFromCertificate(rogueCert.Leaf),
+		}}),
+		TLSConfig: MutualTLSConfig(rogueCert, trusting),
+	})
+	// 对方拒绝证书后连接在握手阶段失败
+	_, err = rogueTr.Dial("127.0.0.1:4312")
+	assert.NotNil(t, err)
+
+	select {
+	case <-peers:
+		t.Fatal("accepted a peer with an untrusted certificate")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
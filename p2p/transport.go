@@ -3,7 +3,8 @@ package p2p
 // Transport 处理网络中节点之间的传输，多种新式(TCP,UDP,Websockets...)
 type Transport interface {
 	ListenAndAccept() error
-	Dial(string) error
+	// Dial 连接到addr 握手完成并且OnPeer接受之后返回对方节点
+	Dial(string) (Peer, error)
 	Consume() <-chan Msg
 	Close() error
 	ListenAddr() string
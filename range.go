@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+)
+
+/**
+范围读取: 只解密文件明文中[offset, offset+length)的部分
+本地没有该文件时 通过MessageGetRange只向其他节点请求解密需要的那部分密文
+不负责该文件的节点读取整个文件时也这样按需读取 不在本地保存副本
+*/
+
+const (
+	// 打开远程文件时一起获取的密文开头部分 足够容纳各种加密格式的头部
+	remoteHeadSize = 64
+	// 每次向其他节点请求的最小密文长度 顺序读取时减少请求次数
+	remoteReadAhead = 4 * 1024 * 1024
+)
+
+// MessageGetRange 获取文件密文中从Offset开始的Length个字节
+type MessageGetRange struct {
+	Key    string
+	Offset int64
+	Length int64
+}
+
+// GetRange 读取文件明文中[offset, offset+length)的部分 返回的reader在读取时才解密
+func (fs *FileServer) GetRange(key string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("invalid range %d+%d", offset, length)
+	}
+	pr, pw := io.Pipe()
+	if fs.store.Exists(key) {
+		go func() {
+			pw.CloseWithError(fs.store.ReadDecryptRange(key, fs.Encrypter, offset, length, pw))
+		}()
+		return pr, nil
+	}
+
+	log.Printf("[%s] file not found,will read range %d+%d from network..", fs.ListenAddr, offset, length)
+	blob, fileKey, err := fs.openRemoteFile(key)
+	if err != nil {
+		return nil, err
+	}
+	length = clampRange(offset, length, blob.size)
+	go func() {
+		_, err := DecryptRange(fs.Encrypter, fileKey, blob, offset, length, pw)
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// openRemote 从网络中按需读取整个文件的密文 边读边解密 不在本地保存副本 key是CID时在读取结束时校验内容
+func (fs *FileServer) openRemote(key string) (io.ReadCloser, error) {
+	if _, ok := fs.store.Tombstone(key); ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrFileDeleted)
+	}
+	log.Printf("[%s] file not found,will read it from network..", fs.ListenAddr)
+	blob, fileKey, err := fs.openRemoteFile(key)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := fs.Encrypter.Decrypt(fileKey, io.NewSectionReader(blob, 0, blob.size), pw)
+		pw.CloseWithError(err)
+	}()
+	if cid, err := ParseCID(key); err == nil {
+		return newCIDVerifyReader(pr, cid), nil
+	}
+	return pr, nil
+}
+
+// openRemoteFile 打开其他节点上的文件 返回解密它使用的密钥
+func (fs *FileServer) openRemoteFile(key string) (*remoteBlob, []byte, error) {
+	blob, err := fs.openRemoteBlob(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(blob.meta) == 0 {
+		return blob, fs.Encrypter.Key(), nil
+	}
+	fileKey, err := unwrapDataKey(fs.Encrypter, blob.meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	return blob, fileKey, nil
+}
+
+// clampRange 把范围的长度限制在密文大小以内 明文不会比密文长 这样不会按请求的长度分配内存
+func clampRange(offset, length, size int64) int64 {
+	if offset >= size {
+		return 0
+	}
+	return min(length, size-offset)
+}
+
+// fetchRange 从网络中获取文件密文中从offset开始的length个字节
+func (fs *FileServer) fetchRange(key string, offset, length int64) (*fileReply, []byte, error) {
+	msg := Message{
+		Payload: MessageGetRange{
+			Key:    key,
+			Offset: offset,
+			Length: length,
+		},
+	}
+	var (
+		reply *fileReply
+		data  []byte
+	)
+	err := fs.request(key, &msg, func(r *fileReply) error {
+		var err error
+		reply = r
+		data, err = io.ReadAll(r.Body)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if reply.Offset != offset {
+		return nil, nil, fmt.Errorf("peer %s replied range at %d, want %d", reply.From, reply.Offset, offset)
+	}
+	return reply, data, nil
+}
+
+// remoteBlob 按需从网络中读取其他节点上的密文
+type remoteBlob struct {
+	fs   *FileServer
+	key  string
+	meta []byte
+	size int64
+
+	// 最近一次获取的密文
+	buf    []byte
+	bufOff int64
+}
+
+func (fs *FileServer) openRemoteBlob(key string) (*remoteBlob, error) {
+	reply, head, err := fs.fetchRange(key, 0, remoteHeadSize)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteBlob{
+		fs:   fs,
+		key:  key,
+		meta: reply.Meta,
+		size: reply.Size,
+		buf:  head,
+	}, nil
+}
+
+func (b *remoteBlob) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), b.size)
+	if off < b.bufOff || end > b.bufOff+int64(len(b.buf)) {
+		_, data, err := b.fs.fetchRange(b.key, off, max(end-off, remoteReadAhead))
+		if err != nil {
+			return 0, err
+		}
+		b.buf, b.bufOff = data, off
+	}
+	n := copy(p, b.buf[off-b.bufOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// 处理获取文件部分密文的请求
+func (fs *FileServer) handleMsgGetRange(from string, id uint64, msg MessageGetRange) error {
+	return fs.replyFile(from, id, msg.Key, msg.Offset, msg.Length)
+}
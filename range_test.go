@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecryptRange(t *testing.T) {
+	data := make([]byte, 3*GCMChunkSize+100)
+	_, _ = io.ReadFull(rand.Reader, data)
+	keyring, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+
+	encrypters := map[string]Encrypter{
+		"ctr":     NewDefaultEncrypter(),
+		"gcm":     NewGCMEncrypter(),
+		"keyring": NewKeyringEncrypter(keyring, NewGCMEncrypter()),
+	}
+	ranges := [][2]int64{
+		{0, 10}, {5, 100}, {GCMChunkSize - 3, 10}, {GCMChunkSize, GCMChunkSize},
+		{2*GCMChunkSize + 7, GCMChunkSize + 93}, {3*GCMChunkSize + 90, 1000}, {int64(len(data)) + 5, 10},
+		{GCMChunkSize + 1, 1 << 40},
+	}
+	for name, e := range encrypters {
+		ciphertext := new(bytes.Buffer)
+		_, err := e.Encrypt(e.Key(), bytes.NewReader(data), ciphertext)
+		assert.Nil(t, err)
+		src := bytes.NewReader(ciphertext.Bytes())
+
+		for _, r := range ranges {
+			offset, length := r[0], r[1]
+			end := min(offset+length, int64(len(data)))
+			want := []byte{}
+			if offset < end {
+				want = data[offset:end]
+			}
+			got := new(bytes.Buffer)
+			n, err := DecryptRange(e, e.Key(), src, offset, length, got)
+			assert.Nil(t, err, name)
+			assert.Equal(t, int64(len(want)), n, name)
+			assert.True(t, bytes.Equal(want, got.Bytes()), "%s %v", name, r)
+		}
+	}
+}
+
+func TestFileServer_GetRange(t *testing.T) {
+	fs := newTestServer(t)
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+	assert.Nil(t, fs.Store("video", bytes.NewReader(data)))
+
+	r, err := fs.GetRange("video", 123456, 1000)
+	assert.Nil(t, err)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data[123456:124456], got)
+
+	// 超出文件大小的长度只读到文件末尾
+	for _, length := range []int64{math.MaxInt64, 1 << 36} {
+		r, err := fs.GetRange("video", 10, length)
+		assert.Nil(t, err)
+		got, err := io.ReadAll(r)
+		r.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, data[10:], got)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"Etherfile/p2p"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+/**
+反熵修复: 每隔RepairInterval 本节点与同样负责某些key的每个节点比较这些key的清单
+清单按key的哈希分为repairBuckets个桶 先比较每个桶的摘要 只对摘要不同的桶交换桶中每个key的密文哈希
+对方缺少的key重新发送 密文不同时以版本较新的副本为准 版本相同时以哈希环上负责该key的第一个可用节点的副本为准
+每一轮修复都会重新检查 直到每个key在负责它的所有可用节点上都有相同的副本
+*/
+
+const (
+	DefaultRepairInterval = 30 * time.Second
+	// 清单分成的桶数
+	repairBuckets = 64
+)
+
+// RepairEntry 清单中的一个key和它的密文哈希 Version是文件的版本 不参与摘要
+type RepairEntry struct {
+	Key     string
+	Hash    []byte
+	Version time.Time
+}
+
+// MessageRepairDigest 双方共同负责的key的清单中每个桶的摘要 空桶的摘要为nil
+type MessageRepairDigest struct {
+	Buckets [][]byte
+}
+
+// MessageRepairKeys 摘要不同的桶中的所有key
+type MessageRepairKeys struct {
+	Entries []RepairEntry
+}
+
+// MessageRepairReply 修复请求的回复
+// Buckets是摘要不同的桶 Missing是对方没有的key Divergent是对方的密文不同的key和对方副本的版本
+// Deleted是对方在请求方的副本的版本之后删除的key
+type MessageRepairReply struct {
+	Buckets   []int
+	Missing   []string
+	Divergent []RepairEntry
+	Deleted   []Tombstone
+}
+
+// contentHashes 缓存本地文件密文的哈希 文件大小或修改时间变化时重新计算
+type contentHashes struct {
+	mu      sync.Mutex
+	entries map[string]contentHash
+}
+
+type contentHash struct {
+	size    int64
+	modTime time.Time
+	sum     []byte
+}
+
+// contentHash 本地文件密文的sha256
+func (fs *FileServer) contentHash(key string) ([]byte, error) {
+	info, err := fs.store.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	c := &fs.hashes
+	c.mu.Lock()
+	cached, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+	_, r, err := fs.store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]contentHash)
+	}
+	c.entries[key] = contentHash{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	c.mu.Unlock()
+	return sum, nil
+}
+
+func repairBucket(key string) int {
+	h := sha256.Sum256([]byte(key))
+	return int(h[0]) % repairBuckets
+}
+
+// bucketDigests 每个桶中的key和哈希按key排序后的摘要
+func bucketDigests(entries []RepairEntry) [][]byte {
+	buckets := make([][]RepairEntry, repairBuckets)
+	for _, e := range entries {
+		b := repairBucket(e.Key)
+		buckets[b] = append(buckets[b], e)
+	}
+	digests := make([][]byte, repairBuckets)
+	for i, bucket := range buckets {
+		if len(bucket) == 0 {
+			continue
+		}
+		slices.SortFunc(bucket, func(a, b RepairEntry) int {
+			return bytes.Compare([]byte(a.Key), []byte(b.Key))
+		})
+		h := sha256.New()
+		for _, e := range bucket {
+			h.Write([]byte(e.Key))
+			h.Write([]byte{0})
+			h.Write(e.Hash)
+		}
+		digests[i] = h.Sum(nil)
+	}
+	return digests
+}
+
+// replicatedKeys 本地存储的按副本复制的key 纠删码的分片不按自己的key放置 不包括在内
+func (fs *FileServer) replicatedKeys() ([]string, error) {
+	keys, err := fs.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	out := keys[:0]
+	for _, key := range keys {
+		if !fs.store.IsShard(key) {
+			out = append(out, key)
+		}
+	}
+	return out, nil
+}
+
+// sharedInventory 本地文件中本节点和peer都负责的key 按节点分组
+// peer为空时返回与所有节点的清单
+func (fs *FileServer) sharedInventory(peer string) (map[string][]RepairEntry, error) {
+	keys, err := fs.replicatedKeys()
+	if err != nil {
+		return nil, err
+	}
+	self := fs.NodeID.String()
+	inventory := make(map[string][]RepairEntry)
+	for _, key := range keys {
+		owners := fs.replicaOwners(key)
+		if !slices.Contains(owners, self) {
+			continue
+		}
+		if peer != "" && !slices.Contains(owners, peer) {
+			continue
+		}
+		sum, err := fs.contentHash(key)
+		if err != nil {
+			log.Printf("[%s] Error hashing %s: %s\n", fs.ListenAddr, key, err)
+			continue
+		}
+		version := fs.store.Written(key)
+		for _, owner := range owners {
+			if owner == self || (peer != "" && owner != peer) {
+				continue
+			}
+			inventory[owner] = append(inventory[owner], RepairEntry{Key: key, Hash: sum, Version: version})
+		}
+	}
+	return inventory, nil
+}
+
+// repairLoop 在quit关闭之前定期修复 并回收过期的墓碑
+func (fs *FileServer) repairLoop() {
+	ticker := time.NewTicker(fs.RepairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fs.repair()
+			fs.collectTombstones()
+		case <-fs.quit:
+			return
+		}
+	}
+}
+
+// repair 与每个共同负责一些key的节点比较清单并补发缺少的文件
+func (fs *FileServer) repair() {
+	inventory, err := fs.sharedInventory("")
+	if err != nil {
+		log.Printf("[%s] Error listing local files: %s\n", fs.ListenAddr, err)
+		return
+	}
+	var wg sync.WaitGroup
+	for name, entries := range inventory {
+		peer, ok := fs.getPeer(name)
+		if !ok || !peer.Info().HasCapability(CapRepair) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fs.repairPeer(peer, entries); err != nil {
+				log.Printf("[%s] Error repairing replicas on %s: %s\n", fs.ListenAddr, name, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// repairPeer 比较与peer共同负责的key 发送peer缺少的文件
+// 密文不同时只发送比对方新的版本 版本相同时只有本节点是负责该key的第一个可用节点才发送 避免双方互相覆盖
+func (fs *FileServer) repairPeer(peer p2p.Peer, entries []RepairEntry) error {
+	resp, err := fs.call(peer, MessageRepairDigest{Buckets: bucketDigests(entries)})
+	if err != nil {
+		return err
+	}
+	reply, ok := resp.(MessageRepairReply)
+	if !ok {
+		return fmt.Errorf("unexpected reply %T", resp)
+	}
+	if len(reply.Buckets) == 0 {
+		return nil
+	}
+	var diff []RepairEntry
+	for _, e := range entries {
+		if slices.Contains(reply.Buckets, repairBucket(e.Key)) {
+			diff = append(diff, e)
+		}
+	}
+	resp, err = fs.call(peer, MessageRepairKeys{Entries: diff})
+	if err != nil {
+		return err
+	}
+	if reply, ok = resp.(MessageRepairReply); !ok {
+		return fmt.Errorf("unexpected reply %T", resp)
+	}
+	// 对方已经删除的key 本地的副本也删除
+	for _, t := range reply.Deleted {
+		if err := fs.deleteLocal(t.Key, t.Time); err != nil {
+			log.Printf("[%s] Error deleting %s: %s\n", fs.ListenAddr, t.Key, err)
+		}
+	}
+	self := fs.NodeID.String()
+	push := reply.Missing
+	for _, e := range reply.Divergent {
+		written := fs.store.Written(e.Key)
+		if written.After(e.Version) {
+			push = append(push, e.Key)
+			continue
+		}
+		if owners := fs.replicaOwners(e.Key); written.Equal(e.Version) && len(owners) > 0 && owners[0] == self {
+			push = append(push, e.Key)
+		}
+	}
+	for _, key := range push {
+		if err := fs.pushTo([]p2p.Peer{peer}, key); err != nil {
+			log.Printf("[%s] Error repairing %s on %s: %s\n", fs.ListenAddr, key, peerName(peer), err)
+		}
+	}
+	if len(push) > 0 {
+		log.Printf("[%s] repairing %d files on %s\n", fs.ListenAddr, len(push), peerName(peer))
+	}
+	return nil
+}
+
+// handleMsgRepairDigest 在后台计算本地清单的摘要 回复不同的桶
+func (fs *FileServer) handleMsgRepairDigest(from string, id uint64, msg MessageRepairDigest) error {
+	if len(msg.Buckets) != repairBuckets {
+		return fmt.Errorf("invalid repair digest with %d buckets from %s", len(msg.Buckets), from)
+	}
+	go func() {
+		inventory, err := fs.sharedInventory(from)
+		if err != nil {
+			log.Printf("[%s] Error listing local files: %s\n", fs.ListenAddr, err)
+			return
+		}
+		var reply MessageRepairReply
+		for i, digest := range bucketDigests(inventory[from]) {
+			if !bytes.Equal(digest, msg.Buckets[i]) {
+				reply.Buckets = append(reply.Buckets, i)
+			}
+		}
+		if err := fs.reply(from, id, reply); err != nil {
+			log.Printf("[%s] Error replying repair digest to %s: %s\n", fs.ListenAddr, from, err)
+		}
+	}()
+	return nil
+}
+
+// handleMsgRepairKeys 在后台逐个检查key 回复本地没有 密文不同或者已经删除的key
+func (fs *FileServer) handleMsgRepairKeys(from string, id uint64, msg MessageRepairKeys) error {
+	go func() {
+		var reply MessageRepairReply
+		for _, e := range msg.Entries {
+			if t, ok := fs.deletedAfter(e.Key, e.Version); ok {
+				reply.Deleted = append(reply.Deleted, Tombstone{Key: e.Key, Time: t})
+				continue
+			}
+			if !fs.store.Exists(e.Key) {
+				reply.Missing = append(reply.Missing, e.Key)
+				continue
+			}
+			sum, err := fs.contentHash(e.Key)
+			if err != nil || !bytes.Equal(sum, e.Hash) {
+				reply.Divergent = append(reply.Divergent, RepairEntry{Key: e.Key, Version: fs.store.Written(e.Key)})
+			}
+		}
+		if err := fs.reply(from, id, reply); err != nil {
+			log.Printf("[%s] Error replying repair keys to %s: %s\n", fs.ListenAddr, from, err)
+		}
+	}()
+	return nil
+}
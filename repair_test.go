@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucketDigests(t *testing.T) {
+	entries := []RepairEntry{
+		{Key: "a", Hash: []byte{1}},
+		{Key: "b", Hash: []byte{2}},
+		{Key: "c", Hash: []byte{3}},
+	}
+	digests := bucketDigests(entries)
+	assert.Len(t, digests, repairBuckets)
+	nonEmpty := 0
+	for _, d := range digests {
+		if d != nil {
+			nonEmpty++
+		}
+	}
+	assert.LessOrEqual(t, nonEmpty, len(entries))
+
+	// 与顺序无关
+	reversed := []RepairEntry{entries[2], entries[1], entries[0]}
+	assert.Equal(t, digests, bucketDigests(reversed))
+
+	// 只有内容变化的key所在的桶不同
+	changed := bucketDigests([]RepairEntry{entries[0], {Key: "b", Hash: []byte{9}}, entries[2]})
+	for i := range digests {
+		if i == repairBucket("b") {
+			assert.NotEqual(t, digests[i], changed[i])
+		} else {
+			assert.Equal(t, digests[i], changed[i])
+		}
+	}
+}
+
+func TestFileServer_Repair(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	addrs := []string{"127.0.0.1:4440", "127.0.0.1:4441", "127.0.0.1:4442"}
+	nodes := make([]*FileServer, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = newClusterNode(t, kr, FileServerOpts{
+			ListenAddr:     addr,
+			RepairInterval: 100 * time.Millisecond,
+		}, addrs[:i]...)
+		// 停止后台修复 之后才删除存储目录
+		t.Cleanup(nodes[i].Stop)
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return len(n.peerList()) == len(nodes)-1 }, 3*time.Second, 20*time.Millisecond)
+	}
+
+	keys := make([]string, 5)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("repaired_file_%d", i)
+		assert.Nil(t, nodes[0].Store(keys[i], bytes.NewReader([]byte(keys[i]))))
+	}
+	hasAll := func(n *FileServer) func() bool {
+		return func() bool {
+			for _, key := range keys {
+				if !n.store.Exists(key) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	for _, n := range nodes {
+		assert.Eventually(t, hasAll(n), 3*time.Second, 20*time.Millisecond)
+	}
+
+	// 存储目录被清空的节点重新收到所有副本
+	wiped := nodes[2]
+	assert.Nil(t, wiped.store.Clear())
+	assert.Eventually(t, hasAll(wiped), 5*time.Second, 50*time.Millisecond)
+
+	// 内容不同时版本较旧的副本被覆盖 没有元数据的副本版本最旧
+	key := keys[0]
+	leader := nodes[0].replicaOwners(key)[0]
+	var stale, authoritative *FileServer
+	for _, n := range nodes {
+		if n.NodeID.String() == leader {
+			authoritative = n
+		} else {
+			stale = n
+		}
+	}
+	want, err := authoritative.contentHash(key)
+	assert.Nil(t, err)
+	assert.Nil(t, stale.store.Write(key, bytes.NewReader([]byte("corrupted replica"))))
+	assert.Eventually(t, func() bool {
+		got, err := stale.contentHash(key)
+		return err == nil && bytes.Equal(want, got)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// 负责该key的第一个节点的副本较旧时 也被较新的副本覆盖
+	assert.Nil(t, stale.store.WriteEncrypt(key, stale.Encrypter, bytes.NewReader([]byte("newer replica"))))
+	want, err = stale.contentHash(key)
+	assert.Nil(t, err)
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			got, err := n.contentHash(key)
+			return err == nil && bytes.Equal(want, got)
+		}, 5*time.Second, 50*time.Millisecond)
+	}
+}
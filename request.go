@@ -0,0 +1,392 @@
+package main
+
+import (
+	"Etherfile/p2p"
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+/**
+请求与回复的对应: 每个Message带有一个随机的请求ID
+文件数据通过单独打开的数据流回复 数据流的开头是它所回复的请求ID 之后是fileReply的头部和文件数据
+FileServer维护等待回复的请求表 收到数据流时按请求ID交给等待的调用方 没有调用方等待的数据流暂存一段时间后丢弃
+*/
+
+const (
+	replyTimeout = 5 * time.Second
+	// 数据流先于请求的消息到达时最多暂存的时间
+	earlyReplyTimeout = time.Second
+	// 回复中元数据的最大长度
+	maxReplyMetaSize = 64 * 1024
+)
+
+var (
+	ErrReplyTimeout = errors.New("timeout waiting for reply")
+	// ErrPeerClosed 请求发往的节点都在回复之前断开了连接
+	ErrPeerClosed = errors.New("peer closed before replying")
+)
+
+// newRequestID 生成随机的请求ID 不同节点生成的ID不会冲突
+func newRequestID() uint64 {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return binary.LittleEndian.Uint64(b[:])
+}
+
+// fileReply 其他节点回复的文件数据 Body为文件中从Offset开始的Length个字节
+// 处理完之后需要Close 关闭回复所在的数据流
+type fileReply struct {
+	From   string
+	Meta   []byte
+	Size   int64
+	Offset int64
+	Length int64
+	Body   io.Reader
+
+	closeOnce sync.Once
+	closeFn   func()
+}
+
+func (r *fileReply) Close() {
+	r.closeOnce.Do(r.closeFn)
+}
+
+func readFileReply(p io.Reader, from string) (*fileReply, error) {
+	reply := &fileReply{From: from}
+	metaSize := int64(0)
+	if err := binary.Read(p, binary.LittleEndian, &metaSize); err != nil {
+		return nil, err
+	}
+	if metaSize < 0 || metaSize > maxReplyMetaSize {
+		return nil, fmt.Errorf("invalid reply meta size %d", metaSize)
+	}
+	reply.Meta = make([]byte, metaSize)
+	if _, err := io.ReadFull(p, reply.Meta); err != nil {
+		return nil, err
+	}
+	for _, v := range []*int64{&reply.Size, &reply.Offset, &reply.Length} {
+		if err := binary.Read(p, binary.LittleEndian, v); err != nil {
+			return nil, err
+		}
+	}
+	reply.Body = io.LimitReader(p, reply.Length)
+	return reply, nil
+}
+
+// pendingRequest 等待回复的请求 只接收第一个回复
+// 文件数据通过数据流回复 其他请求的回复是一个消息
+// to是请求发往的节点 全部断开连接后请求立即失败 为空时只会超时
+type pendingRequest struct {
+	replies  chan *fileReply
+	messages chan any
+	to       map[string]bool
+	failed   chan struct{}
+}
+
+func (fs *FileServer) addPending(id uint64, to ...string) *pendingRequest {
+	req := &pendingRequest{
+		replies:  make(chan *fileReply, 1),
+		messages: make(chan any, 1),
+		to:       make(map[string]bool, len(to)),
+		failed:   make(chan struct{}),
+	}
+	for _, name := range to {
+		req.to[name] = true
+	}
+	fs.pendingMu.Lock()
+	fs.pending[id] = req
+	// 数据流比请求的消息先到达
+	if reply, ok := fs.early[id]; ok {
+		delete(fs.early, id)
+		req.replies <- reply
+	}
+	fs.pendingMu.Unlock()
+	return req
+}
+
+func (fs *FileServer) removePending(id uint64) {
+	fs.pendingMu.Lock()
+	delete(fs.pending, id)
+	fs.pendingMu.Unlock()
+}
+
+// failPending 节点断开连接 只等待该节点回复的请求立即失败
+func (fs *FileServer) failPending(name string) {
+	fs.pendingMu.Lock()
+	defer fs.pendingMu.Unlock()
+	for _, req := range fs.pending {
+		if !req.to[name] {
+			continue
+		}
+		delete(req.to, name)
+		if len(req.to) == 0 {
+			close(req.failed)
+		}
+	}
+}
+
+// dispatch 将回复交给等待该请求的调用方 没有调用方等待或已经收到回复时返回false
+func (fs *FileServer) dispatch(id uint64, reply *fileReply) bool {
+	fs.pendingMu.Lock()
+	req, ok := fs.pending[id]
+	fs.pendingMu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case req.replies <- reply:
+		return true
+	default:
+		return false
+	}
+}
+
+// holdEarly 暂存没有等待的请求的数据流 存储文件时命令消息和数据流分别到达 数据流可能先被处理
+// 超过earlyReplyTimeout仍然没有对应的请求时丢弃
+func (fs *FileServer) holdEarly(id uint64, reply *fileReply) {
+	fs.pendingMu.Lock()
+	if req, ok := fs.pending[id]; ok {
+		// 在dispatch之后刚刚注册的请求 或者已经收到了回复
+		fs.pendingMu.Unlock()
+		select {
+		case req.replies <- reply:
+		default:
+			reply.Close()
+		}
+		return
+	}
+	fs.early[id] = reply
+	fs.pendingMu.Unlock()
+	time.AfterFunc(earlyReplyTimeout, func() {
+		fs.pendingMu.Lock()
+		held := fs.early[id] == reply
+		if held {
+			delete(fs.early, id)
+		}
+		fs.pendingMu.Unlock()
+		if held {
+			reply.Close()
+		}
+	})
+}
+
+// dispatchMessage 将回复的消息交给等待该请求的调用方
+func (fs *FileServer) dispatchMessage(id uint64, payload any) bool {
+	fs.pendingMu.Lock()
+	req, ok := fs.pending[id]
+	fs.pendingMu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case req.messages <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait 等待回复 超时返回ErrReplyTimeout 节点都断开连接时返回ErrPeerClosed
+func (req *pendingRequest) wait() (*fileReply, error) {
+	select {
+	case reply := <-req.replies:
+		return reply, nil
+	case <-req.failed:
+		// 断开之前已经收到的回复仍然有效
+		select {
+		case reply := <-req.replies:
+			return reply, nil
+		default:
+			return nil, ErrPeerClosed
+		}
+	case <-time.After(replyTimeout):
+		return nil, ErrReplyTimeout
+	}
+}
+
+func (req *pendingRequest) waitMessage(timeout time.Duration) (any, error) {
+	select {
+	case payload := <-req.messages:
+		return payload, nil
+	case <-req.failed:
+		select {
+		case payload := <-req.messages:
+			return payload, nil
+		default:
+			return nil, ErrPeerClosed
+		}
+	case <-time.After(timeout):
+		return nil, ErrReplyTimeout
+	}
+}
+
+// call 向peer发送请求并等待回复的消息
+func (fs *FileServer) call(peer p2p.Peer, payload any) (any, error) {
+	return fs.callTimeout(peer, payload, replyTimeout)
+}
+
+func (fs *FileServer) callTimeout(peer p2p.Peer, payload any, timeout time.Duration) (any, error) {
+	msg := Message{ID: newRequestID(), Payload: payload}
+	req := fs.addPending(msg.ID, peerName(peer))
+	defer fs.removePending(msg.ID)
+	if err := fs.send(peer, &msg); err != nil {
+		return nil, err
+	}
+	return req.waitMessage(timeout)
+}
+
+// reply 回复id对应的请求
+func (fs *FileServer) reply(from string, id uint64, payload any) error {
+	peer, ok := fs.getPeer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not found", from)
+	}
+	return fs.send(peer, &Message{ID: id, Payload: payload})
+}
+
+// request 向可能有key的节点发送请求并等待第一个回复 由handle处理回复的文件数据
+func (fs *FileServer) request(key string, msg *Message, handle func(*fileReply) error) error {
+	msg.ID = newRequestID()
+	sources := fs.sourcesFor(key)
+	names := make([]string, len(sources))
+	for i, peer := range sources {
+		names[i] = peerName(peer)
+	}
+	req := fs.addPending(msg.ID, names...)
+	defer fs.removePending(msg.ID)
+
+	fs.sendTo(sources, msg)
+	reply, err := req.wait()
+	if err != nil {
+		return err
+	}
+	defer reply.Close()
+	if err := handle(reply); err != nil {
+		log.Printf("[%s] Error reading data from %s: %s\n", fs.ListenAddr, reply.From, err)
+		return err
+	}
+	log.Printf("[%s] get file from peer %s\n", fs.ListenAddr, reply.From)
+	return nil
+}
+
+// handleStream 读取数据流开头的请求ID和回复头部 交给对应的请求处理
+func (fs *FileServer) handleStream(msg p2p.Msg) error {
+	st := msg.Stream
+	var id uint64
+	if err := binary.Read(st, binary.LittleEndian, &id); err != nil {
+		_ = st.Close()
+		return err
+	}
+	reply, err := readFileReply(st, peerKey(msg.FromID, msg.From))
+	if err != nil {
+		_ = st.Close()
+		return err
+	}
+	reply.closeFn = func() {
+		_ = st.Close()
+	}
+	if !fs.dispatch(id, reply) {
+		// 没有等待的请求(还没有收到请求的消息 已经超时或者已经收到其他节点的回复)
+		fs.holdEarly(id, reply)
+	}
+	return nil
+}
+
+// sendFile 在新的数据流上向peer回复请求id 发送文件的元数据和密文中从offset开始的length个字节 length<0表示直到文件结尾
+func (fs *FileServer) sendFile(peer p2p.Peer, id uint64, key string, offset, length int64) error {
+	n, r, err := fs.store.ReadOffset(key, offset)
+	if err != nil {
+		// 请求方已有的部分和本地文件对不上 从头开始传输
+		offset = 0
+		n, r, err = fs.store.ReadOffset(key, offset)
+	}
+	if err != nil {
+		return err
+	}
+	defer func(r io.ReadCloser) {
+		_ = r.Close()
+	}(r)
+	if length < 0 || offset+length > n {
+		length = n - offset
+	}
+	// 先发送元数据(旧文件没有元数据时长度为0) 再发送密文
+	meta, err := fs.store.ReadMeta(key)
+	if err != nil && !errors.Is(err, ErrNoMeta) {
+		return err
+	}
+	return writeFileReply(peer, id, meta, n, offset, length, r)
+}
+
+// writeFileReply 在新的数据流上发送回复头部和r中的length个字节 size是文件的总大小
+func writeFileReply(peer p2p.Peer, id uint64, meta []byte, size, offset, length int64, r io.Reader) error {
+	st, err := peer.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = st.Close()
+	}()
+	w := bufio.NewWriter(st)
+	if err = binary.Write(w, binary.LittleEndian, id); err != nil {
+		return err
+	}
+	metaSize := int64(len(meta))
+	if err = binary.Write(w, binary.LittleEndian, &metaSize); err != nil {
+		return err
+	}
+	if _, err = w.Write(meta); err != nil {
+		return err
+	}
+	// 文件总大小 本次传输的起始位置和长度
+	for _, v := range []int64{size, offset, length} {
+		if err = binary.Write(w, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	if _, err = io.CopyN(w, r, length); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// keyMutex 按key加锁 同一个key同一时间只有一个获取操作写入本地
+type keyMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (m *keyMutex) Lock(key string) (unlock func()) {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
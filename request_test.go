@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileServer_Dispatch(t *testing.T) {
+	fs := newTestServer(t)
+	id := newRequestID()
+
+	// 没有等待的请求时丢弃回复
+	assert.False(t, fs.dispatch(id, &fileReply{}))
+
+	req := fs.addPending(id)
+	first := &fileReply{From: "first"}
+	assert.True(t, fs.dispatch(id, first))
+	// 只接收第一个回复
+	assert.False(t, fs.dispatch(id, &fileReply{From: "second"}))
+	// 其他请求的回复不会交给这个请求
+	assert.False(t, fs.dispatch(id+1, &fileReply{From: "other"}))
+
+	reply, err := req.wait()
+	assert.Nil(t, err)
+	assert.Equal(t, first, reply)
+
+	fs.removePending(id)
+	assert.False(t, fs.dispatch(id, &fileReply{}))
+}
+
+func TestKeyMutex(t *testing.T) {
+	var (
+		m       keyMutex
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		running = map[string]int{}
+	)
+	for i := 0; i < 20; i++ {
+		key := []string{"a", "b"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := m.Lock(key)
+			defer unlock()
+			mu.Lock()
+			running[key]++
+			assert.Equal(t, 1, running[key])
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running[key]--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	assert.Empty(t, m.locks)
+}
+
+func TestFileServer_HoldEarly(t *testing.T) {
+	fs := newTestServer(t)
+	id := newRequestID()
+
+	// 数据流先于请求到达 注册请求时立即收到
+	early := &fileReply{From: "early"}
+	fs.holdEarly(id, early)
+	req := fs.addPending(id)
+	reply, err := req.wait()
+	assert.Nil(t, err)
+	assert.Equal(t, early, reply)
+	fs.removePending(id)
+
+	// 一直没有对应的请求时关闭数据流
+	closed := make(chan struct{})
+	fs.holdEarly(id+1, &fileReply{closeFn: func() { close(closed) }})
+	select {
+	case <-closed:
+	case <-time.After(earlyReplyTimeout + time.Second):
+		t.Fatal("early reply was not discarded")
+	}
+	fs.pendingMu.Lock()
+	assert.Empty(t, fs.early)
+	fs.pendingMu.Unlock()
+}
+
+func TestFileServer_FailPending(t *testing.T) {
+	fs := newTestServer(t)
+	id := newRequestID()
+
+	// 所有节点都断开后才失败
+	req := fs.addPending(id, "a", "b")
+	fs.failPending("a")
+	select {
+	case <-req.failed:
+		t.Fatal("request failed while b is still connected")
+	default:
+	}
+	fs.failPending("b")
+	start := time.Now()
+	_, err := req.wait()
+	assert.ErrorIs(t, err, ErrPeerClosed)
+	assert.Less(t, time.Since(start), replyTimeout)
+	fs.removePending(id)
+
+	// 断开之前已经到达的回复仍然交给调用方
+	req = fs.addPending(id+1, "a")
+	assert.True(t, fs.dispatchMessage(id+1, "pong"))
+	fs.failPending("a")
+	payload, err := req.waitMessage(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, "pong", payload)
+	fs.removePending(id + 1)
+}
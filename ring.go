@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+/**
+一致性哈希环: 每个节点按标识在环上放置多个虚拟节点 key哈希后顺时针找到的前N个不同节点负责存储该key
+节点加入或离开时只有相邻区间的key改变归属 虚拟节点使各节点负责的区间大小接近
+*/
+
+const (
+	// DefaultReplicationFactor 每个key默认保存的副本数
+	DefaultReplicationFactor = 3
+	// 每个节点在环上的虚拟节点数
+	defaultVirtualNodes = 64
+)
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// hashRing 以节点名(节点标识)为成员的一致性哈希环
+type hashRing struct {
+	mu      sync.RWMutex
+	vnodes  int
+	points  []ringPoint
+	members map[string]struct{}
+}
+
+func newHashRing(vnodes int) *hashRing {
+	if vnodes <= 0 {
+		vnodes = defaultVirtualNodes
+	}
+	return &hashRing{
+		vnodes:  vnodes,
+		members: make(map[string]struct{}),
+	}
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func comparePoints(a, b ringPoint) int {
+	if a.hash != b.hash {
+		if a.hash < b.hash {
+			return -1
+		}
+		return 1
+	}
+	// 哈希相同时按成员名排序 保证各节点上的环一致
+	if a.member < b.member {
+		return -1
+	}
+	if a.member > b.member {
+		return 1
+	}
+	return 0
+}
+
+// Add 加入成员 已经存在时不做任何事
+func (r *hashRing) Add(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.members[member]; ok {
+		return
+	}
+	r.members[member] = struct{}{}
+	for i := 0; i < r.vnodes; i++ {
+		r.points = append(r.points, ringPoint{hash: ringHash(member + "#" + strconv.Itoa(i)), member: member})
+	}
+	slices.SortFunc(r.points, comparePoints)
+}
+
+func (r *hashRing) Remove(member string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.members[member]; !ok {
+		return
+	}
+	delete(r.members, member)
+	r.points = slices.DeleteFunc(r.points, func(p ringPoint) bool {
+		return p.member == member
+	})
+}
+
+func (r *hashRing) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.members)
+}
+
+// Owners 负责key的最多n个成员 按在环上的顺序排列
+func (r *hashRing) Owners(key string, n int) []string {
+	return r.OwnersFunc(key, n, nil)
+}
+
+// OwnersFunc 与Owners相同 但跳过ok返回false的成员 由环上之后的成员代替
+func (r *hashRing) OwnersFunc(key string, n int, ok func(member string) bool) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+	if n <= 0 {
+		return nil
+	}
+	h := ringHash(key)
+	start, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int {
+		if p.hash < h {
+			return -1
+		}
+		if p.hash > h {
+			return 1
+		}
+		return 0
+	})
+	owners := make([]string, 0, n)
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !slices.Contains(owners, p.member) && (ok == nil || ok(p.member)) {
+			owners = append(owners, p.member)
+		}
+	}
+	return owners
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"Etherfile/p2p"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRing_Owners(t *testing.T) {
+	r := newHashRing(0)
+	assert.Nil(t, r.Owners("key", 3))
+	members := make([]string, 10)
+	for i := range members {
+		members[i] = p2p.NewNodeID().String()
+		r.Add(members[i])
+	}
+	r.Add(members[0])
+	assert.Equal(t, 10, r.Len())
+
+	owners := r.Owners("key", 3)
+	assert.Len(t, owners, 3)
+	assert.NotEqual(t, owners[0], owners[1])
+	assert.NotEqual(t, owners[1], owners[2])
+	assert.NotEqual(t, owners[0], owners[2])
+	assert.Len(t, r.Owners("key", 20), 10)
+
+	// 成员加入的顺序不影响结果
+	other := newHashRing(0)
+	for i := len(members) - 1; i >= 0; i-- {
+		other.Add(members[i])
+	}
+	assert.Equal(t, owners, other.Owners("key", 3))
+}
+
+func TestHashRing_Rebalance(t *testing.T) {
+	r := newHashRing(0)
+	for i := 0; i < 10; i++ {
+		r.Add(p2p.NewNodeID().String())
+	}
+	keys := make([]string, 2000)
+	before := make(map[string]string, len(keys))
+	counts := make(map[string]int)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		owner := r.Owners(keys[i], 1)[0]
+		before[keys[i]] = owner
+		counts[owner]++
+	}
+	// 虚拟节点使每个节点负责的key数量接近平均值
+	for _, n := range counts {
+		assert.Greater(t, n, len(keys)/10/3)
+		assert.Less(t, n, len(keys)/10*3)
+	}
+
+	// 新节点加入后只有归属新节点的key发生变化
+	added := p2p.NewNodeID().String()
+	r.Add(added)
+	moved := 0
+	for _, key := range keys {
+		owner := r.Owners(key, 1)[0]
+		if owner != before[key] {
+			assert.Equal(t, added, owner)
+			moved++
+		}
+	}
+	assert.Less(t, moved, len(keys)/4)
+
+	// 节点离开后恢复原来的归属
+	r.Remove(added)
+	for _, key := range keys {
+		assert.Equal(t, before[key], r.Owners(key, 1)[0])
+	}
+}
+
+func TestHashRing_OwnersFunc(t *testing.T) {
+	r := newHashRing(0)
+	for i := 0; i < 5; i++ {
+		r.Add(p2p.NewNodeID().String())
+	}
+	all := r.Owners("key", 5)
+	down := all[1]
+	// 不可用的成员由环上的下一个成员代替
+	owners := r.OwnersFunc("key", 3, func(m string) bool { return m != down })
+	assert.Equal(t, []string{all[0], all[2], all[3]}, owners)
+	assert.Len(t, r.OwnersFunc("key", 5, func(m string) bool { return m != down }), 4)
+}
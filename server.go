@@ -1,60 +1,162 @@
 package main
 
 import (
+	"Etherfile/dht"
+	"Etherfile/membership"
 	"Etherfile/p2p"
 	"bytes"
-	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"slices"
 	"sync"
 	"time"
 )
 
 type FileServerOpts struct {
+	// NodeID 本节点的标识 为零值时使用保存在StorageRoot下的标识
+	NodeID            p2p.NodeID
 	Encrypter         Encrypter
 	ListenAddr        string
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+	// 分块存储时的块大小
+	ChunkerOpts ChunkerOpts
+	// 分块读取时同时获取的块数
+	FetchConcurrency int
+	// ReplicationFactor 每个key保存在哈希环上的几个节点 为0时使用DefaultReplicationFactor
+	ReplicationFactor int
+	// Erasure 设置了数据分片数时使用纠删码存储 代替完整的副本
+	Erasure ErasureOpts
+	// 成员探测的周期和确认失效前的怀疑时间 为0时使用默认值
+	ProbeInterval    time.Duration
+	SuspicionTimeout time.Duration
+	// 同一时间最多的拨号数 以及断线重连的最短和最长间隔 为0时使用默认值
+	MaxConcurrentDials  int
+	ReconnectMinBackoff time.Duration
+	ReconnectMaxBackoff time.Duration
+	// RepairInterval 与其他节点比较清单并修复副本的周期 为0时使用DefaultRepairInterval
+	RepairInterval time.Duration
+	// TombstoneGracePeriod 删除的墓碑保留的时间 为0时使用DefaultTombstoneGracePeriod
+	TombstoneGracePeriod time.Duration
+	// TrustedNodes 不为空时只接受身份经过验证(TLS证书或Noise握手)并且在列表中的节点
+	TrustedNodes []p2p.NodeID
 }
 
 type FileServer struct {
 	FileServerOpts
 
 	sync.Mutex
+	// 以节点标识为key 连接断开时删除
 	peers map[string]p2p.Peer
+	// 保持与引导节点和其他成员的连接
+	conns *connManager
 
-	store *Store
-	quit  chan struct{}
+	dht *dht.DHT
+	// 决定每个key存储在哪些节点
+	ring *hashRing
+	// 集群成员和它们是否存活
+	members *membership.Memberlist
+
+	// 等待回复的请求
+	pendingMu sync.Mutex
+	pending   map[uint64]*pendingRequest
+	// 先于请求到达的数据流
+	early map[uint64]*fileReply
+
+	fetchLocks keyMutex
+	// 本地文件密文的哈希 用于比较副本
+	hashes   contentHashes
+	store    *Store
+	quit     chan struct{}
+	stopOnce sync.Once
 }
 
+// Message 节点之间的消息 ID用于将回复对应到请求
 type Message struct {
+	ID      uint64
 	Payload any
 }
 
+// MessageStoreFile 存储文件 Time是文件的版本 不晚于接收方的墓碑或者早于接收方的副本时拒绝
 type MessageStoreFile struct {
 	Key  string
 	Size int64
+	Meta []byte
+	Time time.Time
 }
 
-type MessageGetFile struct {
+// MessageStoreAck 接收方存储完成后回复存储文件的请求
+type MessageStoreAck struct {
 	Key string
 }
 
+// MessageGetFile 获取文件 Offset为请求方已经收到的字节数 用于断点续传
+// Version是已经收到的部分的版本 与本地文件的版本不同时从头发送
+type MessageGetFile struct {
+	Key     string
+	Offset  int64
+	Version time.Time
+}
+
 func NewFileServer(opts FileServerOpts) *FileServer {
 	storeOpts := StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
 	}
-	return &FileServer{
+	if opts.FetchConcurrency <= 0 {
+		opts.FetchConcurrency = DefaultFetchConcurrency
+	}
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = DefaultReplicationFactor
+	}
+	if opts.RepairInterval <= 0 {
+		opts.RepairInterval = DefaultRepairInterval
+	}
+	if opts.TombstoneGracePeriod <= 0 {
+		opts.TombstoneGracePeriod = DefaultTombstoneGracePeriod
+	}
+	if opts.NodeID.IsZero() {
+		id, err := LoadOrCreateNodeID(storeOpts.Root)
+		if err != nil {
+			log.Printf("Error loading node id: %s, using a temporary one\n", err)
+			id = p2p.NewNodeID()
+		}
+		opts.NodeID = id
+	}
+	fs := &FileServer{
 		FileServerOpts: opts,
 		peers:          make(map[string]p2p.Peer),
+		pending:        make(map[uint64]*pendingRequest),
+		early:          make(map[uint64]*fileReply),
 		store:          NewStore(storeOpts),
+		ring:           newHashRing(defaultVirtualNodes),
 		quit:           make(chan struct{}),
 	}
+	fs.ring.Add(opts.NodeID.String())
+	fs.conns = newConnManager(func(addr string) (p2p.Peer, error) {
+		return fs.Transport.Dial(addr)
+	}, func(name string) bool {
+		_, ok := fs.getPeer(name)
+		return ok
+	}, opts.MaxConcurrentDials, opts.ReconnectMinBackoff, opts.ReconnectMaxBackoff)
+	fs.dht = dht.New(dht.Opts{
+		Self:    dht.Contact{ID: opts.NodeID, Addr: opts.ListenAddr},
+		Network: dhtNetwork{fs: fs},
+	})
+	fs.members = membership.New(membership.Opts{
+		Self:             membership.Member{ID: opts.NodeID, Addr: opts.ListenAddr},
+		Network:          gossipNetwork{fs: fs},
+		ProbeInterval:    opts.ProbeInterval,
+		SuspicionTimeout: opts.SuspicionTimeout,
+		OnJoin:           fs.onMemberJoin,
+		OnLeave:          fs.onMemberLeave,
+	})
+	return fs
 }
 
 func (fs *FileServer) Start() error {
@@ -63,155 +165,354 @@ func (fs *FileServer) Start() error {
 		return fmt.Errorf("Error listening on %s: %s\n", fs.ListenAddr, err)
 	}
 	fs.bootstrapNetwork()
+	fs.members.Start()
+	go fs.repairLoop()
 	fs.loop()
 	return nil
 }
 
+// bootstrapNetwork 在后台连接引导节点 连接断开后自动重连
 func (fs *FileServer) bootstrapNetwork() {
 	for _, addr := range fs.BootstrapNodes {
 		if len(addr) == 0 {
 			continue
 		}
-		go func(addr string) {
-			if err := fs.Transport.Dial(addr); err != nil {
-				log.Printf("Error connecting to %s: %s\n", addr, err)
-			}
-		}(addr)
+		fs.conns.Add(addr, "")
 	}
+	go fs.conns.run(fs.quit)
 }
 
-// Store 存储函数 将文件存在本地 并且广播到整个网络进行备份存储
+// Store 存储函数 将文件存在本地 并且发送到哈希环上负责该key的节点进行备份存储
+// 配置了纠删码时改为将文件编码后的分片分散存储到不同的节点
 func (fs *FileServer) Store(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
+	if fs.Erasure.Enabled() {
+		_, err := fs.StoreErasure(key, r)
+		return err
+	}
+	return fs.storeReplicated(key, r)
+}
 
-	//加密存储到本地
-	err := fs.store.writeEncrypt(key, fs.Encrypter, tee)
-	if err != nil {
+func (fs *FileServer) storeReplicated(key string, r io.Reader) error {
+	// 边读边加密写入本地
+	if err := fs.store.WriteEncrypt(key, fs.Encrypter, r); err != nil {
 		return err
 	}
+	return fs.replicate(key)
+}
 
-	// 广播发送存储文件命令到网络中其他节点进行分布式存储备份
-	msg := Message{
-		Payload: MessageStoreFile{
-			Key:  key,
-			Size: int64(fileBuffer.Len() + DefaultIVSize),
-		},
+// StoreContent 以内容的CID作为key存储文件 相同内容已经存在时不会重复存储
+func (fs *FileServer) StoreContent(r io.Reader) (CID, error) {
+	// 加密写入临时文件的同时计算明文的CID
+	hasher := newCIDHasher()
+	f, err := fs.store.StageEncrypt(fs.Encrypter, io.TeeReader(r, hasher))
+	if err != nil {
+		return "", err
 	}
-	fs.broadcast(&msg)
+	cid := hasher.CID()
+	if fs.store.Exists(cid.String()) {
+		log.Printf("[%s] content %s already stored\n", fs.ListenAddr, cid)
+		return cid, fs.store.Discard(f)
+	}
+	if err := fs.store.Commit(cid.String(), f); err != nil {
+		_ = fs.store.Discard(f)
+		return "", err
+	}
+	return cid, fs.replicate(cid.String())
+}
 
-	// 发送待存储文件至所有peer
-	time.Sleep(10 * time.Millisecond)
-	fs.stream(fileBuffer.Bytes())
+// replicate 将本地存储的密文和元数据备份到哈希环上负责该key的其他节点
+// 本节点不负责该key时 所有负责的节点确认存储之后删除本地的副本 只保留N个副本
+func (fs *FileServer) replicate(key string) error {
+	peers := fs.replicaPeers(key)
+	acks, err := fs.push(peers, key)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 || fs.ownsKey(key) {
+		fs.provide(key)
+		return nil
+	}
+	go fs.dropWhenReplicated(key, acks, len(peers))
 	return nil
 }
 
-// 广播消息到所有对等点
-func (fs *FileServer) broadcast(msg *Message) {
+// dropWhenReplicated 收到n个节点的存储确认后删除本地的副本
+// 有节点没有确认或者本节点已经变为负责该key的节点时保留副本
+func (fs *FileServer) dropWhenReplicated(key string, acks <-chan bool, n int) {
+	for i := 0; i < n; i++ {
+		if !<-acks {
+			fs.provide(key)
+			return
+		}
+	}
+	// 与获取文件互斥 不删除正在写入的文件
+	unlock := fs.fetchLocks.Lock(key)
+	defer unlock()
+	if fs.ownsKey(key) {
+		fs.provide(key)
+		return
+	}
+	if err := fs.store.Delete(key); err != nil {
+		log.Printf("[%s] Error dropping local copy of %s: %s\n", fs.ListenAddr, key, err)
+		return
+	}
+	log.Printf("[%s] dropped local copy of %s after %d replicas were stored\n", fs.ListenAddr, key, n)
+}
+
+// pushTo 在后台将本地存储的key发送给peers 不等待确认
+func (fs *FileServer) pushTo(peers []p2p.Peer, key string) error {
+	_, err := fs.push(peers, key)
+	return err
+}
+
+// push 在后台将本地存储的key发送给peers 发送存储文件命令之后紧跟着文件数据流
+// 每个节点的结果写入返回的channel 对方确认存储时为true
+func (fs *FileServer) push(peers []p2p.Peer, key string) (<-chan bool, error) {
+	meta, err := fs.store.ReadMeta(key)
+	if err != nil && !errors.Is(err, ErrNoMeta) {
+		return nil, err
+	}
+	info, err := fs.store.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	acks := make(chan bool, len(peers))
+	for _, peer := range peers {
+		// 每个节点使用不同的请求ID 分别等待确认
+		msg := Message{
+			ID: newRequestID(),
+			Payload: MessageStoreFile{
+				Key:  key,
+				Size: info.Size(),
+				Meta: meta,
+				// 文件的版本 不是本地副本的修改时间 副本每次复制都会更新修改时间
+				Time: metaWritten(meta),
+			},
+		}
+		go func(p p2p.Peer) {
+			acks <- fs.pushFile(p, &msg, key)
+		}(peer)
+	}
+	return acks, nil
+}
+
+// pushFile 发送存储命令和文件数据流 等待对方确认存储
+func (fs *FileServer) pushFile(p p2p.Peer, msg *Message, key string) bool {
+	req := fs.addPending(msg.ID, peerName(p))
+	defer fs.removePending(msg.ID)
+	if err := fs.send(p, msg); err != nil {
+		log.Printf("Error sending message to %s: %s\n", peerName(p), err)
+		return false
+	}
+	if err := fs.sendFile(p, msg.ID, key, 0, -1); err != nil {
+		log.Printf("Error streaming data to %s: %s\n", peerName(p), err)
+		return false
+	}
+	log.Printf("[%s] send file to %s\n", fs.ListenAddr, peerName(p))
+	if _, err := req.waitMessage(replyTimeout); err != nil {
+		log.Printf("[%s] %s did not confirm storing %s: %s\n", fs.ListenAddr, peerName(p), key, err)
+		return false
+	}
+	return true
+}
+
+func encodeMessage(msg *Message) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// send 向一个对等点发送消息
+func (fs *FileServer) send(peer p2p.Peer, msg *Message) error {
+	buf, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return peer.Send(buf)
+}
+
+// sendTo 在后台向多个对等点发送消息
+func (fs *FileServer) sendTo(peers []p2p.Peer, msg *Message) {
+	buf, err := encodeMessage(msg)
+	if err != nil {
 		log.Printf("Error encoding message: %v\n", err)
+		return
 	}
-	for _, peer := range fs.peers {
+	for _, peer := range peers {
 		go func(p p2p.Peer) {
-			err := p.Send([]byte{p2p.IncomingMessage})
-			if err = p.Send(buf.Bytes()); err != nil {
-				log.Fatalf("Error sending message to %s: %s\n", p, err)
+			if err := p.Send(buf); err != nil {
+				log.Printf("Error sending message to %s: %s\n", peerName(p), err)
+				return
 			}
-			log.Printf("[%s] send msg to %s\n", fs.ListenAddr, peer.RemoteAddr())
+			log.Printf("[%s] send msg to %s\n", fs.ListenAddr, peerName(p))
 		}(peer)
 	}
 }
 
-// 向所有peer传输文件
-func (fs *FileServer) stream(fileDataStream []byte) {
+func (fs *FileServer) getPeer(key string) (p2p.Peer, bool) {
+	fs.Lock()
+	defer fs.Unlock()
+	peer, ok := fs.peers[key]
+	return peer, ok
+}
+
+// replicaOwners 负责key的节点 跳过断开连接的节点 由环上之后的节点代替
+func (fs *FileServer) replicaOwners(key string) []string {
+	return fs.ring.OwnersFunc(key, fs.ReplicationFactor, fs.available)
+}
+
+// ownsKey 本节点是否负责key
+func (fs *FileServer) ownsKey(key string) bool {
+	return slices.Contains(fs.replicaOwners(key), fs.NodeID.String())
+}
+
+// available 本节点或者已经连接的节点
+func (fs *FileServer) available(name string) bool {
+	if name == fs.NodeID.String() {
+		return true
+	}
+	_, ok := fs.getPeer(name)
+	return ok
+}
+
+// replicaPeers 负责key的节点中除本节点以外的节点
+func (fs *FileServer) replicaPeers(key string) []p2p.Peer {
+	self := fs.NodeID.String()
+	var peers []p2p.Peer
+	for _, name := range fs.replicaOwners(key) {
+		if name == self {
+			continue
+		}
+		if peer, ok := fs.getPeer(name); ok {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (fs *FileServer) peerList() []p2p.Peer {
+	fs.Lock()
+	defer fs.Unlock()
+	peers := make([]p2p.Peer, 0, len(fs.peers))
 	for _, peer := range fs.peers {
-		go func(p p2p.Peer) {
-			err := peer.Send([]byte{p2p.IncomingStream})
-			//_, err = io.Copy(peer, bytes.NewReader(fileDataStream))
-			//加密传输
-			_, err = fs.Encrypter.Encrypt(fs.Encrypter.Key(), bytes.NewReader(fileDataStream), peer)
-			if err != nil {
-				return
-			}
-			if err != nil {
-				log.Fatalf("Error streaming data to %s: %s\n", peer, err)
-			}
-			log.Printf("[%s] send file to %s\n", fs.ListenAddr, peer.RemoteAddr())
-		}(peer)
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Get 获取文件 返回的reader在读取时才解密 使用完之后需要Close
+func (fs *FileServer) Get(key string) (io.ReadCloser, error) {
+	if fs.Erasure.Enabled() {
+		return fs.GetErasure(key)
+	}
+	return fs.getReplicated(key)
+}
+
+// getReplicated 本节点负责key时获取文件并保存副本
+// 不负责时只从网络中按需读取 不保存副本 否则每次读取都会增加一个副本
+func (fs *FileServer) getReplicated(key string) (io.ReadCloser, error) {
+	if !fs.store.Exists(key) && !fs.ownsKey(key) {
+		return fs.openRemote(key)
+	}
+	if err := fs.fetch(key); err != nil {
+		return nil, err
 	}
+	return fs.openDecrypt(key), nil
 }
 
-func (fs *FileServer) Get(key string) (io.Reader, error) {
-head:
+// fetch 本地没有该文件时从网络中获取并存储到本地 已经删除的文件返回ErrFileDeleted
+func (fs *FileServer) fetch(key string) error {
 	if fs.store.Exists(key) {
 		log.Printf("[%s] file : %s exists\n", fs.ListenAddr, key)
-		dst := new(bytes.Buffer)
-		err := fs.store.ReadDecrypt(key, fs.Encrypter, dst)
-		if err != nil {
-			return nil, err
-		}
-		return dst, nil
+		return nil
+	}
+	if _, ok := fs.store.Tombstone(key); ok {
+		return fmt.Errorf("%s: %w", key, ErrFileDeleted)
 	}
-	log.Printf("[%s] file not found,will search on network..", fs.ListenAddr)
+	// 同一个key同一时间只有一个获取操作写入本地未完成的文件
+	unlock := fs.fetchLocks.Lock(key)
+	defer unlock()
+	if fs.store.Exists(key) {
+		return nil
+	}
+	// 之前中断的传输从已经收到的位置继续 不知道已收到部分的版本时从头获取
+	offset := fs.store.PartialSize(key)
+	version, ok := fs.store.PartialVersion(key)
+	if !ok {
+		offset = 0
+	}
+	log.Printf("[%s] file not found,will search on network from offset %d..", fs.ListenAddr, offset)
 	msg := Message{
 		Payload: MessageGetFile{
-			Key: key,
+			Key:     key,
+			Offset:  offset,
+			Version: version,
 		},
 	}
-	fs.broadcast(&msg)
-	time.Sleep(1 * time.Second)
-	fileBuffer := new(bytes.Buffer)
-	fileBufferCh := make(chan struct{})
-	for _, peer := range fs.peers {
-		go func(p p2p.Peer) {
-			defer p.CloseStream()
-			fileBuffer = new(bytes.Buffer)
-			fileSize := int64(0)
-			err := binary.Read(p, binary.LittleEndian, &fileSize)
-			if err != nil {
-				return
-			}
-			_, err = io.CopyN(fileBuffer, p, fileSize)
-			log.Printf("[%s] get file from peer %s\n", fs.ListenAddr, p.RemoteAddr())
-			if err != nil {
-				log.Fatalf("Error reading data from %s: %s\n", p, err)
-			}
-			if fileBuffer.Len() > 0 {
-				fileBufferCh <- struct{}{}
-			}
-		}(peer)
+	err := fs.request(key, &msg, func(reply *fileReply) error {
+		return fs.receiveFile(key, reply)
+	})
+	if err == nil {
+		fs.provide(key)
 	}
-	for {
-		select {
-		case <-fileBufferCh:
-			// 将文件写入到本地
-			err := fs.store.Write(key, fileBuffer)
-			if err != nil {
-				return nil, err
-			}
-			goto head
-		case <-time.After(5 * time.Second):
-			return nil, fmt.Errorf("timeout waiting for file to exist")
+	return err
+}
+
+// openDecrypt 在后台边读边解密本地文件 key是CID时在读取结束时校验内容
+func (fs *FileServer) openDecrypt(key string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(fs.store.ReadDecrypt(key, fs.Encrypter, pw))
+	}()
+	if cid, err := ParseCID(key); err == nil {
+		return newCIDVerifyReader(pr, cid)
+	}
+	return pr
+}
+
+// receiveFile 将回复中从offset开始的密文追加到本地未完成的文件中
+// 收到完整的文件后才重命名为正式文件 传输中断时保留已收到的部分
+func (fs *FileServer) receiveFile(key string, reply *fileReply) error {
+	// 从头传输时记录版本 之后只从同一个版本续传
+	if reply.Offset == 0 {
+		if err := fs.store.SetPartialVersion(key, metaWritten(reply.Meta)); err != nil {
+			return err
 		}
 	}
+	n, err := fs.store.WritePartial(key, reply.Offset, reply.Body)
+	if err != nil {
+		return err
+	}
+	if n != reply.Size {
+		return fmt.Errorf("transfer of %s interrupted at %d/%d bytes", key, n, reply.Size)
+	}
+	// 对方的文件没有元数据时删除本地旧副本留下的元数据
+	return fs.store.CommitPartial(key, reply.Meta)
 }
 
 func (fs *FileServer) loop() {
 	for {
 		select {
 		case msg := <-fs.Transport.Consume():
+			if msg.Stream != nil {
+				// 数据流的头部可能还没有到达 不阻塞后续消息的处理
+				go func() {
+					if err := fs.handleStream(msg); err != nil {
+						log.Println("Error handling stream:", err)
+					}
+				}()
+				continue
+			}
 			var m Message
 			if err := gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(&m); err != nil {
 				log.Printf("Error decoding message: %s", err)
 			}
-			if err := fs.handlerMsg(msg.From.String(), &m); err != nil {
+			if err := fs.handlerMsg(peerKey(msg.FromID, msg.From), &m); err != nil {
 				log.Println("Error handling message:", err)
 			}
 		case <-fs.quit:
-			fs.Stop()
 			return
 		}
 	}
@@ -220,78 +521,275 @@ func (fs *FileServer) loop() {
 func (fs *FileServer) handlerMsg(from string, msg *Message) error {
 	switch m := msg.Payload.(type) {
 	case MessageStoreFile:
-		return fs.handleMsgStoreFile(from, m)
+		return fs.handleMsgStoreFile(from, msg.ID, m)
+	case MessageStoreAck:
+		fs.dispatchMessage(msg.ID, m)
 	case MessageGetFile:
-		return fs.handleMsgGetFile(from, m)
+		return fs.handleMsgGetFile(from, msg.ID, m)
+	case MessageGetRange:
+		return fs.handleMsgGetRange(from, msg.ID, m)
+	case MessageFindNode:
+		return fs.handleMsgFindNode(from, msg.ID, m)
+	case MessageFindValue:
+		return fs.handleMsgFindValue(from, msg.ID, m)
+	case MessageAddProvider:
+		return fs.handleMsgAddProvider(from, msg.ID, m)
+	case MessageDHTReply:
+		fs.dispatchMessage(msg.ID, m)
+	case MessagePing:
+		return fs.handleMsgPing(from, msg.ID, m)
+	case MessagePingReq:
+		return fs.handleMsgPingReq(from, msg.ID, m)
+	case MessageSync:
+		return fs.handleMsgSync(from, msg.ID, m)
+	case MessageGossipReply:
+		fs.dispatchMessage(msg.ID, m)
+	case MessageRepairDigest:
+		return fs.handleMsgRepairDigest(from, msg.ID, m)
+	case MessageRepairKeys:
+		return fs.handleMsgRepairKeys(from, msg.ID, m)
+	case MessageRepairReply:
+		fs.dispatchMessage(msg.ID, m)
+	case MessageDeleteFile:
+		return fs.handleMsgDeleteFile(from, m)
 	default:
 		log.Printf("Unrecognized message from %s", m)
 	}
 	return nil
 }
 
-// 处理文件存储的请求
-func (fs *FileServer) handleMsgStoreFile(from string, msg MessageStoreFile) error {
-	//log.Printf("Handling store file message from %s cmd : %s\n", from, msg.Key)
-	peer, ok := fs.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not found", from)
+// 处理文件存储的请求 文件数据随后以回复请求id的数据流到达
+func (fs *FileServer) handleMsgStoreFile(from string, id uint64, msg MessageStoreFile) error {
+	// 不接受删除之前的副本 没有请求等待的数据流会被丢弃
+	if t, ok := fs.deletedAfter(msg.Key, msg.Time); ok {
+		return fmt.Errorf("refusing %s from %s: deleted at %s", msg.Key, from, t)
+	}
+	if fs.store.Exists(msg.Key) && fs.store.Written(msg.Key).After(msg.Time) {
+		return fmt.Errorf("refusing %s from %s: %w", msg.Key, from, ErrStaleVersion)
 	}
-	defer func() {
+	req := fs.addPending(id, from)
+	go func() {
+		defer fs.removePending(id)
+		reply, err := req.wait()
+		if err != nil {
+			log.Printf("[%s] Error storing file %s from %s: %s\n", fs.ListenAddr, msg.Key, from, err)
+			return
+		}
+		defer reply.Close()
+		// 先写入未完成的文件 连接中断时保留已收到的部分 之后获取该文件时可以继续传输
+		if err := fs.receiveFile(msg.Key, reply); err != nil {
+			log.Printf("[%s] Error storing file %s from %s: %s\n", fs.ListenAddr, msg.Key, from, err)
+			return
+		}
 		log.Printf("[%s] Compting store file from %s", fs.ListenAddr, from)
-		peer.CloseStream()
+		fs.provide(msg.Key)
+		if err := fs.reply(from, id, MessageStoreAck{Key: msg.Key}); err != nil {
+			log.Printf("[%s] Error confirming %s to %s: %s\n", fs.ListenAddr, msg.Key, from, err)
+		}
 	}()
-	return fs.store.Write(msg.Key, io.LimitReader(peer, msg.Size))
+	return nil
 }
 
-// 处理获取文件的请求
-func (fs *FileServer) handleMsgGetFile(from string, msg MessageGetFile) error {
-	if !fs.store.Exists(msg.Key) {
-		return fmt.Errorf("file not found on %s\n", from)
+// 处理获取文件的请求 从请求方已经收到的位置开始发送
+// 请求方收到的部分属于其他版本时 拼接起来的密文无法解密 从头发送
+func (fs *FileServer) handleMsgGetFile(from string, id uint64, msg MessageGetFile) error {
+	offset := msg.Offset
+	if offset > 0 && !fs.store.Written(msg.Key).Equal(msg.Version) {
+		offset = 0
 	}
-	n, r, err := fs.store.Read(msg.Key)
-	defer func(r io.ReadCloser) {
-		_ = r.Close()
-	}(r)
-	if err != nil {
-		return err
+	return fs.replyFile(from, id, msg.Key, offset, -1)
+}
+
+// replyFile 本地有该文件时在后台回复给请求方 传输文件时继续处理其他消息
+func (fs *FileServer) replyFile(from string, id uint64, key string, offset, length int64) error {
+	if !fs.store.Exists(key) {
+		return fmt.Errorf("file not found on %s\n", from)
 	}
-	peer, ok := fs.peers[from]
+	peer, ok := fs.getPeer(from)
 	if !ok {
 		return fmt.Errorf("peer %s not found", from)
 	}
-	// copy文件给广播节点
-	err = peer.Send([]byte{p2p.IncomingStream})
-	fileSize := n
-	err = binary.Write(peer, binary.LittleEndian, &fileSize)
-	if err != nil {
-		return err
+	go func() {
+		if err := fs.sendFile(peer, id, key, offset, length); err != nil {
+			log.Printf("[%s] Error sending file %s to %s: %s\n", fs.ListenAddr, key, from, err)
+			return
+		}
+		log.Printf("[%s] find file %s,sending to %s\n", fs.ListenAddr, key, from)
+	}()
+	return nil
+}
+
+// RotateKey 切换到新的密钥 并在后台用新密钥重新加密本地存储的数据密钥和旧文件
+func (fs *FileServer) RotateKey(key []byte) error {
+	encrypter, ok := fs.Encrypter.(*KeyringEncrypter)
+	if !ok {
+		return fmt.Errorf("encrypter %T does not support key rotation", fs.Encrypter)
 	}
-	if _, err = io.Copy(peer, r); err != nil {
+	id, err := encrypter.Keyring.Rotate(key)
+	if err != nil {
 		return err
 	}
-	log.Printf("[%s] find file %s,sending to %s\n", fs.ListenAddr, msg.Key, peer.RemoteAddr())
+	log.Printf("[%s] rotated to key %s, re-encrypting stored files..\n", fs.ListenAddr, id)
+	go func() {
+		n, err := fs.store.RewrapKeys(encrypter)
+		if err != nil {
+			log.Printf("[%s] Error rewrapping data keys: %s\n", fs.ListenAddr, err)
+			return
+		}
+		log.Printf("[%s] rewrapped %d data keys with key %s\n", fs.ListenAddr, n, id)
+		// 部分文件失败时其余文件仍然重新加密
+		if n, err = fs.store.ReEncrypt(encrypter); err != nil {
+			log.Printf("[%s] Error re-encrypting files: %s\n", fs.ListenAddr, err)
+		}
+		log.Printf("[%s] re-encrypted %d files with key %s\n", fs.ListenAddr, n, id)
+	}()
 	return nil
 }
 
+// Stop 停止处理消息和成员探测 并关闭transport 可以重复调用
 func (fs *FileServer) Stop() {
-	close(fs.quit)
-	err := fs.Transport.Close()
-	if err != nil {
-		log.Printf("Error closing transport %s\n", err)
+	fs.stopOnce.Do(func() {
+		fs.members.Stop()
+		close(fs.quit)
+		err := fs.Transport.Close()
+		if err != nil {
+			log.Printf("Error closing transport %s\n", err)
+		}
+		log.Printf("Quiting file server on : %s\n", fs.ListenAddr)
+	})
+}
+
+func (fs *FileServer) stopped() bool {
+	select {
+	case <-fs.quit:
+		return true
+	default:
+		return false
 	}
-	log.Printf("Quiting file server on : %s\n", fs.ListenAddr)
 }
 
 // OnPeer 连接建立成功的回调函数
 func (fs *FileServer) OnPeer(peer p2p.Peer) error {
+	if err := fs.checkTrusted(peer); err != nil {
+		return err
+	}
 	fs.Lock()
 	defer fs.Unlock()
-	fs.peers[peer.RemoteAddr().String()] = peer
-	log.Printf("[%s] connected to peer %s\n", fs.ListenAddr, peer.RemoteAddr())
+	// 同一个节点重新连接时替换旧的连接
+	fs.peers[peerName(peer)] = peer
+	fs.ring.Add(peerName(peer))
+	if supportsDHT(peer) {
+		empty := fs.dht.Table().Size() == 0
+		fs.dht.AddContact(contactOf(peer))
+		if empty {
+			fs.bootstrapDHT()
+		}
+	}
+	if supportsGossip(peer) {
+		go fs.joinMember(peer)
+	}
+	info := peer.Info()
+	log.Printf("[%s] connected to peer %s at %s (version %d, capabilities %v)\n",
+		fs.ListenAddr, peerName(peer), peer.RemoteAddr(), info.Version, info.Capabilities)
+	return nil
+}
+
+// OnPeerClosed 连接断开的回调函数 已经被新的连接替换时保留新的连接
+// 否则从peers中删除 等待该节点回复的请求立即失败 并为它负责的key补充副本
+func (fs *FileServer) OnPeerClosed(peer p2p.Peer) {
+	name := peerName(peer)
+	fs.Lock()
+	current := fs.peers[name] == peer
+	if current {
+		delete(fs.peers, name)
+	}
+	fs.Unlock()
+	if !current {
+		return
+	}
+	log.Printf("[%s] disconnected from peer %s\n", fs.ListenAddr, name)
+	fs.failPending(name)
+	if fs.stopped() {
+		return
+	}
+	fs.conns.Wake()
+	go fs.rereplicate(name)
+}
+
+// rereplicate 将lost负责的本地文件补充到哈希环上接替它的节点
+// 只由接替后负责该key的第一个节点发送 避免持有副本的节点都重复发送
+func (fs *FileServer) rereplicate(lost string) {
+	keys, err := fs.replicatedKeys()
+	if err != nil {
+		log.Printf("[%s] Error listing local files: %s\n", fs.ListenAddr, err)
+		return
+	}
+	self := fs.NodeID.String()
+	n := 0
+	for _, key := range keys {
+		before := fs.ring.OwnersFunc(key, fs.ReplicationFactor, func(m string) bool {
+			return m == lost || fs.available(m)
+		})
+		if !slices.Contains(before, lost) {
+			continue
+		}
+		after := fs.replicaOwners(key)
+		if len(after) == 0 || after[0] != self {
+			continue
+		}
+		var peers []p2p.Peer
+		for _, name := range after {
+			if slices.Contains(before, name) {
+				continue
+			}
+			if peer, ok := fs.getPeer(name); ok {
+				peers = append(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			continue
+		}
+		if err := fs.pushTo(peers, key); err != nil {
+			log.Printf("[%s] Error re-replicating %s: %s\n", fs.ListenAddr, key, err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		log.Printf("[%s] re-replicated %d files held by %s\n", fs.ListenAddr, n, lost)
+	}
+}
+
+// checkTrusted 按对方经过验证的身份而不是地址决定是否信任
+func (fs *FileServer) checkTrusted(peer p2p.Peer) error {
+	if len(fs.TrustedNodes) == 0 {
+		return nil
+	}
+	id, ok := peer.Identity()
+	if !ok {
+		return fmt.Errorf("peer %s has no verified identity", peerName(peer))
+	}
+	if !slices.Contains(fs.TrustedNodes, id) {
+		return fmt.Errorf("peer %s at %s is not trusted", id, peer.RemoteAddr())
+	}
 	return nil
 }
 
 func init() {
 	gob.Register(MessageGetFile{})
 	gob.Register(MessageStoreFile{})
+	gob.Register(MessageStoreAck{})
+	gob.Register(MessageGetRange{})
+	gob.Register(MessageFindNode{})
+	gob.Register(MessageFindValue{})
+	gob.Register(MessageAddProvider{})
+	gob.Register(MessageDHTReply{})
+	gob.Register(MessagePing{})
+	gob.Register(MessagePingReq{})
+	gob.Register(MessageSync{})
+	gob.Register(MessageGossipReply{})
+	gob.Register(MessageRepairDigest{})
+	gob.Register(MessageRepairKeys{})
+	gob.Register(MessageRepairReply{})
+	gob.Register(MessageDeleteFile{})
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"Etherfile/p2p"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) *FileServer {
+	return NewFileServer(FileServerOpts{
+		Encrypter:         NewGCMEncrypter(),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: SHA1PathTransformFunc,
+		Transport:         p2p.NewTCPTransport(p2p.TCPTransportOpts{}),
+	})
+}
+
+func TestFileServer_StoreContent(t *testing.T) {
+	fs := newTestServer(t)
+	data := []byte("content addressed bytes")
+
+	cid, err := fs.StoreContent(bytes.NewReader(data))
+	assert.Nil(t, err)
+	parsed, err := ParseCID(cid.String())
+	assert.Nil(t, err)
+	assert.Equal(t, cid, parsed)
+
+	// 相同内容得到相同的CID 并且不会重新写入
+	meta, err := fs.store.ReadMeta(cid.String())
+	assert.Nil(t, err)
+	again, err := fs.StoreContent(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, cid, again)
+	metaAgain, err := fs.store.ReadMeta(cid.String())
+	assert.Nil(t, err)
+	assert.Equal(t, meta, metaAgain)
+
+	r, err := fs.Get(cid.String())
+	assert.Nil(t, err)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestFileServer_GetCIDMismatch(t *testing.T) {
+	fs := newTestServer(t)
+	cid, err := ComputeCID(bytes.NewReader([]byte("expected content")))
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Store(cid.String(), bytes.NewReader([]byte("something else"))))
+
+	r, err := fs.Get(cid.String())
+	assert.Nil(t, err)
+	defer r.Close()
+	_, err = io.ReadAll(r)
+	assert.True(t, errors.Is(err, ErrCIDMismatch))
+
+	_, err = ParseCID("sha256-not-hex")
+	assert.Equal(t, ErrInvalidCID, err)
+}
+
+// identityPeer 只用于检查信任的节点
+type identityPeer struct {
+	p2p.Peer
+	id       p2p.NodeID
+	verified bool
+}
+
+func (p identityPeer) Identity() (p2p.NodeID, bool) { return p.id, p.verified }
+func (p identityPeer) Info() p2p.PeerInfo           { return p2p.PeerInfo{NodeID: p.id} }
+func (p identityPeer) RemoteAddr() net.Addr         { return &net.TCPAddr{Port: 3000} }
+
+func TestFileServer_TrustedNodes(t *testing.T) {
+	fs := newTestServer(t)
+	trusted, other := p2p.NewNodeID(), p2p.NewNodeID()
+	assert.Nil(t, fs.checkTrusted(identityPeer{id: other}))
+
+	fs.TrustedNodes = []p2p.NodeID{trusted}
+	assert.Nil(t, fs.checkTrusted(identityPeer{id: trusted, verified: true}))
+	assert.NotNil(t, fs.checkTrusted(identityPeer{id: other, verified: true}))
+	// 没有经过验证的身份不能仅凭声明被信任
+	assert.NotNil(t, fs.checkTrusted(identityPeer{id: trusted}))
+}
+
+func TestLoadOrCreateNodeID(t *testing.T) {
+	root := t.TempDir()
+	id, err := LoadOrCreateNodeID(root)
+	assert.Nil(t, err)
+	assert.False(t, id.IsZero())
+
+	// 重启之后以及清空存储之后标识不变
+	fs := NewFileServer(FileServerOpts{StorageRoot: root, Encrypter: NewGCMEncrypter(), PathTransformFunc: SHA1PathTransformFunc})
+	assert.Equal(t, id, fs.NodeID)
+	assert.Nil(t, fs.Store("key", bytes.NewReader([]byte("data"))))
+	assert.Nil(t, fs.store.Clear())
+	assert.False(t, fs.store.Exists("key"))
+	again, err := LoadOrCreateNodeID(root)
+	assert.Nil(t, err)
+	assert.Equal(t, id, again)
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	legacy := filepath.Join(t.TempDir(), "node_identity.json")
+	old, err := p2p.LoadOrCreateIdentity(legacy)
+	assert.Nil(t, err)
+
+	// 旧位置的身份被移动到存储根目录下 节点标识不变
+	id, err := LoadOrCreateIdentity(root, legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, old.NodeID(), id.NodeID())
+	_, err = os.Stat(legacy)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	again, err := LoadOrCreateIdentity(root, legacy)
+	assert.Nil(t, err)
+	assert.Equal(t, old.NodeID(), again.NodeID())
+}
+
+func TestFileServer_StoreOnlyOnOwners(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	addrs := []string{"127.0.0.1:4470", "127.0.0.1:4471", "127.0.0.1:4472", "127.0.0.1:4473", "127.0.0.1:4474"}
+	nodes := make([]*FileServer, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = newClusterNode(t, kr, FileServerOpts{ListenAddr: addr, ReplicationFactor: 2}, addrs[:i]...)
+		t.Cleanup(nodes[i].Stop)
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return len(n.peerList()) == len(nodes)-1 }, 3*time.Second, 20*time.Millisecond)
+	}
+
+	// 写入节点不负责的key 在负责的节点确认之后也从写入节点删除
+	writer := nodes[0]
+	keys := make([]string, 8)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("placed_file_%d", i)
+		assert.Nil(t, writer.Store(keys[i], bytes.NewReader([]byte(keys[i]))))
+	}
+	for _, key := range keys {
+		owners := writer.replicaOwners(key)
+		assert.Len(t, owners, 2)
+		slices.Sort(owners)
+		assert.Eventually(t, func() bool {
+			var holders []string
+			for _, n := range nodes {
+				if n.store.Exists(key) {
+					holders = append(holders, n.NodeID.String())
+				}
+			}
+			slices.Sort(holders)
+			return slices.Equal(holders, owners)
+		}, 3*time.Second, 20*time.Millisecond, key)
+	}
+
+	// 写入节点仍然可以读取 读取不负责的key之后也不保存副本
+	for _, key := range keys {
+		owned := writer.ownsKey(key)
+		r, err := writer.Get(key)
+		assert.Nil(t, err)
+		got, err := io.ReadAll(r)
+		r.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, key, string(got))
+		assert.Equal(t, owned, writer.store.Exists(key))
+		assert.Equal(t, int64(0), writer.store.PartialSize(key))
+	}
+}
+
+func TestFileServer_ResumeRewrittenFile(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	addrs := []string{"127.0.0.1:4490", "127.0.0.1:4491"}
+	a := newClusterNode(t, kr, FileServerOpts{ListenAddr: addrs[0]})
+	t.Cleanup(a.Stop)
+	time.Sleep(50 * time.Millisecond)
+	b := newClusterNode(t, kr, FileServerOpts{ListenAddr: addrs[1]}, addrs[0])
+	t.Cleanup(b.Stop)
+	assert.Eventually(t, func() bool { return len(a.peerList()) == 1 && len(b.peerList()) == 1 }, 3*time.Second, 20*time.Millisecond)
+
+	key := "rewritten_file"
+	old := bytes.Repeat([]byte("old version "), 4096)
+	assert.Nil(t, a.Store(key, bytes.NewReader(old)))
+	assert.Eventually(t, func() bool { return b.store.Exists(key) }, 3*time.Second, 20*time.Millisecond)
+	_, f, err := b.store.Read(key)
+	assert.Nil(t, err)
+	stale, err := io.ReadAll(f)
+	f.Close()
+	assert.Nil(t, err)
+	version := b.store.Written(key)
+
+	// 重新写入之后 b上留下旧版本中断时收到的部分
+	time.Sleep(10 * time.Millisecond)
+	data := bytes.Repeat([]byte("new version "), 4096)
+	assert.Nil(t, a.Store(key, bytes.NewReader(data)))
+	assert.Eventually(t, func() bool { return b.store.Written(key).Equal(a.store.Written(key)) }, 3*time.Second, 20*time.Millisecond)
+	assert.Nil(t, b.store.Delete(key))
+	assert.Nil(t, b.store.SetPartialVersion(key, version))
+	_, err = b.store.WritePartial(key, 0, bytes.NewReader(stale[:len(stale)/2]))
+	assert.Nil(t, err)
+
+	// 版本不同 从头获取新版本 不拼接旧版本的部分
+	r, err := b.Get(key)
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	assert.True(t, a.store.Written(key).Equal(b.store.Written(key)))
+	_, ok := b.store.PartialVersion(key)
+	assert.False(t, ok)
+}
+
+func TestFileServer_RereplicateOnPeerClosed(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	addrs := []string{"127.0.0.1:4430", "127.0.0.1:4431", "127.0.0.1:4432", "127.0.0.1:4433"}
+	nodes := make(map[string]*FileServer, len(addrs))
+	var writer *FileServer
+	for i, addr := range addrs {
+		n := newClusterNode(t, kr, FileServerOpts{ListenAddr: addr, ReplicationFactor: 2}, addrs[:i]...)
+		// 退出的节点再次Stop不会有影响
+		t.Cleanup(n.Stop)
+		nodes[n.NodeID.String()] = n
+		if writer == nil {
+			writer = n
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return len(n.peerList()) == len(nodes)-1 }, 3*time.Second, 20*time.Millisecond)
+	}
+
+	// 选择由写入节点负责的key 接替的节点原本没有副本
+	var key string
+	var owners []string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("rereplicated_file_%d", i)
+		owners = writer.ring.Owners(key, 2)
+		if slices.Contains(owners, writer.NodeID.String()) {
+			break
+		}
+	}
+	assert.Nil(t, writer.Store(key, bytes.NewReader([]byte("survives a lost replica"))))
+	for _, name := range owners {
+		assert.Eventually(t, func() bool { return nodes[name].store.Exists(key) }, 3*time.Second, 20*time.Millisecond)
+	}
+
+	// 负责该key的另一个节点退出后 哈希环上接替它的节点收到副本
+	lost := owners[0]
+	if nodes[lost] == writer {
+		lost = owners[1]
+	}
+	after := writer.ring.OwnersFunc(key, 2, func(m string) bool { return m != lost })
+	replacement := after[len(after)-1]
+	assert.False(t, nodes[replacement].store.Exists(key))
+	nodes[lost].Stop()
+	assert.Eventually(t, func() bool { return nodes[replacement].store.Exists(key) }, 3*time.Second, 20*time.Millisecond)
+}
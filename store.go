@@ -1,17 +1,30 @@
 package main
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 const (
 	DefaultRootName = "etherPath"
+	tmpSuffix       = ".tmp"
+	partialSuffix   = ".part"
+	// 未完成的文件对应的版本 续传时发送给对方 对方的版本不同时从头传输
+	partialVersionSuffix = ".part.version"
+	// 文件的原始key 存储路径是key的哈希 无法从路径还原key
+	keySuffix = ".key"
 )
 
+// ErrStaleVersion 本地已经有更新版本的文件
+var ErrStaleVersion = errors.New("store: newer version already stored")
+
 type StoreOpts struct {
 	Root              string
 	PathTransformFunc PathTransformFunc
@@ -19,6 +32,8 @@ type StoreOpts struct {
 
 type Store struct {
 	StoreOpts
+	// 提交和删除同一个key时互斥 保证墓碑的检查和文件的重命名之间不会插入删除
+	locks keyMutex
 }
 
 func NewStore(opts StoreOpts) *Store {
@@ -28,46 +43,143 @@ func NewStore(opts StoreOpts) *Store {
 	if len(opts.Root) == 0 {
 		opts.Root = DefaultRootName
 	}
-	return &Store{opts}
+	return &Store{StoreOpts: opts}
 }
 
-func (s *Store) writeEncrypt(key string, encrypter Encrypter, src io.Reader) error {
-	// 加密当前文件 并且加入缓冲区
-	encryptedBuffer := new(bytes.Buffer)
-	if _, err := encrypter.Encrypt(encrypter.Key(), src, encryptedBuffer); err != nil {
-		return err
+// StagedFile 已经写入存储根目录下临时文件的文件 Commit之后才能通过key读取
+// version是文件的版本 没有元数据的文件以写入临时文件的时间为版本
+type StagedFile struct {
+	tmpPath string
+	meta    []byte
+	version time.Time
+}
+
+// stage 将内容写入临时文件 写入失败时删除临时文件
+func (s *Store) stage(meta []byte, write func(io.Writer) error) (*StagedFile, error) {
+	if err := os.MkdirAll(s.Root, os.ModePerm); err != nil {
+		return nil, err
 	}
+	tmp, err := os.CreateTemp(s.Root, "*"+tmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	version := metaWritten(meta)
+	if version.IsZero() {
+		version = time.Now()
+	}
+	return &StagedFile{tmpPath: tmp.Name(), meta: meta, version: version}, nil
+}
 
-	// 将加密后的数据写入存储
-	if err := s.writeStream(key, encryptedBuffer); err != nil {
-		return err
+// StageEncrypt 使用随机生成的数据密钥将src直接加密到临时文件 数据密钥用主密钥加密后保存在元数据中
+func (s *Store) StageEncrypt(encrypter Encrypter, src io.Reader) (*StagedFile, error) {
+	dataKey := encrypter.KeyGeneration()
+	if dataKey == nil {
+		return nil, errors.New("store: failed to generate data key")
 	}
-	return nil
+	meta, err := wrapDataKey(encrypter, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return s.stage(meta, func(w io.Writer) error {
+		_, err := encrypter.Encrypt(dataKey, src, w)
+		return err
+	})
 }
 
-func (s *Store) writeStream(key string, r io.Reader) error {
-	// 路径名转换
-	pathKey := s.PathTransformFunc(key)
+// Commit 将临时文件重命名为key对应的文件 key在文件的版本之后被删除时返回ErrFileDeleted
+func (s *Store) Commit(key string, f *StagedFile) error {
+	return s.commit(key, f.tmpPath, f.meta, f.version)
+}
 
-	//log.Printf("row key : %s,  pathKey : %s ", key, pathKey)
+// commit 在key的锁内检查墓碑 写入元数据和key记录 然后将path重命名为key对应的文件
+func (s *Store) commit(key, path string, meta []byte, version time.Time) error {
+	pathKey := s.PathTransformFunc(key)
 	if err := os.MkdirAll(s.Root+"/"+pathKey.PathName, os.ModePerm); err != nil {
 		return err
 	}
-
-	// 拼接路径和文件名
+	unlock := s.locks.Lock(key)
+	defer unlock()
+	// 删除之后重新写入 只清除早于这个版本的墓碑
+	if err := s.clearTombstone(key, version); err != nil {
+		return err
+	}
+	// 不用旧版本覆盖本地更新的副本
+	if s.Exists(key) && s.Written(key).After(version) {
+		return fmt.Errorf("%w: %s", ErrStaleVersion, key)
+	}
+	// 先写元数据再写文件 保证文件存在时一定能找到它的数据密钥
+	// 没有元数据时删除旧文件留下的元数据 否则会用旧的数据密钥解密新文件
+	if len(meta) > 0 {
+		if err := s.WriteMeta(key, meta); err != nil {
+			return err
+		}
+	} else if err := s.RemoveMeta(key); err != nil {
+		return err
+	}
+	if err := s.writeKey(key); err != nil {
+		return err
+	}
 	fullPathWithRoot := s.Root + "/" + pathKey.FullPath()
-	f, err := os.OpenFile(fullPathWithRoot, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err := os.Rename(path, fullPathWithRoot); err != nil {
+		return err
+	}
+	log.Printf("wrote %s", fullPathWithRoot)
+	return nil
+}
+
+// OpenStaged 打开临时文件读取密文 返回密文的长度
+func (s *Store) OpenStaged(f *StagedFile) (int64, io.ReadCloser, error) {
+	file, err := os.Open(f.tmpPath)
+	if err != nil {
+		return 0, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+	return fi.Size(), file, nil
+}
+
+// Discard 丢弃临时文件
+func (s *Store) Discard(f *StagedFile) error {
+	return os.Remove(f.tmpPath)
+}
+
+func (s *Store) writeEncrypt(key string, encrypter Encrypter, src io.Reader) error {
+	f, err := s.StageEncrypt(encrypter, src)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	if err := s.Commit(key, f); err != nil {
+		_ = s.Discard(f)
+		return err
+	}
+	return nil
+}
 
-	// 将内容写入文件
-	n, err := io.Copy(f, r)
+// writeStream 先写入临时文件再重命名 写入中断时不会留下不完整的文件
+func (s *Store) writeStream(key string, r io.Reader) error {
+	f, err := s.stage(nil, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	log.Printf("wrote %d bytes to %s", n, fullPathWithRoot)
+	if err := s.Commit(key, f); err != nil {
+		_ = s.Discard(f)
+		return err
+	}
 	return nil
 }
 
@@ -79,20 +191,56 @@ func (s *Store) Write(key string, r io.Reader) error {
 	return s.writeStream(key, r)
 }
 
+// fileKey 返回解密文件使用的密钥 没有元数据的旧文件直接使用主密钥
+func (s *Store) fileKey(key string, encrypter Encrypter) ([]byte, error) {
+	meta, err := s.ReadMeta(key)
+	if errors.Is(err, ErrNoMeta) {
+		return encrypter.Key(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unwrapDataKey(encrypter, meta)
+}
+
 func (s *Store) readDecrypt(key string, encrypter Encrypter, dst io.Writer) error {
+	fileKey, err := s.fileKey(key, encrypter)
+	if err != nil {
+		return err
+	}
+
 	keyPath := s.PathTransformFunc(key)
 	f, err := os.Open(s.Root + "/" + keyPath.FullPath())
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	_, err = encrypter.Decrypt(encrypter.Key(), f, dst)
+	_, err = encrypter.Decrypt(fileKey, f, dst)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// ReadDecryptRange 只解密文件中[offset, offset+length)的明文
+func (s *Store) ReadDecryptRange(key string, encrypter Encrypter, offset, length int64, dst io.Writer) error {
+	fileKey, err := s.fileKey(key, encrypter)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(s.Root + "/" + s.PathTransformFunc(key).FullPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = DecryptRange(encrypter, fileKey, f, offset, clampRange(offset, length, info.Size()), dst)
+	return err
+}
+
 func (s *Store) readStream(key string) (int64, io.ReadCloser, error) {
 	keyPath := s.PathTransformFunc(key)
 	f, err := os.Open(s.Root + "/" + keyPath.FullPath())
@@ -106,6 +254,23 @@ func (s *Store) readStream(key string) (int64, io.ReadCloser, error) {
 	return info.Size(), f, nil
 }
 
+// ReadOffset 打开文件并定位到offset处 返回文件的总大小
+func (s *Store) ReadOffset(key string, offset int64) (int64, io.ReadCloser, error) {
+	size, r, err := s.readStream(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if offset > size {
+		r.Close()
+		return 0, nil, fmt.Errorf("store: offset %d beyond size %d of %s", offset, size, key)
+	}
+	if _, err := r.(io.Seeker).Seek(offset, io.SeekStart); err != nil {
+		r.Close()
+		return 0, nil, err
+	}
+	return size, r, nil
+}
+
 func (s *Store) ReadDecrypt(key string, encrypter Encrypter, dst io.Writer) error {
 	return s.readDecrypt(key, encrypter, dst)
 }
@@ -114,17 +279,166 @@ func (s *Store) Read(key string) (int64, io.ReadCloser, error) {
 	return s.readStream(key)
 }
 
+func (s *Store) partialPath(key string) string {
+	return s.Root + "/" + s.PathTransformFunc(key).FullPath() + partialSuffix
+}
+
+// PartialSize 返回未传输完成的文件已经收到的字节数
+func (s *Store) PartialSize(key string) int64 {
+	info, err := os.Stat(s.partialPath(key))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (s *Store) partialVersionPath(key string) string {
+	return s.Root + "/" + s.PathTransformFunc(key).FullPath() + partialVersionSuffix
+}
+
+// SetPartialVersion 记录未完成的文件属于哪个版本 从头开始传输时写入
+func (s *Store) SetPartialVersion(key string, version time.Time) error {
+	pathKey := s.PathTransformFunc(key)
+	if err := os.MkdirAll(s.Root+"/"+pathKey.PathName, os.ModePerm); err != nil {
+		return err
+	}
+	return writeTime(s.partialVersionPath(key), version)
+}
+
+// PartialVersion 返回未完成的文件的版本 没有记录版本时返回false 这样的文件不能续传
+func (s *Store) PartialVersion(key string) (time.Time, bool) {
+	return readTime(s.partialVersionPath(key))
+}
+
+// WritePartial 从offset处开始将r写入未完成的文件 offset之后已有的内容会被丢弃 返回写入后的大小
+// 传输中断时已经写入的内容会保留 下次可以从返回的大小处继续
+func (s *Store) WritePartial(key string, offset int64, r io.Reader) (int64, error) {
+	pathKey := s.PathTransformFunc(key)
+	if err := os.MkdirAll(s.Root+"/"+pathKey.PathName, os.ModePerm); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(s.partialPath(key), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	return offset + n, err
+}
+
+// CommitPartial 传输完成后写入元数据 并将未完成的文件重命名为key对应的文件
+// 文件的版本是元数据中的写入时间 key在这之后被删除时丢弃收到的文件并返回ErrFileDeleted
+func (s *Store) CommitPartial(key string, meta []byte) error {
+	err := s.commit(key, s.partialPath(key), meta, metaWritten(meta))
+	if errors.Is(err, ErrFileDeleted) || errors.Is(err, ErrStaleVersion) {
+		_ = os.Remove(s.partialPath(key))
+	}
+	if err == nil || errors.Is(err, ErrFileDeleted) || errors.Is(err, ErrStaleVersion) {
+		_ = os.Remove(s.partialVersionPath(key))
+	}
+	return err
+}
+
+func (s *Store) keyPath(key string) string {
+	return s.Root + "/" + s.PathTransformFunc(key).FullPath() + keySuffix
+}
+
+// lockPath 找到存储路径对应的原始key并加锁 与提交和删除这个key互斥
+// 记录key之前写入的旧文件找不到key 不加锁
+func (s *Store) lockPath(fullPath string) (string, func()) {
+	key, err := os.ReadFile(fullPath + keySuffix)
+	if err != nil {
+		return "", func() {}
+	}
+	return string(key), s.locks.Lock(string(key))
+}
+
+// writeKey 在文件旁记录原始key 供Keys列出本地存储的文件
+func (s *Store) writeKey(key string) error {
+	return writeFileAtomic(s.keyPath(key), []byte(key))
+}
+
+// Keys 列出本地存储的所有文件的key 不包括记录key之前写入的旧文件和未传输完成的文件
+func (s *Store) Keys() ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, keySuffix) {
+			return nil
+		}
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if s.Exists(string(key)) {
+			keys = append(keys, string(key))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Delete 删除key对应的文件和它的元数据 key记录与未完成的部分 之后删除变为空的上级目录
+// 其他key可能与它共用上级目录 不能删除整个目录 墓碑保留
 func (s *Store) Delete(key string) error {
-	keyPath := s.PathTransformFunc(key)
-	defer func() {
-		log.Println("Deleted file:", keyPath.FileName)
-	}()
-	root := keyPath.RootPath()
-	return os.RemoveAll(s.Root + "/" + root)
+	pathKey := s.PathTransformFunc(key)
+	fullPath := s.Root + "/" + pathKey.FullPath()
+	for _, path := range []string{fullPath, s.metaPath(key), s.keyPath(key), s.partialPath(key), s.partialVersionPath(key)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	s.pruneEmptyDirs(filepath.Dir(fullPath))
+	log.Println("Deleted file:", pathKey.FileName)
+	return nil
 }
 
+// pruneEmptyDirs 从dir开始向上删除空目录 直到遇到非空目录或者存储根目录
+func (s *Store) pruneEmptyDirs(dir string) {
+	root := filepath.Clean(s.Root)
+	for dir = filepath.Clean(dir); dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// Clear 删除所有存储的数据 保留根目录下以.开头的文件(如节点标识)
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	entries, err := os.ReadDir(s.Root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(s.Root, e.Name())
+		if !e.IsDir() && s.isReservedPath(path) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isReservedPath 存储根目录下以.开头的文件不属于存储的数据
+func (s *Store) isReservedPath(path string) bool {
+	return filepath.Clean(filepath.Dir(path)) == filepath.Clean(s.Root) &&
+		strings.HasPrefix(filepath.Base(path), ".")
 }
 
 func (s *Store) Exists(key string) bool {
@@ -136,3 +450,96 @@ func (s *Store) Exists(key string) bool {
 	}
 	return true
 }
+
+// Stat 返回key对应文件的信息
+func (s *Store) Stat(key string) (os.FileInfo, error) {
+	return os.Stat(s.Root + "/" + s.PathTransformFunc(key).FullPath())
+}
+
+// ReEncrypt 遍历存储中没有元数据的旧文件 将不是用当前密钥加密的文件用当前密钥重新加密
+// 每个文件在它的key的锁内先写入同目录下的临时文件再重命名覆盖 返回重新加密的文件数
+// 无法重新加密的文件记录日志后跳过 最后返回失败的文件数
+// 使用信封加密的文件只需要 RewrapKeys
+func (s *Store) ReEncrypt(encrypter *KeyringEncrypter) (int, error) {
+	activeID, activeKey := encrypter.Keyring.Active()
+	count, failed := 0, 0
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, tmpSuffix) || strings.HasSuffix(path, metaSuffix) ||
+			strings.HasSuffix(path, keySuffix) || strings.HasSuffix(path, tombstoneSuffix) ||
+			strings.HasSuffix(path, partialSuffix) || strings.HasSuffix(path, partialVersionSuffix) ||
+			s.isReservedPath(path) {
+			return nil
+		}
+		done, err := s.reEncryptFile(path, encrypter, activeID, activeKey)
+		if err != nil {
+			log.Printf("Error re-encrypting %s: %s\n", path, err)
+			failed++
+			return nil
+		}
+		if done {
+			count++
+		}
+		return nil
+	})
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("store: failed to re-encrypt %d files", failed)
+	}
+	return count, err
+}
+
+func (s *Store) reEncryptFile(path string, encrypter *KeyringEncrypter, activeID KeyID, activeKey []byte) (bool, error) {
+	key, unlock := s.lockPath(path)
+	defer unlock()
+	// 等待锁期间文件可能已经被删除 或者被使用信封加密的新文件替换
+	if key != "" {
+		if _, ok := s.Tombstone(key); ok {
+			return false, nil
+		}
+	}
+	if _, err := os.Stat(path + metaSuffix); err == nil {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	id, tagged, _, err := readKeyID(f)
+	if err != nil {
+		return false, err
+	}
+	if tagged && id == activeID {
+		return false, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "*"+tmpSuffix)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// 边解密边用当前密钥加密
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := encrypter.Decrypt(activeKey, f, pw)
+		pw.CloseWithError(err)
+	}()
+	if _, err := encrypter.Encrypt(activeKey, pr, tmp); err != nil {
+		pr.CloseWithError(err)
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
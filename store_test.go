@@ -2,8 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
 	"testing"
+	"time"
 )
 
 func Test_PathTransformFunc(t *testing.T) {
@@ -33,3 +38,147 @@ func Test_store(t *testing.T) {
 	}
 	assert.Equal(t, s.Exists(key), false)
 }
+
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := min(len(p), r.n)
+	r.n -= n
+	return n, nil
+}
+
+func Test_storeInterruptedWrite(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+	key := "interrupted_file"
+	assert.NotNil(t, s.Write(key, &failingReader{n: 1024}))
+	assert.NotNil(t, s.WriteEncrypt(key, NewGCMEncrypter(), &failingReader{n: 1024}))
+	assert.False(t, s.Exists(key))
+
+	// 临时文件也被清理掉了
+	entries, err := os.ReadDir(s.Root)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func Test_storeResumePartial(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+	key := "resumed_file"
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	// 第一次传输在中途断开
+	n, err := s.WritePartial(key, 0, io.MultiReader(bytes.NewReader(data[:4096]), &failingReader{}))
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(4096), n)
+	assert.Equal(t, int64(4096), s.PartialSize(key))
+	assert.False(t, s.Exists(key))
+
+	// 没有记录版本的部分不能续传
+	_, ok := s.PartialVersion(key)
+	assert.False(t, ok)
+	version := time.Now()
+	assert.Nil(t, s.SetPartialVersion(key, version))
+	got, ok := s.PartialVersion(key)
+	assert.True(t, ok)
+	assert.True(t, version.Equal(got))
+
+	// 从已经收到的位置继续
+	size, r, err := func() (int64, io.ReadCloser, error) {
+		src := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+		assert.Nil(t, src.Write(key, bytes.NewReader(data)))
+		return src.ReadOffset(key, s.PartialSize(key))
+	}()
+	assert.Nil(t, err)
+	defer r.Close()
+	n, err = s.WritePartial(key, s.PartialSize(key), r)
+	assert.Nil(t, err)
+	assert.Equal(t, size, n)
+	assert.Nil(t, s.CommitPartial(key, nil))
+	_, ok = s.PartialVersion(key)
+	assert.False(t, ok)
+
+	_, f, err := s.Read(key)
+	assert.Nil(t, err)
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, data, content)
+	assert.Equal(t, int64(0), s.PartialSize(key))
+}
+
+func Test_storeKeys(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+	keys, err := s.Keys()
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+
+	assert.Nil(t, s.Write("plain", bytes.NewReader([]byte("a"))))
+	assert.Nil(t, s.WriteEncrypt("encrypted", NewGCMEncrypter(), bytes.NewReader([]byte("b"))))
+	_, err = s.WritePartial("partial", 0, bytes.NewReader([]byte("c")))
+	assert.Nil(t, err)
+	keys, err = s.Keys()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"plain", "encrypted"}, keys)
+
+	// 传输完成后才列出
+	assert.Nil(t, s.CommitPartial("partial", nil))
+	keys, err = s.Keys()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"plain", "encrypted", "partial"}, keys)
+}
+
+// collidingKeys 找到SHA1路径的第一级目录相同的n个key
+func collidingKeys(n int) []string {
+	groups := make(map[string][]string)
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("colliding_key_%d", i)
+		root := SHA1PathTransformFunc(key).RootPath()
+		groups[root] = append(groups[root], key)
+		if len(groups[root]) == n {
+			return groups[root]
+		}
+	}
+}
+
+func Test_storeDeleteCollidingPrefix(t *testing.T) {
+	keys := collidingKeys(3)
+	shared := func(key string) PathKey {
+		return PathKey{PathName: "shared/chain", FileName: SHA1PathTransformFunc(key).FileName}
+	}
+	for _, transform := range []PathTransformFunc{SHA1PathTransformFunc, shared} {
+		s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: transform})
+		all := append([]string{}, keys...)
+		for i := 0; i < 20; i++ {
+			all = append(all, fmt.Sprintf("other_key_%d", i))
+		}
+		for _, key := range all {
+			assert.Nil(t, s.WriteEncrypt(key, NewGCMEncrypter(), bytes.NewReader([]byte(key))))
+		}
+
+		// 只删除目标文件 共用上级目录的其他文件保留
+		assert.Nil(t, s.Delete(keys[0]))
+		assert.False(t, s.Exists(keys[0]))
+		_, err := s.ReadMeta(keys[0])
+		assert.ErrorIs(t, err, ErrNoMeta)
+		for _, key := range all[1:] {
+			assert.True(t, s.Exists(key), key)
+			_, err := s.ReadMeta(key)
+			assert.Nil(t, err)
+		}
+		listed, err := s.Keys()
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, all[1:], listed)
+
+		// 全部删除后不留下空目录
+		for _, key := range all[1:] {
+			assert.Nil(t, s.Delete(key))
+		}
+		entries, err := os.ReadDir(s.Root)
+		assert.Nil(t, err)
+		assert.Empty(t, entries)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/**
+分布式删除: 删除文件时在本地记录带有删除时间的墓碑 并通知所有节点删除各自的副本
+文件的版本是元数据中记录的原始写入时间 随副本复制不变 不晚于墓碑的副本不会再被接受
+提交文件和删除文件在同一个key的锁内检查墓碑 反熵修复时持有旧副本的节点会收到墓碑并删除副本
+删除之后重新写入时新文件的版本晚于墓碑 提交时墓碑被清除
+墓碑保留TombstoneGracePeriod之后回收 宽限期内一直没有连接的节点上的旧副本在回收后可能重新出现
+纠删码存储的文件删除时读取分片清单 分片和清单一起记录墓碑并通知所有节点删除
+分片不参与反熵修复 删除时没有连接的节点上的分片不会被删除
+*/
+
+const (
+	tombstoneSuffix             = ".tomb"
+	DefaultTombstoneGracePeriod = 7 * 24 * time.Hour
+)
+
+var ErrFileDeleted = errors.New("file has been deleted")
+
+// Tombstone 被删除的key和删除时间
+type Tombstone struct {
+	Key  string
+	Time time.Time
+}
+
+// MessageDeleteFile 删除Time之前写入的key
+type MessageDeleteFile struct {
+	Key  string
+	Time time.Time
+}
+
+func (s *Store) tombstonePath(key string) string {
+	return s.Root + "/" + s.PathTransformFunc(key).FullPath() + tombstoneSuffix
+}
+
+// WriteTombstone 记录key在t时被删除
+func (s *Store) WriteTombstone(key string, t time.Time) error {
+	pathKey := s.PathTransformFunc(key)
+	if err := os.MkdirAll(s.Root+"/"+pathKey.PathName, os.ModePerm); err != nil {
+		return err
+	}
+	return writeTime(s.tombstonePath(key), t)
+}
+
+// Tombstone 返回key被删除的时间 没有墓碑时返回false
+func (s *Store) Tombstone(key string) (time.Time, bool) {
+	return readTime(s.tombstonePath(key))
+}
+
+// writeTime 以RFC3339Nano格式原子地把时间写入文件
+func writeTime(path string, t time.Time) error {
+	return writeFileAtomic(path, []byte(t.UTC().Format(time.RFC3339Nano)))
+}
+
+// readTime 读取文件中以RFC3339Nano格式记录的时间
+func readTime(path string) (time.Time, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(b))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// RemoveTombstone 删除key的墓碑 没有墓碑时不做任何事
+func (s *Store) RemoveTombstone(key string) error {
+	err := os.Remove(s.tombstonePath(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// clearTombstone 在key的锁内调用 version不晚于墓碑时返回ErrFileDeleted 否则删除更早的墓碑
+func (s *Store) clearTombstone(key string, version time.Time) error {
+	t, ok := s.Tombstone(key)
+	if !ok {
+		return nil
+	}
+	if !version.After(t) {
+		return fmt.Errorf("%s deleted at %s: %w", key, t.Format(time.RFC3339Nano), ErrFileDeleted)
+	}
+	return s.RemoveTombstone(key)
+}
+
+// DeleteBefore 记录key在t时被删除 并删除版本不晚于t的本地文件 版本晚于t的文件保留
+// 已有更晚的墓碑时不做任何事
+func (s *Store) DeleteBefore(key string, t time.Time) error {
+	unlock := s.locks.Lock(key)
+	defer unlock()
+	if old, ok := s.Tombstone(key); ok && !t.After(old) {
+		return nil
+	}
+	if s.Exists(key) {
+		if s.Written(key).After(t) {
+			return nil
+		}
+		if err := s.Delete(key); err != nil {
+			return err
+		}
+	}
+	return s.WriteTombstone(key, t)
+}
+
+// RemoveTombstonesBefore 删除早于before的墓碑 返回删除的数量
+func (s *Store) RemoveTombstonesBefore(before time.Time) (int, error) {
+	n := 0
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, tombstoneSuffix) {
+			return nil
+		}
+		// 无法解析的墓碑也一并删除
+		if t, ok := readTime(path); ok && !t.Before(before) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// Delete 删除文件 并通知所有节点删除各自的副本 纠删码存储的文件同时删除所有分片
+func (fs *FileServer) Delete(key string) error {
+	// 删除清单之前读取分片的key
+	keys := append([]string{key}, fs.erasureShardKeys(key)...)
+	now := time.Now()
+	for _, k := range keys {
+		if err := fs.deleteLocal(k, now); err != nil {
+			return err
+		}
+		fs.sendTo(fs.peerList(), &Message{Payload: MessageDeleteFile{Key: k, Time: now}})
+	}
+	return nil
+}
+
+// deleteLocal 记录t时的墓碑并删除版本在t之前的本地文件 t之后重新写入的文件保留
+func (fs *FileServer) deleteLocal(key string, t time.Time) error {
+	return fs.store.DeleteBefore(key, t)
+}
+
+// deletedAfter key是否在written之后被删除 written是副本的版本
+func (fs *FileServer) deletedAfter(key string, written time.Time) (time.Time, bool) {
+	t, ok := fs.store.Tombstone(key)
+	if !ok || !t.After(written) {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func (fs *FileServer) handleMsgDeleteFile(from string, msg MessageDeleteFile) error {
+	if err := fs.deleteLocal(msg.Key, msg.Time); err != nil {
+		return fmt.Errorf("delete %s requested by %s: %w", msg.Key, from, err)
+	}
+	log.Printf("[%s] deleted %s as requested by %s\n", fs.ListenAddr, msg.Key, from)
+	return nil
+}
+
+// collectTombstones 回收超过宽限期的墓碑
+func (fs *FileServer) collectTombstones() {
+	n, err := fs.store.RemoveTombstonesBefore(time.Now().Add(-fs.TombstoneGracePeriod))
+	if err != nil {
+		log.Printf("[%s] Error collecting tombstones: %s\n", fs.ListenAddr, err)
+		return
+	}
+	if n > 0 {
+		log.Printf("[%s] collected %d tombstones\n", fs.ListenAddr, n)
+	}
+}
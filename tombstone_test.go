@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_storeTombstones(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: SHA1PathTransformFunc})
+	_, ok := s.Tombstone("deleted")
+	assert.False(t, ok)
+	assert.Nil(t, s.RemoveTombstone("deleted"))
+
+	now := time.Now()
+	assert.Nil(t, s.WriteTombstone("deleted", now))
+	assert.Nil(t, s.WriteTombstone("old", now.Add(-time.Hour)))
+	got, ok := s.Tombstone("deleted")
+	assert.True(t, ok)
+	assert.True(t, now.Equal(got))
+
+	// 重新写入后墓碑被清除
+	assert.Nil(t, s.WriteTombstone("rewritten", now))
+	assert.Nil(t, s.Write("rewritten", bytes.NewReader([]byte("again"))))
+	_, ok = s.Tombstone("rewritten")
+	assert.False(t, ok)
+
+	// 版本不晚于墓碑的文件不能提交 墓碑保留
+	meta, err := json.Marshal(FileMeta{Version: fileMetaVersion, Written: now.Add(-time.Second)})
+	assert.Nil(t, err)
+	_, err = s.WritePartial("deleted", 0, bytes.NewReader([]byte("stale")))
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(s.CommitPartial("deleted", meta), ErrFileDeleted))
+	assert.False(t, s.Exists("deleted"))
+	assert.Equal(t, int64(0), s.PartialSize("deleted"))
+	got, ok = s.Tombstone("deleted")
+	assert.True(t, ok)
+	assert.True(t, now.Equal(got))
+
+	// 只删除版本早于删除时间的文件
+	newer, err := json.Marshal(FileMeta{Version: fileMetaVersion, Written: now.Add(time.Second)})
+	assert.Nil(t, err)
+	_, err = s.WritePartial("newer", 0, bytes.NewReader([]byte("newer")))
+	assert.Nil(t, err)
+	assert.Nil(t, s.CommitPartial("newer", newer))
+	// 旧版本不能覆盖本地更新的副本
+	_, err = s.WritePartial("newer", 0, bytes.NewReader([]byte("older")))
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(s.CommitPartial("newer", meta), ErrStaleVersion))
+	assert.Equal(t, int64(0), s.PartialSize("newer"))
+	assert.True(t, now.Add(time.Second).Equal(s.Written("newer")))
+	assert.Nil(t, s.DeleteBefore("newer", now))
+	assert.True(t, s.Exists("newer"))
+	assert.Nil(t, s.DeleteBefore("newer", now.Add(2*time.Second)))
+	assert.False(t, s.Exists("newer"))
+
+	// 只回收超过宽限期的墓碑
+	n, err := s.RemoveTombstonesBefore(now.Add(-time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	_, ok = s.Tombstone("old")
+	assert.False(t, ok)
+	_, ok = s.Tombstone("deleted")
+	assert.True(t, ok)
+}
+
+func TestFileServer_Delete(t *testing.T) {
+	kr, err := NewKeyring(NewGCMEncrypter().Key())
+	assert.Nil(t, err)
+	addrs := []string{"127.0.0.1:4450", "127.0.0.1:4451", "127.0.0.1:4452"}
+	nodes := make([]*FileServer, len(addrs))
+	for i, addr := range addrs {
+		nodes[i] = newClusterNode(t, kr, FileServerOpts{
+			ListenAddr:     addr,
+			RepairInterval: 100 * time.Millisecond,
+		}, addrs[:i]...)
+		t.Cleanup(nodes[i].Stop)
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return len(n.peerList()) == len(nodes)-1 }, 3*time.Second, 20*time.Millisecond)
+	}
+
+	key := "deleted_file"
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	assert.Nil(t, a.Store(key, bytes.NewReader([]byte("soon gone"))))
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool { return n.store.Exists(key) }, 3*time.Second, 20*time.Millisecond)
+	}
+	_, f, err := c.store.Read(key)
+	assert.Nil(t, err)
+	stale := new(bytes.Buffer)
+	_, err = stale.ReadFrom(f)
+	f.Close()
+	assert.Nil(t, err)
+	meta, err := c.store.ReadMeta(key)
+	assert.Nil(t, err)
+
+	// 所有节点都删除副本并记录墓碑
+	assert.Nil(t, a.Delete(key))
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			_, ok := n.store.Tombstone(key)
+			return ok && !n.store.Exists(key)
+		}, 3*time.Second, 20*time.Millisecond)
+	}
+	_, err = b.Get(key)
+	assert.True(t, errors.Is(err, ErrFileDeleted))
+
+	// 没有收到删除通知的节点上的旧副本 在反熵修复时被删除 不会复制到其他节点
+	// 旧副本的修改时间是现在 但是元数据中的版本早于删除
+	assert.Nil(t, c.store.RemoveTombstone(key))
+	_, err = c.store.WritePartial(key, 0, bytes.NewReader(stale.Bytes()))
+	assert.Nil(t, err)
+	assert.Nil(t, c.store.CommitPartial(key, meta))
+	assert.Eventually(t, func() bool {
+		_, ok := c.store.Tombstone(key)
+		return ok && !c.store.Exists(key)
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.False(t, a.store.Exists(key))
+	assert.False(t, b.store.Exists(key))
+
+	// 删除之后重新写入
+	assert.Nil(t, b.Store(key, bytes.NewReader([]byte("back again"))))
+	for _, n := range nodes {
+		assert.Eventually(t, func() bool {
+			_, ok := n.store.Tombstone(key)
+			return !ok && n.store.Exists(key)
+		}, 3*time.Second, 20*time.Millisecond)
+	}
+	r, err := a.Get(key)
+	assert.Nil(t, err)
+	got := new(bytes.Buffer)
+	_, err = got.ReadFrom(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, "back again", got.String())
+}